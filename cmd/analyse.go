@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/logging"
 	"github.com/xeals/signal-back/signal"
 	"github.com/xeals/signal-back/types"
 )
@@ -18,9 +21,10 @@ var Analyse = cli.Command{
 	Name:               "analyse",
 	Aliases:            []string{"analyze"},
 	Usage:              "Report information about the backup file",
-	Description:        "Perform integrity check and password validation on the entire file. \nOptionally display statistical information.",
+	Description:        "Perform integrity check and password validation on the entire file. \nOptionally display statistical information.\n"+
+	                    "When several files are given, a comparison table is printed at the end.",
 	CustomHelpTemplate: SubcommandHelp,
-	ArgsUsage:          "BACKUPFILE",
+	ArgsUsage:          "BACKUPFILE...",
 	Flags: append([]cli.Flag{
 		&cli.BoolFlag{
 			Name:  "summary, s",
@@ -34,45 +38,221 @@ var Analyse = cli.Command{
 			Name:  "body, b",
 			Usage: "Show frame body for every frame (very verbose!)",
 		},
+		&cli.BoolFlag{
+			Name:  "mime-types, m",
+			Usage: "Count each declared MIME type of attachments",
+		},
+		&cli.IntFlag{
+			Name:  "max-frames",
+			Usage: "Stop after the first `N` frames and report partial counts",
+		},
+		&cli.BoolFlag{
+			Name:  "check-password",
+			Usage: "Only check the password, against the first frame, instead of reading\n\t\t" +
+			       "the whole file. Fails with an error if the password is wrong",
+		},
+		&cli.BoolFlag{
+			Name:  "prompt-each",
+			Usage: "Prompt for a separate password for each backup file\n\t\t" +
+			       "(default is one password shared by all files)",
+		},
 	}, coreFlags...),
 	Action: func(c *cli.Context) error {
-		bf, err := setup(c)
-		if err != nil {
+		if err := setupLogging(c); err != nil {
 			return err
 		}
 
-		fmt.Println("Analysing...")
-		a, err := AnalyseFile(bf, c)
-		if err != nil {
-			return errors.WithMessage(err, "failed to analyse file")
+		paths := c.Args()
+		if len(paths) == 0 || paths[0] == "" {
+			return errors.New("must specify a Signal backup file")
+		}
+
+		opt := analyseOptions{
+			Summary: c.Bool("summary"),
+			Frames:  c.Bool("frames"),
+			Body:    c.Bool("body"),
+			MaxFrames: c.Int("max-frames"),
 		}
-		fmt.Println("Password valid, file OK")
 
-		if c.Bool("summary") {
-			for key, count := range a {
-				fmt.Printf("%v: %v\n", key, count)
+		var (
+			pass string
+			err  error
+		)
+		if !c.Bool("prompt-each") {
+			if pass, err = readPassword(c); err != nil {
+				return errors.Wrap(err, "unable to read password")
+			}
+		}
+
+		results := make([]analyseResult, 0, len(paths))
+		for _, path := range paths {
+			if len(paths) > 1 {
+				fmt.Printf("== %s ==\n", path)
+			}
+			if c.Bool("prompt-each") {
+				fmt.Fprintf(os.Stderr, "%s\n", path)
+				if pass, err = readPassword(c); err != nil {
+					return errors.Wrap(err, "unable to read password")
+				}
+			}
+
+			if c.Bool("mime-types") {
+				opt.MimeTypes = make(map[string]int)
+			}
+			opt.Examples = make(map[string]*signal.SqlStatement)
+
+			bf, err := openBackup(c, path, pass)
+			if err != nil {
+				return errors.WithMessage(err, path)
+			}
+
+			if c.Bool("check-password") {
+				err := bf.ValidatePassword()
+				bf.Close()
+				if err != nil {
+					return errors.WithMessage(err, path)
+				}
+				status(c, "Password valid")
+				continue
+			}
+
+			status(c, "Analysing...")
+			// Frame listings go to the terminal too, and would break up the meter
+			var progress *progressMeter
+			if !opt.Frames && !opt.Body {
+				progress = newProgress(c, bf.FileSize)
+			}
+			opt.Progress = nil
+			if progress != nil {
+				opt.Progress = progress.update
+			}
+			a, err := AnalyseFile(bf, opt)
+			if progress != nil {
+				progress.done()
+			}
+			if err != nil {
+				return errors.WithMessage(err, "failed to analyse file " + path)
+			}
+			// a complete file ends with an end frame
+			partial := opt.MaxFrames > 0 && a["end"] == 0
+			label := fmt.Sprintf("(first %d frames only)", a["frames"])
+			if partial {
+				status(c, "Password valid, file OK " + label)
+			} else {
+				status(c, "Password valid, file OK")
+			}
+
+			if opt.Summary {
+				keys := make([]string, 0, len(a))
+				for key := range a {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					fmt.Printf("%v: %v\n", key, a[key])
+				}
+				if partial {
+					fmt.Println(label)
+				}
+			}
+
+			if opt.MimeTypes != nil {
+				printMimeTypes(os.Stdout, opt.MimeTypes)
 			}
+
+			part := opt.Examples["stmt_insert_into_part"]
+			logging.Debugf("example part: %d %v", len(part.GetParameters()), part)
+
+			results = append(results, analyseResult{
+				path:     path,
+				version:  bf.Version,
+				fileSize: bf.FileSize,
+				counts:   a,
+			})
 		}
 
-		log.Println("\nexample part:", len(examples["stmt_insert_into_part"].GetParameters()), examples["stmt_insert_into_part"])
+		if len(results) > 1 {
+			fmt.Println()
+			printComparison(os.Stdout, results)
+		}
 
 		return nil
 	},
 }
 
-var examples = map[string]*signal.SqlStatement{}
+// analyseOptions selects what AnalyseFile reports while it reads a file.
+type analyseOptions struct {
+	Summary bool
+	Frames  bool
+	Body    bool
+
+	// If more than zero, stop reading after this many frames.
+	MaxFrames int
+
+	// If not nil, tallies the declared content type of each attachment row.
+	MimeTypes map[string]int
+
+	// If not nil, keeps the last statement of each kind counted, for debugging.
+	Examples map[string]*signal.SqlStatement
+
+	// If not nil, passed the bytes read after each frame.
+	Progress func(bytesRead, totalBytes int64)
+}
+
+type analyseResult struct {
+	path     string
+	version  uint32
+	fileSize int64
+	counts   map[string]int
+}
+
+// printComparison writes one row per analysed file.
+func printComparison(out io.Writer, results []analyseResult) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tVERSION\tFRAMES\tATTACHMENTS\tBYTES")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", r.path, r.version, r.counts["frames"], r.counts["attachment"], r.fileSize)
+	}
+	w.Flush()
+}
+
+// printMimeTypes lists each MIME type with its count, most frequent first.
+func printMimeTypes(out io.Writer, mimes map[string]int) {
+	keys := make([]string, 0, len(mimes))
+	for mime := range mimes {
+		keys = append(keys, mime)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if mimes[keys[i]] != mimes[keys[j]] {
+			return mimes[keys[i]] > mimes[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MIME TYPE\tCOUNT")
+	for _, mime := range keys {
+		note := ""
+		if _, ok := GetExtension(mime); !ok {
+			note = "(extension unknown)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", mime, mimes[mime], note)
+	}
+	w.Flush()
+}
 
 // AnalyseFile tabulates the frequency of all records in the backup file.
-func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
+func AnalyseFile(bf *types.BackupFile, opt analyseOptions) (map[string]int, error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Panicked during extraction:", r)
+			logging.Errorf("panicked during extraction: %v", r)
 		}
 	}()
 	defer bf.Close()
 
 	counts := make(map[string]int)
 	statementTypes := make(map[string]string)
+	schema := make(map[string]*types.Schema)
 	var data_sink io.Writer = ioutil.Discard
 
 	for _, caps := range []string{
@@ -92,11 +272,11 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 		statementTypes[caps] = key
 	}
 
-	if c.Bool("frames") || c.Bool("body") {
+	if opt.Frames || opt.Body {
 		desc := fmt.Sprintf("%012X: FRAME %d header:<iv:%x, salt:%x>", 0, 0, bf.IV, bf.Salt)
 		fmt.Println(desc)
 	}
-	if c.Bool("summary") {
+	if opt.Summary {
 		fmt.Println("File version", bf.Version)
 	}
 
@@ -104,7 +284,11 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 	frame_number := 1
 
 	fns := types.ConsumeFuncs{
+		ProgressFunc:   opt.Progress,
 		FrameFunc:      func(f *signal.BackupFrame, pos int64, frame_length uint32) error {
+			if opt.MaxFrames > 0 && frame_number > opt.MaxFrames {
+				return types.ErrStopConsume
+			}
 			if ended == 1 {
 				fmt.Println("*** Warning: more frames found after 'end' frame")
 				ended++
@@ -115,14 +299,14 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 				hdr := f.GetHeader()
 				desc += fmt.Sprintf(" header:<version:%d iv:%x, salt:%x>", hdr.GetVersion(), hdr.GetIv(), hdr.GetSalt())
 				counts["header"]++
-				if c.Bool("summary") {
+				if opt.Summary {
 					fmt.Println("File version ", hdr.GetVersion())
 				}
 			}
 			if f.GetVersion() != nil {
 				desc += fmt.Sprintf(" version:%d", f.GetVersion().GetVersion())
 				counts["version"]++
-				if c.Bool("summary") {
+				if opt.Summary {
 					fmt.Println("Database", f.GetVersion())
 				}
 			}
@@ -151,6 +335,10 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 				desc += fmt.Sprintf(" sticker[%d]", f.GetSticker().GetLength())
 				counts["sticker"]++
 			}
+			if fields := types.UnknownFields(f); len(fields) > 0 {
+				desc += fmt.Sprintf(" unknown%v", fields)
+				counts["unknown"]++
+			}
 			if f.End != nil {
 				desc += fmt.Sprintf(" end[%v]", f.GetEnd())
 				counts["end"]++
@@ -159,10 +347,10 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 				}
 			}
 
-			if c.Bool("frames") {
+			if opt.Frames {
 				fmt.Println(desc)
 			}
-			if c.Bool("body") {
+			if opt.Body {
 				fmt.Printf("%v\n", f)
 			}
 			frame_number++
@@ -189,7 +377,9 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 			found := false
 			for prefix, key := range statementTypes {
 				if strings.HasPrefix(stmt, prefix) {
-					examples[key] = s
+					if opt.Examples != nil {
+						opt.Examples[key] = s
+					}
 					counts[key]++
 					found = true
 				}
@@ -197,9 +387,19 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 			if !found && strings.HasPrefix(stmt, "INSERT INTO") {
 				table := strings.Split(stmt, " ")[2]
 				key := "stmt_insert_into_" + table
-				examples[key] = s
+				if opt.Examples != nil {
+					opt.Examples[key] = s
+				}
 				counts[key]++
 				found = true
+
+				if opt.MimeTypes != nil {
+					tallyMimeType(opt.MimeTypes, schema, types.Unwrap(table, `""`), s.GetParameters())
+				}
+			}
+			if opt.MimeTypes != nil && strings.HasPrefix(stmt, "CREATE TABLE ") {
+				a := strings.SplitN(stmt, " ", 4)
+				schema[types.Unwrap(a[2], `""`)] = types.NewSchema(a[3])
 			}
 			if !found {
 				counts["stmt_other"]++
@@ -211,6 +411,30 @@ func AnalyseFile(bf *types.BackupFile, c *cli.Context) (map[string]int, error) {
 	if err := bf.Consume(fns); err != nil {
 		return nil, err
 	}
+	counts["frames"] = frame_number - 1
 
 	return counts, nil
 }
+
+func tallyMimeType(mimes map[string]int, schema map[string]*types.Schema, table string, ps []*signal.SqlStatement_SqlParameter) {
+	column := ""
+	switch table {
+	case "attachment":
+		column = "content_type"
+	case "part":
+		column = "ct"
+	default:
+		return
+	}
+	sch, ok := schema[table]
+	if !ok || !sch.HasField(column) {
+		return
+	}
+	mime := "(none)"
+	if v, _ := sch.Field(ps, column); v != nil {
+		if s, ok := v.(*string); ok && s != nil {
+			mime = *s
+		}
+	}
+	mimes[mime]++
+}
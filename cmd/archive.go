@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// writeZip packs the tree under dir into a zip archive at pathName, with
+// paths relative to dir. The database of layout is added after everything
+// else. Attachments, avatars and stickers are stored as they are, since they
+// are mostly compressed already; other files are deflated. Symlinks are stored
+// as links. The archive replaces pathName only once it is complete.
+func writeZip(pathName, dir string, layout outputLayout) error {
+	last := layout.db
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel != last {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "zip")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, last)); err == nil {
+		names = append(names, last)
+	}
+
+	file, err := createTemp(pathName)
+	if err != nil {
+		return errors.Wrap(err, "zip")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	w := zip.NewWriter(file)
+	for _, name := range names {
+		if err := addZipEntry(w, dir, name, layout); err != nil {
+			return errors.Wrap(err, "zip "+name)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "zip")
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "zip")
+	}
+	return errors.Wrap(os.Rename(file.Name(), pathName), "zip")
+}
+
+func addZipEntry(w *zip.Writer, dir, name string, layout outputLayout) error {
+	pathName := filepath.Join(dir, name)
+	info, err := os.Lstat(pathName)
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Method = zip.Deflate
+	for _, folder := range []string{layout.attachments, layout.avatars, layout.stickers} {
+		if strings.HasPrefix(header.Name, filepath.ToSlash(folder)+"/") {
+			header.Method = zip.Store
+		}
+	}
+	out, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(pathName)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, filepath.ToSlash(target))
+		return err
+	}
+	_, err = readFile(pathName, func(r io.Reader) (int64, error) {
+		return io.Copy(out, r)
+	})
+	return err
+}
@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"database/sql"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// attachmentStore keeps what extraction learns from the attachment rows until
+// their frames arrive, the files waiting for their message's timestamp, and
+// the timestamps of messages already seen.
+type attachmentStore interface {
+	addRow(row, id int64, info attachmentInfo) error
+	info(id int64) (attachmentInfo, bool, error)
+	key(row int64) (int64, bool, error) // row _id -> id of info
+	addFile(msg int64, f attachmentFile) error
+	takeFiles(msg int64) ([]attachmentFile, error)
+	setMessageTime(msg int64, time int64) error
+	messageTime(msg int64) (int64, bool, error)
+	Close() error
+}
+
+// memoryAttachments is the default attachmentStore, holding everything in maps.
+type memoryAttachments struct {
+	infos map[int64]attachmentInfo
+	rows  map[int64]int64
+	files map[int64][]attachmentFile
+	times map[int64]int64
+}
+
+func newMemoryAttachments() *memoryAttachments {
+	return &memoryAttachments{
+		infos: make(map[int64]attachmentInfo),
+		rows:  make(map[int64]int64),
+		files: make(map[int64][]attachmentFile),
+		times: make(map[int64]int64),
+	}
+}
+
+func (s *memoryAttachments) addRow(row, id int64, info attachmentInfo) error {
+	s.rows[row] = id
+	s.infos[id] = info
+	return nil
+}
+
+func (s *memoryAttachments) info(id int64) (attachmentInfo, bool, error) {
+	info, ok := s.infos[id]
+	return info, ok, nil
+}
+
+func (s *memoryAttachments) key(row int64) (int64, bool, error) {
+	id, ok := s.rows[row]
+	return id, ok, nil
+}
+
+func (s *memoryAttachments) addFile(msg int64, f attachmentFile) error {
+	s.files[msg] = append(s.files[msg], f)
+	return nil
+}
+
+func (s *memoryAttachments) takeFiles(msg int64) ([]attachmentFile, error) {
+	files := s.files[msg]
+	delete(s.files, msg)
+	return files, nil
+}
+
+func (s *memoryAttachments) setMessageTime(msg int64, time int64) error {
+	s.times[msg] = time
+	return nil
+}
+
+func (s *memoryAttachments) messageTime(msg int64) (int64, bool, error) {
+	time, ok := s.times[msg]
+	return time, ok, nil
+}
+
+func (s *memoryAttachments) Close() error {
+	return nil
+}
+
+// diskAttachments is the attachmentStore for --low-mem. It keeps the same
+// information in a temporary SQLite file, so memory use no longer grows with
+// the number of attachments and messages, at the cost of a query per lookup.
+type diskAttachments struct {
+	db       *sql.DB
+	pathName string
+}
+
+const diskAttachmentsSchema = `
+CREATE TABLE info (id INTEGER PRIMARY KEY, msg INTEGER, mime TEXT, size INTEGER, name TEXT, time INTEGER, data TEXT);
+CREATE TABLE row (row INTEGER PRIMARY KEY, id INTEGER);
+CREATE TABLE file (msg INTEGER, time INTEGER, path TEXT);
+CREATE INDEX file_msg ON file (msg);
+CREATE TABLE message (id INTEGER PRIMARY KEY, time INTEGER);
+`
+
+func newDiskAttachments(pathName string) (*diskAttachments, error) {
+	os.Remove(pathName) // left over from an interrupted run
+	db, err := sql.Open("sqlite", pathName)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create attachment index")
+	}
+	// Only one connection, so the pragmas apply to every statement
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = OFF", "PRAGMA synchronous = OFF", diskAttachmentsSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			os.Remove(pathName)
+			return nil, errors.Wrap(err, "cannot create attachment index")
+		}
+	}
+	return &diskAttachments{db, pathName}, nil
+}
+
+func (s *diskAttachments) addRow(row, id int64, info attachmentInfo) error {
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO row VALUES (?, ?)", row, id); err != nil {
+		return errors.Wrap(err, "attachment index")
+	}
+	_, err := s.db.Exec("INSERT OR REPLACE INTO info VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, info.msg, info.mime, info.size, info.name, info.time, info.data)
+	return errors.Wrap(err, "attachment index")
+}
+
+func (s *diskAttachments) info(id int64) (attachmentInfo, bool, error) {
+	var (
+		info             attachmentInfo
+		mime, name, data sql.NullString
+	)
+	err := s.db.QueryRow("SELECT msg, mime, size, name, time, data FROM info WHERE id = ?", id).
+		Scan(&info.msg, &mime, &info.size, &name, &info.time, &data)
+	if err == sql.ErrNoRows {
+		return info, false, nil
+	} else if err != nil {
+		return info, false, errors.Wrap(err, "attachment index")
+	}
+	info.mime, info.name, info.data = nullString(mime), nullString(name), nullString(data)
+	return info, true, nil
+}
+
+func (s *diskAttachments) key(row int64) (int64, bool, error) {
+	var id int64
+	err := s.db.QueryRow("SELECT id FROM row WHERE row = ?", row).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return id, err == nil, errors.Wrap(err, "attachment index")
+}
+
+func (s *diskAttachments) addFile(msg int64, f attachmentFile) error {
+	_, err := s.db.Exec("INSERT INTO file VALUES (?, ?, ?)", msg, f.time, f.path)
+	return errors.Wrap(err, "attachment index")
+}
+
+func (s *diskAttachments) takeFiles(msg int64) ([]attachmentFile, error) {
+	rows, err := s.db.Query("SELECT time, path FROM file WHERE msg = ?", msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "attachment index")
+	}
+	defer rows.Close()
+
+	var files []attachmentFile
+	for rows.Next() {
+		var f attachmentFile
+		if err := rows.Scan(&f.time, &f.path); err != nil {
+			return nil, errors.Wrap(err, "attachment index")
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "attachment index")
+	}
+	rows.Close()
+
+	if len(files) > 0 {
+		if _, err := s.db.Exec("DELETE FROM file WHERE msg = ?", msg); err != nil {
+			return nil, errors.Wrap(err, "attachment index")
+		}
+	}
+	return files, nil
+}
+
+func (s *diskAttachments) setMessageTime(msg int64, time int64) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO message VALUES (?, ?)", msg, time)
+	return errors.Wrap(err, "attachment index")
+}
+
+func (s *diskAttachments) messageTime(msg int64) (int64, bool, error) {
+	var time int64
+	err := s.db.QueryRow("SELECT time FROM message WHERE id = ?", msg).Scan(&time)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return time, err == nil, errors.Wrap(err, "attachment index")
+}
+
+// Close removes the temporary file.
+func (s *diskAttachments) Close() error {
+	err := s.db.Close()
+	os.Remove(s.pathName)
+	return errors.Wrap(err, "attachment index")
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestAttachmentStores makes the same calls on both stores, which must give
+// the same answers.
+func TestAttachmentStores(t *testing.T) {
+	disk, err := newDiskAttachments(filepath.Join(t.TempDir(), "signal.db.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]attachmentStore{"memory": newMemoryAttachments(), "disk": disk}
+
+	mime, name, data := "image/png", "photo.png", "/data/part1.mms"
+	full := attachmentInfo{msg: 1, mime: &mime, size: 33, name: &name, time: 1600000000000, data: &data}
+	calls := []struct {
+		name string
+		call func(s attachmentStore) (interface{}, error)
+	}{
+		{"add with NULL mime, name and data", func(s attachmentStore) (interface{}, error) {
+			return nil, s.addRow(5, 1600000003001, attachmentInfo{msg: 1, size: 10})
+		}},
+		{"info of NULL mime, name and data", func(s attachmentStore) (interface{}, error) {
+			info, ok, err := s.info(1600000003001)
+			return []interface{}{info, ok}, err
+		}},
+		{"replace", func(s attachmentStore) (interface{}, error) {
+			return nil, s.addRow(5, 1600000003001, full)
+		}},
+		{"info replaced", func(s attachmentStore) (interface{}, error) {
+			info, ok, err := s.info(1600000003001)
+			return []interface{}{info, ok}, err
+		}},
+		{"key", func(s attachmentStore) (interface{}, error) {
+			id, ok, err := s.key(5)
+			return []interface{}{id, ok}, err
+		}},
+		{"no info", func(s attachmentStore) (interface{}, error) {
+			info, ok, err := s.info(5)
+			return []interface{}{info, ok}, err
+		}},
+		{"no key", func(s attachmentStore) (interface{}, error) {
+			id, ok, err := s.key(1600000003001)
+			return []interface{}{id, ok}, err
+		}},
+		{"add files", func(s attachmentStore) (interface{}, error) {
+			for _, f := range []attachmentFile{{0, "a"}, {2, "b"}} {
+				if err := s.addFile(1, f); err != nil {
+					return nil, err
+				}
+			}
+			return nil, s.addFile(2, attachmentFile{3, "c"})
+		}},
+		{"take files", func(s attachmentStore) (interface{}, error) {
+			return s.takeFiles(1)
+		}},
+		{"take files again", func(s attachmentStore) (interface{}, error) {
+			files, err := s.takeFiles(1)
+			return len(files), err
+		}},
+		{"take other files", func(s attachmentStore) (interface{}, error) {
+			return s.takeFiles(2)
+		}},
+		{"no message time", func(s attachmentStore) (interface{}, error) {
+			time, ok, err := s.messageTime(1)
+			return []interface{}{time, ok}, err
+		}},
+		{"message time replaced", func(s attachmentStore) (interface{}, error) {
+			if err := s.setMessageTime(1, 10); err != nil {
+				return nil, err
+			}
+			if err := s.setMessageTime(1, 20); err != nil {
+				return nil, err
+			}
+			time, ok, err := s.messageTime(1)
+			return []interface{}{time, ok}, err
+		}},
+	}
+
+	for _, c := range calls {
+		got := make(map[string]interface{})
+		for name, s := range stores {
+			v, err := c.call(s)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", c.name, name, err)
+			}
+			got[name] = v
+		}
+		if !reflect.DeepEqual(got["memory"], got["disk"]) {
+			t.Errorf("%s: memory gives %+v, disk gives %+v", c.name, got["memory"], got["disk"])
+		}
+	}
+	// Both could be wrong the same way
+	if info, _, _ := disk.info(1600000003001); !reflect.DeepEqual(info, full) {
+		t.Errorf("info = %+v, want %+v", info, full)
+	}
+	for _, s := range stores {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
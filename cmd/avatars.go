@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/h2non/filetype"
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/types/message"
+)
+
+// Background colours of generated monograms, picked by recipient id.
+var monogramColours = []string{"#2c6bed", "#cc163d", "#c73800", "#746c53", "#3b7845", "#1d8663", "#077288", "#7d6f40", "#a90d9b", "#6f6a58"}
+
+// avatarFiles maps recipient ids to the avatar files in dir, named by extract
+// as the id, optionally followed by " (name)" and an extension.
+func avatarFiles(dir string) (map[int64]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "avatars")
+	}
+	files := make(map[int64]string, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		end := strings.IndexFunc(name, func(r rune) bool { return r < '0' || r > '9' })
+		if end < 0 {
+			end = len(name)
+		}
+		if end == 0 || (end < len(name) && name[end] != ' ' && name[end] != '.') {
+			continue
+		}
+		if id, err := strconv.ParseInt(name[:end], 10, 64); err == nil {
+			files[id] = filepath.Join(dir, name)
+		}
+	}
+	return files, nil
+}
+
+// addAvatars gives each message the avatar of its sender, from the avatar files
+// in dir or else a monogram of the sender's initials, and returns the avatars used.
+func addAvatars(db *sql.DB, dir string, m []message.Message) ([]message.Avatar, error) {
+	files, err := avatarFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	correspondents := make(map[int64]message.DbCorrespondent)
+	rows, err := SelectStructFromTable(db, message.DbCorrespondent{}, "recipient")
+	if err != nil {
+		return nil, errors.Wrap(err, "avatars select recipient")
+	}
+	for _, row := range rows {
+		r := row.(*message.DbCorrespondent)
+		correspondents[r.ID] = *r
+	}
+
+	var avatars []message.Avatar
+	seen := make(map[int64]bool)
+	for i := range m {
+		id := m[i].SenderId
+		m[i].AvatarId = &id
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		avatar := message.Avatar{RecipientId: id}
+		if pathName, ok := files[id]; ok {
+			if avatar.ContentType, avatar.Data, err = avatarData(pathName); err != nil {
+				return nil, err
+			}
+		} else {
+			avatar.ContentType = "image/svg+xml"
+			avatar.Data = base64.StdEncoding.EncodeToString([]byte(monogram(id, stringPtr(message.CorrespondentName(correspondents[id])))))
+		}
+		avatars = append(avatars, avatar)
+	}
+	return avatars, nil
+}
+
+// avatarData returns the content type of an avatar file, detected from its
+// contents, and the file as base64.
+func avatarData(pathName string) (string, string, error) {
+	kind, err := filetype.MatchFile(pathName)
+	if err != nil {
+		return "", "", errors.Wrap(err, "avatar")
+	}
+	mime := kind.MIME.Value
+	if kind == filetype.Unknown {
+		mime = "image/jpeg"
+	}
+	_, data, err := readFileAsBase64(pathName)
+	if err != nil {
+		return "", "", errors.Wrap(err, "avatar")
+	}
+	return mime, data, nil
+}
+
+// monogram draws the initials of name in a circle, as an SVG image. A name
+// with no letters, such as a phone number, is drawn as "#".
+func monogram(id int64, name string) string {
+	var initials []rune
+	for _, word := range strings.Fields(name) {
+		r := []rune(word)[0]
+		if unicode.IsLetter(r) {
+			initials = append(initials, unicode.ToUpper(r))
+		}
+		if len(initials) == 2 {
+			break
+		}
+	}
+	text := string(initials)
+	if text == "" {
+		text = "#"
+	}
+	if id < 0 {
+		id = -id
+	}
+	colour := monogramColours[id%int64(len(monogramColours))]
+
+	// Only letters reach the SVG text, so it needs no escaping
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="40" height="40" viewBox="0 0 40 40">`+
+		`<circle cx="20" cy="20" r="20" fill="%s"/>`+
+		`<text x="20" y="20" dy=".35em" text-anchor="middle" font-family="arial,sans-serif" font-size="16" fill="#fff">%s</text>`+
+		`</svg>`, colour, text)
+}
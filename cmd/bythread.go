@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/internal/logging"
+)
+
+// threadUnknown is the folder that --by-thread puts attachments in when their
+// message or its thread is not in the database.
+const threadUnknown = "_unknown"
+
+// threadIndex is the name, without extension, of the file that format
+// --split-by-thread lists the files of the threads in.
+const threadIndex = "_index"
+
+// threadNameColumns are the columns tried, in order, for the name of a thread,
+// each as the table alias and the column names used by newer and older Signal
+// versions.
+var threadNameColumns = []struct {
+	alias, table string
+	columns      []string
+}{
+	{"g", "groups", []string{"title"}},
+	{"r", "recipient", []string{"system_joined_name", "system_display_name"}},
+	{"r", "recipient", []string{"profile_joined_name", "signal_profile_name"}},
+	{"r", "recipient", []string{"e164", "phone"}},
+}
+
+// threadLabel is the name of a thread, and the escaped form of it that names
+// the folder or file of the thread, unique among the threads named together.
+type threadLabel struct {
+	Name string
+	File string
+}
+
+// threadFolders maps message ids to the folder, under the attachment folder,
+// for the attachments of each message: the escaped name of the group or
+// contact of its thread.
+func threadFolders(db *sql.DB) (map[int64]string, error) {
+	table := "message"
+	if has, err := HasColumn(db, table, "thread_id"); err != nil {
+		return nil, errors.Wrap(err, "by thread")
+	} else if !has {
+		table = "mms"
+	}
+	if has, err := HasColumn(db, table, "thread_id"); err != nil {
+		return nil, errors.Wrap(err, "by thread")
+	} else if !has {
+		return nil, errors.Errorf("by thread: this database has no %s.thread_id column", table)
+	}
+	labels, err := threadLabels(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT _id, thread_id FROM %s", table))
+	if err != nil {
+		return nil, errors.Wrap(err, "by thread")
+	}
+	defer rows.Close()
+
+	folders := make(map[int64]string)
+	for rows.Next() {
+		var msg int64
+		var thread sql.NullInt64
+		if err := rows.Scan(&msg, &thread); err != nil {
+			return nil, errors.Wrap(err, "by thread")
+		}
+		if label, ok := labels[thread.Int64]; ok && thread.Valid {
+			folders[msg] = label.File
+		}
+	}
+	return folders, errors.Wrap(rows.Err(), "by thread")
+}
+
+// threadLabels names the threads that have rows in any of the given tables,
+// or subqueries, by the group or contact of each thread. Threads that share a
+// name are numbered in id order, and a thread with no name at all is named by
+// its id. The file names never clash with threadUnknown or threadIndex.
+func threadLabels(db *sql.DB, tables ...string) (map[int64]threadLabel, error) {
+	if has, err := HasColumn(db, "thread", "recipient_id"); err != nil {
+		return nil, errors.Wrap(err, "by thread")
+	} else if !has {
+		return nil, errors.New("by thread: this database has no thread.recipient_id column")
+	}
+
+	joins := `
+	LEFT JOIN recipient r ON r._id = t.recipient_id`
+	hasGroups, err := HasColumn(db, "groups", "recipient_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "by thread")
+	} else if hasGroups {
+		joins += `
+	LEFT JOIN groups g ON g.recipient_id = t.recipient_id`
+	}
+
+	var names []string
+	for _, n := range threadNameColumns {
+		if n.alias == "g" && !hasGroups {
+			continue
+		}
+		for _, column := range n.columns {
+			if has, err := HasColumn(db, n.table, column); err != nil {
+				return nil, errors.Wrap(err, "by thread")
+			} else if has {
+				names = append(names, n.alias+"."+column)
+				break
+			}
+		}
+	}
+	name := "NULL"
+	if len(names) > 0 {
+		name = "COALESCE(" + strings.Join(names, ", ") + ")"
+	}
+
+	used := make([]string, len(tables))
+	for i, table := range tables {
+		used[i] = "SELECT thread_id FROM " + table
+	}
+	q := fmt.Sprintf("SELECT t._id, %s FROM thread t%s WHERE t._id IN (%s) ORDER BY t._id",
+		name, joins, strings.Join(used, " UNION "))
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "by thread")
+	}
+	defer rows.Close()
+
+	labels := make(map[int64]threadLabel)
+	taken := map[string]bool{strings.ToLower(threadUnknown): true, strings.ToLower(threadIndex): true}
+	for rows.Next() {
+		var thread int64
+		var title sql.NullString
+		if err := rows.Scan(&thread, &title); err != nil {
+			return nil, errors.Wrap(err, "by thread")
+		}
+		label := threadLabel{Name: fmt.Sprintf("Thread %d", thread)}
+		if title.Valid && strings.TrimSpace(title.String) != "" {
+			label.Name = strings.TrimSpace(title.String)
+		}
+		base := escapeFileName(label.Name)
+		label.File = base
+		for n := 2; taken[strings.ToLower(label.File)]; n++ {
+			label.File = fmt.Sprintf("%s (%d)", base, n)
+		}
+		taken[strings.ToLower(label.File)] = true
+		labels[thread] = label
+	}
+	return labels, errors.Wrap(rows.Err(), "by thread")
+}
+
+// moveToThread moves an attachment file into the folder of its thread, next
+// to where it was, and returns its new name.
+func moveToThread(pathName, folder string) (string, error) {
+	newName := filepath.Join(filepath.Dir(pathName), folder, filepath.Base(pathName))
+	if err := os.MkdirAll(filepath.Dir(newName), 0755); err != nil {
+		return "", errors.Wrap(err, "by thread")
+	}
+	return newName, errors.Wrap(os.Rename(pathName, newName), "by thread")
+}
+
+// formatByThread fulfils format --split-by-thread: each thread with messages
+// is written by write, with opt.Thread set to it, into its own file in dir,
+// named after the thread like the folders of extract --by-thread. The files
+// are listed in an index, threadIndex.csv.
+func formatByThread(db *sql.DB, format, table, dir string, opt FormatOptions, write func(io.Writer, FormatOptions) error) error {
+	var sources []string
+	switch format {
+	case "xml", "html":
+		sources = []string{"message"}
+		if old, err := HasTable(db, "mms"); err != nil {
+			return errors.Wrap(err, "failed to read database schema")
+		} else if old {
+			sources = []string{"sms", "mms"}
+		}
+	case "csv", "json", "ndjson":
+		source, err := tableSource(db, table)
+		if err != nil {
+			return err
+		}
+		if err := requireThreadColumn(db, table, source); err != nil {
+			return err
+		}
+		sources = []string{source}
+	default:
+		return errors.Errorf("--split-by-thread cannot be used with format '%s'", format)
+	}
+
+	labels, err := threadLabels(db, sources...)
+	if err != nil {
+		return err
+	}
+	archived := make(map[int64]bool)
+	if opt.OnlyArchived || opt.SkipArchived {
+		threads, err := loadThreads(db)
+		if err != nil {
+			return errors.Wrap(err, "split by thread")
+		}
+		for id, t := range threads {
+			archived[id] = t.Archived != 0
+		}
+	}
+	var ids []int64
+	for id := range labels {
+		if !opt.skipThread(id, archived[id]) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "unable to create output directory")
+	}
+	for _, id := range ids {
+		opt := opt
+		opt.Thread = id
+		pathName := filepath.Join(dir, labels[id].File+"."+format)
+		if err := replaceFile(pathName, func(w io.Writer) error { return write(w, opt) }); err != nil {
+			return errors.Wrap(err, labels[id].File)
+		}
+	}
+
+	// Messages whose thread is gone have no file to go in
+	used := make([]string, len(sources))
+	for i, source := range sources {
+		used[i] = "SELECT thread_id FROM " + source
+	}
+	var orphans int
+	q := fmt.Sprintf("SELECT COUNT(*) FROM (%s) WHERE thread_id NOT IN (SELECT _id FROM thread)", strings.Join(used, " UNION ALL "))
+	if err := db.QueryRow(q).Scan(&orphans); err != nil {
+		return errors.Wrap(err, "split by thread")
+	}
+	if orphans > 0 {
+		logging.Warnf("%d messages belong to no thread in the database and were left out", orphans)
+	}
+
+	return replaceFile(filepath.Join(dir, threadIndex+".csv"), func(out io.Writer) error {
+		w := csv.NewWriter(out)
+		w.Write([]string{"thread_id", "name", "file"})
+		for _, id := range ids {
+			w.Write([]string{fmt.Sprint(id), labels[id].Name, labels[id].File + "." + format})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// requireThreadColumn checks that source, as tableSource gives for table, has
+// the thread_id column that rows are picked by for a thread.
+func requireThreadColumn(db *sql.DB, table, source string) error {
+	columns, err := TableColumns(db, source)
+	if err != nil {
+		return errors.Wrap(err, table)
+	}
+	if !slices.Contains(columns, "thread_id") {
+		return errors.Errorf("table '%s' has no thread_id column", table)
+	}
+	return nil
+}
+
+// replaceFile writes a file through a temporary one, which only replaces
+// pathName once write succeeds.
+func replaceFile(pathName string, write func(io.Writer) error) error {
+	file, err := createTemp(pathName)
+	if err != nil {
+		return errors.Wrap(err, "unable to open output file")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := write(file); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "unable to close output file")
+	}
+	return errors.Wrap(os.Rename(file.Name(), pathName), "unable to replace output file")
+}
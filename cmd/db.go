@@ -6,34 +6,39 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"unicode"
 
 	"github.com/pkg/errors"
 )
 
-var snakeCase *strings.Replacer
-
-func makeReplacer() *strings.Replacer {
-	r := make([]string, 0, 26*2)
-	for ch := 'a'; ch <= 'z'; ch++ {
-		CH := ch - 'a' + 'A'
-		r = append(r, string(CH))
-		r = append(r, "_" + string(ch))
+// Convert a struct member name into snake_case.
+// Each capital starts a new word, except within a run of capitals, where only
+// the last one before a lowercase letter does: "MType" is m_type, "SmsID" is
+// sms_id. Digits stay with the word before them, so "E164" is e164.
+func snakeCase(name string) string {
+	rs := []rune(name)
+	var b strings.Builder
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			if i > 0 && (!unicode.IsUpper(rs[i-1]) || (i+1 < len(rs) && unicode.IsLower(rs[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
 	}
-	return strings.NewReplacer(r...)
+	return b.String()
 }
 
 // Convert names of struct members into snake_case
 func names(fields []reflect.StructField) []string {
-	if snakeCase == nil {
-		snakeCase = makeReplacer()
-	}
 	s := make([]string, 0, len(fields))
 	for _, f := range fields {
 		if f.Name == "ID" {
 			// special case, exported struct members cannot begin with _
 			s = append(s, "_id")
 		} else {
-			s = append(s, snakeCase.Replace(f.Name)[1:])
+			s = append(s, snakeCase(f.Name))
 		}
 	}
 	return s
@@ -64,6 +69,18 @@ func HasTable(db *sql.DB, table string) (bool, error) {
 	return rows.Next(), nil
 }
 
+func HasColumn(db *sql.DB, table string, column string) (bool, error) {
+	q := fmt.Sprintf("SELECT name FROM pragma_table_info('%s') WHERE name='%s'", table, column)
+
+	rows, err := db.Query(q)
+	if err != nil {
+		return false, errors.Wrap(err, q)
+	}
+	defer rows.Close()
+
+	return rows.Next(), nil
+}
+
 //TODO: upgrade project to support generics [T any]
 
 // Read all rows from table, but only columns that are named as struct members.
@@ -103,26 +120,50 @@ func SelectStructFromTable(db *sql.DB, record interface{}, table string) ([]inte
 }
 
 func SelectEntireTable(db *sql.DB, table string) (columnNames []string, records [][]interface{}, result error) {
+	err := ScanEntireTable(db, table, func(names []string, cols []interface{}) error {
+		columnNames = names
+		records = append(records, cols)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if columnNames == nil {
+		// Table is empty, but callers still want a header row
+		columnNames, err = TableColumns(db, table)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return columnNames, records, nil
+}
+
+// ErrStopScan may be returned by a ScanEntireTable callback to end the scan early without error.
+var ErrStopScan = errors.New("stop scan")
+
+// Streaming variant of SelectEntireTable. Each row is passed to fn as soon as it is
+// scanned, so only one row is held in memory at a time.
+func ScanEntireTable(db *sql.DB, table string, fn func(columnNames []string, row []interface{}) error) error {
 	q := fmt.Sprintf("SELECT * FROM %s", table)
 
 	rows, err := db.Query(q)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, q)
+		return errors.Wrap(err, q)
 	}
 	defer rows.Close()
 
-	// For convenience, return column names
+	// For convenience, pass column names
 	// (useful for CSV header row and JSON field names)
-	columnNames, err = rows.Columns()
+	columnNames, err := rows.Columns()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, q)
+		return errors.Wrap(err, q)
 	}
 
 	// Scan rows into generic arrays of type interface{}
 	for rows.Next() {
 		columns, err := rows.ColumnTypes()
 		if err != nil {
-			return nil, nil, errors.Wrap(err, q)
+			return errors.Wrap(err, q)
 		}
 
 		cols := make([]interface{}, 0, len(columns))
@@ -131,7 +172,7 @@ func SelectEntireTable(db *sql.DB, table string) (columnNames []string, records
 		}
 
 		if err = rows.Scan(cols...); err != nil {
-			return nil, nil, errors.Wrap(err, "scan")
+			return errors.Wrap(err, "scan")
 		}
 
 		// Fixup null values back to nil
@@ -141,13 +182,39 @@ func SelectEntireTable(db *sql.DB, table string) (columnNames []string, records
 			}
 		}
 
-		records = append(records, cols)
+		if err = fn(columnNames, cols); err == ErrStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
 	}
 
-	return columnNames, records, nil
+	return errors.Wrap(rows.Err(), q)
+}
+
+func TableColumns(db *sql.DB, table string) ([]string, error) {
+	q := fmt.Sprintf("SELECT * FROM %s LIMIT 0", table)
+
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, q)
+	}
+	defer rows.Close()
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, q)
+	}
+	return columnNames, nil
 }
 
 // Accommodate deficiencies in the driver's ScanType()
+//
+// SQLite types each value rather than each column, and the driver reports the
+// type of the value in the current row. Values are scanned by that storage
+// class, whatever the column is declared as: INTEGER into *int64, REAL into
+// *float64, TEXT into *string and BLOB into *[]byte, so that JSON gives
+// numbers as numbers, text as strings and blobs as base64 strings.
 func ScanType(col *sql.ColumnType) interface{} {
 	typ := col.ScanType()
 	if typ == nil {
@@ -160,24 +227,30 @@ func ScanType(col *sql.ColumnType) interface{} {
 		// We must substitute nil with one of those Null types (it doesn't
 		// matter which one, since we know type.Valid will always be false).
 		return &sql.NullBool{}
+	}
 
-	} else if col.DatabaseTypeName() == "BLOB" {
-		// Driver chooses inappropriate type *[][]byte
-		// Replace with *[]byte
+	switch typ.Kind() {
+	case reflect.Slice:
+		// Driver chooses inappropriate type *[][]byte for a BLOB value,
+		// even in a column not declared as BLOB. Replace with *[]byte
 		return &[]byte{}
-
-	} else {
+	case reflect.Bool, reflect.Struct:
+		// An INTEGER value in a column declared BOOLEAN or DATE is offered
+		// as bool or time.Time, but the stored number is what we want
+		return new(int64)
+	default:
 		return reflect.New(typ).Interface()
 	}
 }
 
-// Convert results from SelectEntireTable into strings
+// Convert results from SelectEntireTable into strings, keeping at most limit
+// rows; a negative limit keeps them all
 func StringifyRows(vrows [][]interface{}, limit int) [][]string {
-	srows := [][]string{}
-	for i, vrow := range vrows {
-		if i == limit {
-			break
-		}
+	if limit >= 0 && limit < len(vrows) {
+		vrows = vrows[:limit]
+	}
+	srows := make([][]string, 0, len(vrows))
+	for _, vrow := range vrows {
 		ss := make([]string, 0, len(vrow))
 		for _, v := range vrow {
 			s := ""
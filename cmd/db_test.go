@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xeals/signal-back/internal/backuptest"
+	"github.com/xeals/signal-back/types/message"
+	_ "modernc.org/sqlite"
+)
+
+func TestSnakeCase(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Body", "body"},
+		{"ThreadId", "thread_id"},
+		{"E164", "e164"},
+		{"MType", "m_type"},
+		{"CtL", "ct_l"},
+		{"CttS", "ctt_s"},
+		{"SmsID", "sms_id"},
+		{"ID", "id"},
+		{"PendingPush", "pending_push"},
+	}
+	for _, tt := range tests {
+		if got := snakeCase(tt.name); got != tt.want {
+			t.Errorf("snakeCase(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	fields := reflect.VisibleFields(reflect.TypeOf(message.DbThread{}))
+	if got := names(fields); !reflect.DeepEqual(got, []string{"_id", "recipient_id", "archived"}) {
+		t.Errorf("names(DbThread) = %q", got)
+	}
+}
+
+// TestStructColumns selects each struct in types/message from the schema it
+// is read from, so that every member must name a column there.
+func TestStructColumns(t *testing.T) {
+	eras := map[string]*backuptest.Builder{
+		"legacy":  backuptest.Legacy(backuptest.WithKDFRounds(1)),
+		"unified": backuptest.Unified(backuptest.WithKDFRounds(1)),
+	}
+	dbs := make(map[string]*sql.DB)
+	for name, b := range eras {
+		db, err := createDB(filepath.Join(t.TempDir(), "signal.db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		replay(t, b, func(stmt string, param ...interface{}) error {
+			_, err := db.Exec(stmt, param...)
+			return err
+		})
+		dbs[name] = db
+	}
+	// Not in the test backups; as created by Signal before the unified schema
+	_, err := dbs["legacy"].Exec("CREATE TABLE group_receipts (_id INTEGER PRIMARY KEY, mms_id INTEGER, address INTEGER, status INTEGER, timestamp INTEGER, unidentified INTEGER DEFAULT 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		era    string
+		record interface{}
+		table  string
+	}{
+		{"legacy", message.DbRecipient{}, "recipient"},
+		{"legacy", message.DbThread{}, "thread"},
+		{"legacy", message.DbSMS{}, "sms"},
+		{"legacy", message.DbMMS{}, "mms"},
+		{"legacy", message.DbPart{}, "part"},
+		{"legacy", message.DbGroupReceipt{}, "group_receipts"},
+		{"unified", message.DbCorrespondent{}, "recipient"},
+		{"unified", message.DbThread{}, "thread"},
+		{"unified", message.DbGroup{}, "groups"},
+		{"unified", message.DbMessage{}, "message"},
+		{"unified", message.DbRevision{}, "message"},
+		{"unified", message.DbReaction{}, "reaction"},
+		{"unified", message.DbAttachment{}, "attachment"},
+	}
+	for _, tt := range tests {
+		if _, err := SelectStructFromTable(dbs[tt.era], tt.record, tt.table); err != nil {
+			t.Errorf("%s %T: %v", tt.era, tt.record, err)
+		}
+	}
+}
+
+func TestScanType(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stmts := []string{
+		"CREATE TABLE t (i INTEGER, b BOOLEAN, d DATE, r REAL, s TEXT, x BLOB, n INTEGER)",
+		"INSERT INTO t VALUES (42, 1, 1600000000000, 1.5, '42', x'6869', NULL)",
+	}
+	for _, q := range stmts {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []byte
+	err = ScanEntireTable(db, "t", func(_ []string, row []interface{}) error {
+		var err error
+		got, err = json.Marshal(row)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[42,1,1600000000000,1.5,"42","aGk=",null]`
+	if string(got) != want {
+		t.Errorf("row = %s, want %s", got, want)
+	}
+}
+
+func TestStringifyRows(t *testing.T) {
+	n, s, b := int64(42), "text", []byte("hi")
+	rows := [][]interface{}{
+		{&n, &s, &b, nil},
+		{&n, &s, &b, nil},
+	}
+	row := []string{"42", "text", "aGk=", ""}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  [][]string
+	}{
+		{"zero", 0, [][]string{}},
+		{"one", 1, [][]string{row}},
+		{"all", -1, [][]string{row, row}},
+		{"more than rows", 5, [][]string{row, row}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StringifyRows(rows, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StringifyRows(rows, %d) = %q, want %q", tt.limit, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dedupPointerExt ends the name of the file that stands for a duplicate
+// attachment where symlinks are not used.
+const dedupPointerExt = ".duplicate.json"
+
+// dedupPointer is the content of a pointer file.
+type dedupPointer struct {
+	DuplicateOf string `json:"duplicate_of"` // relative to the pointer's folder
+	SHA256      string `json:"sha256"`
+}
+
+// dedupAttachments replaces every attachment file under dir whose content was
+// already seen, in name order, by a link to the first copy. It returns the
+// names of the files replaced, mapped to the names that now stand for them.
+func dedupAttachments(dir string) (map[string]string, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	first := make(map[string]string) // sha256 -> path
+	replaced := make(map[string]string)
+	err := filepath.WalkDir(dir, func(pathName string, d fs.DirEntry, err error) error {
+		// Links and pointers from an earlier run are already deduplicated
+		if err != nil || !d.Type().IsRegular() || strings.HasSuffix(d.Name(), dedupPointerExt) {
+			return err
+		}
+		sum, err := fileSHA256(pathName)
+		if err != nil {
+			return err
+		}
+		firstPath, seen := first[sum]
+		if !seen {
+			first[sum] = pathName
+			return nil
+		}
+		name, err := filepath.Rel(filepath.Dir(pathName), firstPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(pathName); err != nil {
+			return err
+		}
+		newName, err := linkDuplicate(pathName, name, sum)
+		if err != nil {
+			return err
+		}
+		replaced[pathName] = newName
+		return nil
+	})
+	return replaced, errors.Wrap(err, "dedup")
+}
+
+// resolveDuplicate returns the first copy of an attachment that dedup replaced
+// by a link or pointer, or pathName itself for any other file.
+func resolveDuplicate(pathName string) (string, error) {
+	if strings.HasSuffix(pathName, dedupPointerExt) {
+		data, err := os.ReadFile(pathName)
+		if err != nil {
+			return "", err
+		}
+		var p dedupPointer
+		if err := json.Unmarshal(data, &p); err != nil {
+			return "", errors.Wrap(err, pathName)
+		}
+		return filepath.Join(filepath.Dir(pathName), filepath.FromSlash(p.DuplicateOf)), nil
+	}
+	// Links made by --store are absolute and are left alone
+	if target, err := os.Readlink(pathName); err == nil && !filepath.IsAbs(target) {
+		return filepath.Join(filepath.Dir(pathName), target), nil
+	}
+	return pathName, nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package cmd
+
+import "os"
+
+// linkDuplicate puts a symlink to the file name, relative to its folder, in place
+// of the removed duplicate pathName.
+func linkDuplicate(pathName, name, sum string) (string, error) {
+	return pathName, os.Symlink(name, pathName)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package cmd
+
+import "path/filepath"
+
+// linkDuplicate writes a pointer file to the file name, relative to its folder,
+// next to where the removed duplicate pathName was. Symlinks on Windows need
+// rights that most users do not have.
+func linkDuplicate(pathName, name, sum string) (string, error) {
+	pointer := pathName + dedupPointerExt
+	return pointer, writeJson(pointer, dedupPointer{filepath.ToSlash(name), sum})
+}
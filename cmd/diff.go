@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Tables whose primary keys are compared individually with --verbose.
+var diffKeyTables = []string{"message", "attachment", "sms", "mms", "part"}
+
+// Diff fulfils the `diff` subcommand.
+var Diff = cli.Command{
+	Name:               "diff",
+	Usage:              "Compare the contents of two signal databases",
+	Description:        "Report the difference in row count of every table between two extracted databases.\n"+
+	                    "With --verbose, also list message and attachment ids found in only one of them.",
+	CustomHelpTemplate: SubcommandHelp,
+	ArgsUsage:          "DBFILE1 DBFILE2",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "verbose, v",
+			Usage: "List ids present in only one database",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			return errors.New("must specify two Signal database files")
+		}
+
+		dbA, err := openDB(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		defer dbA.Close()
+		dbB, err := openDB(c.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		defer dbB.Close()
+
+		countsA, err := tableCounts(dbA)
+		if err != nil {
+			return errors.Wrap(err, c.Args().Get(0))
+		}
+		countsB, err := tableCounts(dbB)
+		if err != nil {
+			return errors.Wrap(err, c.Args().Get(1))
+		}
+
+		tables := make([]string, 0, len(countsA))
+		for table := range countsA {
+			tables = append(tables, table)
+		}
+		for table := range countsB {
+			if _, ok := countsA[table]; !ok {
+				tables = append(tables, table)
+			}
+		}
+		sort.Strings(tables)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tBEFORE\tAFTER\tDELTA")
+		for _, table := range tables {
+			a, inA := countsA[table]
+			b, inB := countsB[table]
+			before, after := fmt.Sprint(a), fmt.Sprint(b)
+			if !inA {
+				before = "-"
+			}
+			if !inB {
+				after = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%+d\n", table, before, after, b-a)
+		}
+		w.Flush()
+
+		if !c.Bool("verbose") {
+			return nil
+		}
+
+		for _, table := range diffKeyTables {
+			_, inA := countsA[table]
+			_, inB := countsB[table]
+			if !inA || !inB {
+				continue
+			}
+			idsA, err := tableIds(dbA, table)
+			if err != nil {
+				return errors.Wrap(err, c.Args().Get(0))
+			}
+			idsB, err := tableIds(dbB, table)
+			if err != nil {
+				return errors.Wrap(err, c.Args().Get(1))
+			}
+			printMissing(table, "only in "+c.Args().Get(0), idsA, idsB)
+			printMissing(table, "only in "+c.Args().Get(1), idsB, idsA)
+		}
+
+		return nil
+	},
+}
+
+func openDB(dbfile string) (*sql.DB, error) {
+	if _, err := os.Stat(dbfile); err != nil {
+		return nil, errors.Wrap(err, "cannot open database file")
+	}
+	db, err := sql.Open("sqlite", dbfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open database file")
+	}
+	return db, nil
+}
+
+// tableCounts returns the number of rows in every table in the database.
+func tableCounts(db *sql.DB) (map[string]int64, error) {
+	q := "SELECT name FROM sqlite_master WHERE type='table'"
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, q)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "scan")
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	counts := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var n int64
+		q := fmt.Sprintf("SELECT COUNT(*) FROM \"%s\"", table)
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			return nil, errors.Wrap(err, q)
+		}
+		counts[table] = n
+	}
+	return counts, nil
+}
+
+// tableIds returns the set of _id values in a table.
+func tableIds(db *sql.DB, table string) (map[int64]bool, error) {
+	q := fmt.Sprintf("SELECT _id FROM %s", table)
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, q)
+	}
+	defer rows.Close()
+
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+func printMissing(table, label string, have, other map[int64]bool) {
+	var missing []int64
+	for id := range have {
+		if !other[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	fmt.Printf("\n%s: %d ids %s\n", table, len(missing), label)
+	for _, id := range missing {
+		fmt.Println(id)
+	}
+}
@@ -1,22 +1,38 @@
 package cmd
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image/png"
 	"io"
-	"log"
+	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/h2non/filetype"
 	filetype_types "github.com/h2non/filetype/types"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/logging"
 	"github.com/xeals/signal-back/signal"
 	"github.com/xeals/signal-back/types"
+	"github.com/xeals/signal-back/types/message"
+	"golang.org/x/image/webp"
+	"golang.org/x/text/unicode/norm"
 )
 
 var filenameDB = "signal.db"
@@ -26,6 +42,35 @@ var FolderSticker = "Stickers"
 var FolderSettings = "Settings"
 var stickerInfoFilename = "pack_info.json"
 
+// outputLayout names the database and the folders of an extraction, relative
+// to the output folder.
+type outputLayout struct {
+	db          string
+	attachments string
+	avatars     string
+	stickers    string
+	settings    string
+}
+
+// layoutFor gives the layout the extract options ask for. --android-layout
+// uses the names Signal-Android uses in its private storage; settings are
+// still written as JSON, not XML.
+func layoutFor(c *cli.Context) outputLayout {
+	if c.Bool("android-layout") {
+		return outputLayout{
+			db:          filepath.Join("databases", "signal.db"),
+			attachments: "app_parts",
+			avatars:     "app_avatars",
+			stickers:    "app_stickers",
+			settings:    "shared_prefs",
+		}
+	}
+	return outputLayout{filenameDB, FolderAttachment, FolderAvatar, FolderSticker, FolderSettings}
+}
+
+// manifestFilename is the list of every file extract wrote, in the output directory.
+const manifestFilename = "manifest.json"
+
 // Extract fulfils the `extract` subcommand.
 var Extract = cli.Command{
 	Name:               "extract",
@@ -58,54 +103,304 @@ var Extract = cli.Command{
 			Name:  "database",
 			Usage: "Skip extracting database",
 		},
+		&cli.StringSliceFlag{
+			Name:  "only",
+			Usage: "Extract only the listed `PARTS` of: database, attachments, avatars,\n\t\t" +
+			       "stickers, settings. May be repeated or comma-separated",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-bad",
+			Usage: "Skip attachments, avatars and stickers whose data fails its MAC check\n\t\t" +
+			       "instead of aborting. Damage to a frame header cannot be skipped.",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "Skip attachments that cannot be written or renamed instead of aborting,\n\t\t" +
+			       "and fail once the rest is extracted",
+		},
+		&cli.StringSliceFlag{
+			Name:  "pragma",
+			Usage: "Apply SQLite `PRAGMA` (e.g. \"cache_size=-200000\") when building the database.\n\t\t" +
+			       "May be repeated; applied after the defaults journal_mode=OFF, synchronous=OFF",
+		},
+		&cli.BoolFlag{
+			Name:  "verify-db",
+			Usage: "Run an integrity check on the extracted database",
+		},
+		&cli.BoolFlag{
+			Name:  "checksum",
+			Usage: "Write the SHA-256 of the extracted database to a .sha256 file",
+		},
+		&cli.BoolFlag{
+			Name:  "android-layout",
+			Usage: "Mirror Signal-Android's storage: databases/signal.db, app_parts,\n\t\t" +
+			       "app_avatars, app_stickers and shared_prefs, with on-device file names",
+		},
+		&cli.StringFlag{
+			Name:  "convert-stickers",
+			Usage: "Also write each WebP sticker as a PNG beside the original, for `FORMAT` png,\n\t\t" +
+			       "or in place of it for png-only",
+		},
+		&cli.BoolFlag{
+			Name:  "verify-sizes",
+			Usage: "After extracting, check the size of every attachment file against\n\t\t" +
+			       "the size declared in the database and report any that differ",
+		},
+		&cli.IntFlag{
+			Name:  "buffer-size",
+			Usage: "Decrypt attachments `BYTES` at a time. A larger buffer can be faster\n\t\t" +
+			       "for backups of mostly large videos",
+			Value: types.ATTACHMENT_BUFFER_SIZE,
+		},
+		&cli.BoolFlag{
+			Name:  "low-mem",
+			Usage: "Keep attachment details in a temporary file beside the database\n\t\t" +
+			       "instead of in memory. Slower, but memory use stays flat for huge backups",
+		},
+		&cli.IntFlag{
+			Name:  "sample-attachments",
+			Usage: "Write only the first `N` attachments, for a quick check that a backup\n\t\t" +
+			       "extracts correctly; the rest are still read but not written",
+		},
+		&cli.Int64Flag{
+			Name:  "sample-seed",
+			Usage: "With --sample-attachments, write a random choice of attachments instead,\n\t\t" +
+			       "picked reproducibly from the number `S`",
+		},
+		&cli.BoolFlag{
+			Name:  "resume",
+			Usage: "Continue an extraction that was interrupted, keeping the attachment\n\t\t" +
+			       "files it had finished rather than writing them again; the backup is\n\t\t" +
+			       "still read from the start, to rebuild the database",
+		},
+		&cli.StringFlag{
+			Name:  "store",
+			Usage: "Keep each distinct attachment once, as `DIR`/<sha256>, and link to it from\n\t\t" +
+			       "the attachments folder, so repeated extractions share their files",
+		},
+		&cli.IntFlag{
+			Name:  "jobs",
+			Usage: "Detect the file types of attachments and set their timestamps on `N`\n\t\t" +
+			       "goroutines while the backup is still being read",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  "zip",
+			Usage: "Write everything into the zip archive `FILE` instead of a folder, with\n\t\t" +
+			       "the same layout inside and the database added last",
+		},
+		&cli.BoolFlag{
+			Name:  "dedup",
+			Usage: "Replace each attachment whose content repeats an earlier one with a link\n\t\t" +
+			       "to the first copy (a .duplicate.json pointer file on Windows)",
+		},
+		&cli.StringFlag{
+			Name:  "index-csv",
+			Usage: "Write an index of the extracted attachments to `FILE` as CSV",
+		},
+		&cli.StringSliceFlag{
+			Name:  "since-manifest",
+			Usage: "Write only the attachments whose ids are not in `FILE`, the manifest.json\n\t\t" +
+			       "or --index-csv index of an earlier extraction. May be repeated, one per\n\t\t" +
+			       "earlier run",
+		},
+		&cli.BoolFlag{
+			Name:  "report-macs",
+			Usage: "Add a mac column to the --index-csv index, ok or corrupt for each\n\t\t" +
+			       "attachment; with --skip-bad, corrupt attachments are listed too",
+		},
+		&cli.BoolFlag{
+			Name:  "no-space-check",
+			Usage: "Do not check before extracting that the output directory has free space\n\t\t" +
+			       "for roughly the size of the backup",
+		},
+		&cli.StringFlag{
+			Name:  "get-setting",
+			Usage: "Print the value of the single setting `FILE:KEY` and exit without\n\t\t" +
+			       "writing any files (KeyValue entries are in the file 'signal')",
+		},
+		&cli.StringSliceFlag{
+			Name:  "mime",
+			Usage: "Only extract attachments whose declared MIME type matches `TYPE`, or\n\t\t" +
+			       "whose contents do if none is declared. May be repeated or\n\t\t" +
+			       "comma-separated, and accepts wildcards (image/*)",
+		},
+		&cli.StringFlag{
+			Name:  "after",
+			Usage: "Only extract attachments of messages sent at or after `TIME`, given\n\t\t" +
+			       "as RFC 3339, YYYY-MM-DD or milliseconds since the Unix epoch",
+		},
+		&cli.StringFlag{
+			Name:  "before",
+			Usage: "Only extract attachments of messages sent before `TIME`, given\n\t\t" +
+			       "as RFC 3339, YYYY-MM-DD or milliseconds since the Unix epoch",
+		},
+		&cli.BoolFlag{
+			Name:  "original-names",
+			Usage: "Name attachments by their original file name alone, where they have one,\n\t\t" +
+			       "adding \" (2)\", \" (3)\" and so on, in backup order, when names collide",
+		},
+		&cli.BoolFlag{
+			Name:  "by-thread",
+			Usage: "Put each attachment in a folder named after the group or contact of its\n\t\t" +
+			       "conversation, or in " + threadUnknown + " if it belongs to none",
+		},
+		&cli.BoolFlag{
+			Name:  "include-orphans",
+			Usage: "With --after or --before, also extract attachments that belong to no message",
+		},
 	}, coreFlags...),
 	Action: func(c *cli.Context) error {
+		if err := applyOnly(c); err != nil {
+			return err
+		}
+		if err := validatePragmas(c.StringSlice("pragma")); err != nil {
+			return err
+		}
+		if c.Int("sample-attachments") < 0 {
+			return errors.New("--sample-attachments must not be negative")
+		}
+		if c.IsSet("sample-seed") && !c.IsSet("sample-attachments") {
+			return errors.New("--sample-seed needs --sample-attachments")
+		}
+		if c.Int("buffer-size") <= 0 {
+			return errors.New("--buffer-size must be positive")
+		}
+		if c.Int("jobs") < 1 {
+			return errors.New("--jobs must be at least 1")
+		}
+		if c.Bool("report-macs") && c.String("index-csv") == "" {
+			return errors.New("--report-macs needs --index-csv")
+		}
+		if c.Bool("original-names") && c.Bool("android-layout") {
+			return errors.New("--original-names and --android-layout cannot be used together")
+		}
+		if c.Bool("by-thread") && c.Bool("android-layout") {
+			return errors.New("--by-thread and --android-layout cannot be used together")
+		}
+		if c.Bool("by-thread") && c.Bool("database") {
+			return errors.New("--by-thread and --database cannot be used together")
+		}
+		if c.String("zip") != "" {
+			for _, flag := range []string{"outdir", "store", "resume"} {
+				if c.IsSet(flag) {
+					return errors.Errorf("--zip and --%s cannot be used together", flag)
+				}
+			}
+		}
+		switch c.String("convert-stickers") {
+		case "", "png", "png-only":
+		default:
+			return errors.Errorf("--convert-stickers format '%s' not recognised", c.String("convert-stickers"))
+		}
+
 		bf, err := setup(c)
 		if err != nil {
 			return err
 		}
+		bf.BufferSize = c.Int("buffer-size")
+
+		if name := c.String("get-setting"); name != "" {
+			return GetSetting(bf, name, os.Stdout)
+		}
 
 		basePath := c.String("outdir")
+		zipPath := c.String("zip")
+		if zipPath != "" {
+			// Files are renamed and checked after they are written, so they
+			// go to a folder next to the archive first and are packed at the end
+			if basePath, err = os.MkdirTemp(filepath.Dir(zipPath), ".signal-back-zip.*"); err != nil {
+				return errors.Wrap(err, "unable to create output directory")
+			}
+			defer os.RemoveAll(basePath)
+		}
+
+		layout := layoutFor(c)
+		if c.Bool("android-layout") {
+			if err := os.MkdirAll(filepath.Join(basePath, filepath.Dir(layout.db)), 0755); err != nil {
+				return errors.Wrap(err, "unable to create database directory")
+			}
+		}
 
 		if basePath != "" {
 			if err := os.MkdirAll(basePath, 0755); err != nil {
 				return errors.Wrap(err, "unable to create output directory")
 			}
 		}
+		// The decrypted contents are about the size of the backup itself
+		need := bf.FileSize
+		if zipPath != "" {
+			need *= 2 // the folder and the archive
+		}
+		if c.Bool("no-space-check") {
+			need = 0
+		}
+		if err := checkOutputDir(basePath, need); err != nil {
+			return err
+		}
 		if !c.Bool("attachments") {
-			if err := os.MkdirAll(filepath.Join(basePath, FolderAttachment), 0755); err != nil {
+			if err := os.MkdirAll(filepath.Join(basePath, layout.attachments), 0755); err != nil {
 				return errors.Wrap(err, "unable to create attachment directory")
 			}
 		}
 		if !c.Bool("avatars") {
-			if err := os.MkdirAll(filepath.Join(basePath, FolderAvatar), 0755); err != nil {
+			if err := os.MkdirAll(filepath.Join(basePath, layout.avatars), 0755); err != nil {
 				return errors.Wrap(err, "unable to create avatar directory")
 			}
 		}
 		if !c.Bool("stickers") {
-			if err := os.MkdirAll(filepath.Join(basePath, FolderSticker), 0755); err != nil {
+			if err := os.MkdirAll(filepath.Join(basePath, layout.stickers), 0755); err != nil {
 				return errors.Wrap(err, "unable to create sticker directory")
 			}
 		}
 		if !c.Bool("settings") {
-			if err := os.MkdirAll(filepath.Join(basePath, FolderSettings), 0755); err != nil {
+			if err := os.MkdirAll(filepath.Join(basePath, layout.settings), 0755); err != nil {
 				return errors.Wrap(err, "unable to create settings directory")
 			}
 		}
-		if err = ExtractFiles(bf, c, basePath); err != nil {
+		warnings, err := ExtractFiles(bf, c, basePath)
+		failed, partial := err.(failedError)
+		if err != nil && !partial {
 			return errors.Wrap(err, "failed to extract")
 		}
+		if zipPath != "" {
+			if err := writeZip(zipPath, basePath, layout); err != nil {
+				return errors.Wrap(err, "failed to extract")
+			}
+			status(c, "Wrote " + zipPath)
+		}
+		if len(warnings) > 0 && !logging.Enabled(logging.Warn) && !c.Bool("quiet") {
+			fmt.Fprintf(os.Stderr, "%d warnings during extraction (use --verbose or --log-level warn for details)\n", len(warnings))
+		}
 
+		if partial {
+			return failed
+		}
 		return nil
 	},
 }
 
+// Warning is a non-fatal problem encountered while extracting, such as a
+// frame with no matching SQL row or a size mismatch.
+type Warning struct {
+	Kind    string // attachment, avatar, sticker, frame
+	ID      string
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+type warnFunc func(format string, a ...interface{})
+
 type attachmentInfo struct {
 	msg  int64
 	mime *string
 	size int64
 	name *string
 	time int64
+	data *string // path of the file on the device
 }
 
 type attachmentFile struct {
@@ -113,10 +408,48 @@ type attachmentFile struct {
 	path string
 }
 
+// pendingAttachment is an attachment written before its SQL row was seen.
+type pendingAttachment struct {
+	frame   *signal.Attachment
+	pos     int64
+	path    string
+	corrupt bool // failed its MAC check, so there is no file
+}
+
+// indexEntry describes one extracted attachment, for the attachment index.
+type indexEntry struct {
+	ID        int64  `json:"id"`
+	MessageID int64  `json:"message_id"`
+	Mime      string `json:"mime"`
+	Size      uint32 `json:"size"`
+	Path      string `json:"path"` // relative to the output directory, or empty if corrupt
+	MAC       string `json:"mac,omitempty"` // ok or corrupt, with --report-macs
+
+	declared int64 // data_size of the SQL row, or -1 if there was none
+}
+
+// manifest is the content of manifest.json.
+type manifest struct {
+	Files []manifestEntry `json:"files"`
+}
+
+// manifestEntry is one file written by extract.
+type manifestEntry struct {
+	Category     string `json:"category"` // attachment, avatar or sticker
+	ID           string `json:"id"`       // row id, or recipient id for an avatar
+	Path         string `json:"path"`     // relative to the output directory
+	Mime         string `json:"mime,omitempty"`          // as declared by the SQL row
+	DeclaredSize *int64 `json:"declared_size,omitempty"` // as declared by the SQL row
+	Size         int64  `json:"size"`
+	Extension    string `json:"extension,omitempty"` // detected from the contents, or declared
+	NoSQLEntry   bool   `json:"no_sql_entry,omitempty"`
+}
+
 type avatarInfo struct {
 	DisplayName *string
 	ProfileName *string
 	fetchTime   int64
+	groupId     string // canonical form, for a group's recipient
 }
 
 type stickerInfo struct {
@@ -126,10 +459,94 @@ type stickerInfo struct {
 	size       int64
 	sticker_id int64
 	cover      bool
+	file_path  string
+}
+
+var pragmaPattern = regexp.MustCompile(`^\w+(\.\w+)?\s*(=\s*[-\w']+|\(\s*[-\w']+\s*\))?$`)
+
+// validatePragmas accepts statements of the form name, name=value or
+// name(value), optionally with a schema prefix (main.name).
+func validatePragmas(pragmas []string) error {
+	for _, p := range pragmas {
+		if !pragmaPattern.MatchString(strings.TrimSpace(p)) {
+			return errors.Errorf("malformed --pragma `%s`", p)
+		}
+	}
+	return nil
+}
+
+// statementBatchSize is the number of statements run in each transaction while
+// the database is built. Committing once per statement is slow even with the
+// journal off; a single transaction for the whole backup holds every change
+// in memory until the end.
+const statementBatchSize = 5000
+
+// statementBatch runs statements in transactions of statementBatchSize.
+// Backups insert rows with the same few statements over and over, so each
+// INSERT is prepared once per transaction and reused.
+type statementBatch struct {
+	db    *sql.DB
+	tx    *sql.Tx
+	n     int
+	stmts map[string]*sql.Stmt // closed with the transaction
+}
+
+func (b *statementBatch) exec(stmt string, args ...interface{}) error {
+	if b.tx == nil {
+		tx, err := b.db.Begin()
+		if err != nil {
+			return errors.Wrap(err, "begin transaction")
+		}
+		b.tx = tx
+		b.stmts = make(map[string]*sql.Stmt)
+	}
+	if !strings.HasPrefix(stmt, "INSERT ") {
+		if _, err := b.tx.Exec(stmt, args...); err != nil {
+			return err
+		}
+	} else {
+		prepared, ok := b.stmts[stmt]
+		if !ok {
+			var err error
+			if prepared, err = b.tx.Prepare(stmt); err != nil {
+				return err
+			}
+			b.stmts[stmt] = prepared
+		}
+		if _, err := prepared.Exec(args...); err != nil {
+			return err
+		}
+	}
+	if b.n++; b.n >= statementBatchSize {
+		return b.commit()
+	}
+	return nil
+}
+
+// commit ends the current transaction, if there is one.
+func (b *statementBatch) commit() error {
+	if b.tx == nil {
+		return nil
+	}
+	err := b.tx.Commit()
+	b.tx, b.n, b.stmts = nil, 0, nil
+	return errors.Wrap(err, "commit transaction")
+}
+
+// rollback abandons the current transaction, if there is one.
+func (b *statementBatch) rollback() {
+	if b.tx != nil {
+		b.tx.Rollback()
+		b.tx, b.n, b.stmts = nil, 0, nil
+	}
 }
 
-func createDB(fileName string) (db *sql.DB, err error) {
-	log.Printf("Begin decrypt into %s", fileName)
+func createDB(fileName string, pragmas []string) (db *sql.DB, err error) {
+	if err := validatePragmas(pragmas); err != nil {
+		return nil, err
+	}
+
+	logging.Infof("Begin decrypt into %s", fileName)
 
 	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
 		return nil, errors.Wrap(err, "creating fresh database")
@@ -139,6 +556,8 @@ func createDB(fileName string) (db *sql.DB, err error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot create database file")
 	}
+	// PRAGMAs apply to a single connection, so keep to the one they were run on
+	db.SetMaxOpenConns(1)
 
 	// Boost performance. It takes 100 times longer to create the db file without these!
 	_, err = db.Exec("PRAGMA journal_mode = OFF")
@@ -150,38 +569,149 @@ func createDB(fileName string) (db *sql.DB, err error) {
 		return nil, errors.Wrap(err, "PRAGMA synchronous failed")
 	}
 
+	for _, p := range pragmas {
+		if _, err = db.Exec("PRAGMA " + p); err != nil {
+			return nil, errors.Wrap(err, "PRAGMA " + p + " failed")
+		}
+		logging.Infof("Applied PRAGMA %s", p)
+	}
+
 	return db, nil
 }
 
 // ExtractFiles consumes all decrypted data from the backup file and
 // dispatches it to an appropriate location.
-func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
+//
+// Non-fatal problems are logged and also returned as warnings, so that
+// callers who discard the log can still report them.
+func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) (warnings []Warning, result error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Panicked during extraction:", r)
+			result = errors.Errorf("panicked during extraction: %v", r)
 		}
 	}()
 	defer bf.Close()
+	layout := layoutFor(c)
 
+	// The database is built under a temporary name and only renamed into
+	// place once extraction succeeds, so a failed run keeps any previous one.
 	var db *sql.DB
+	var batch *statementBatch
 	var err error
+	pathDB := filepath.Join(base, layout.db)
+	pathTemp := pathDB + ".tmp"
 	if !c.Bool("database") {
-		db, err = createDB(filepath.Join(base, filenameDB))
+		db, err = createDB(pathTemp, c.StringSlice("pragma"))
 		if err != nil {
-			return err
+			return nil, err
+		}
+		batch = &statementBatch{db: db}
+		defer func() {
+			batch.rollback()
+			db.Close()
+			if result != nil {
+				os.Remove(pathTemp)
+			}
+		}()
+	}
+
+	mimeFilter, err := parseMimeFilter(c.StringSlice("mime"))
+	if err != nil {
+		return nil, err
+	}
+
+	dates, err := parseDateFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attachments listed by an earlier extraction are read but not written
+	var prior map[int64]bool
+	if manifests := c.StringSlice("since-manifest"); len(manifests) > 0 {
+		if prior, err = readIndexIDs(manifests); err != nil {
+			return nil, err
+		}
+	}
+
+	var store attachmentStore = newMemoryAttachments()
+	if c.Bool("low-mem") {
+		if store, err = newDiskAttachments(pathDB + ".index"); err != nil {
+			return nil, err
 		}
-		defer db.Close()
 	}
+	defer store.Close()
+
+	var sample *attachmentSample
+	if c.IsSet("sample-attachments") {
+		var rng *rand.Rand
+		if c.IsSet("sample-seed") {
+			rng = rand.New(rand.NewSource(c.Int64("sample-seed")))
+		}
+		sample = newAttachmentSample(c.Int("sample-attachments"), rng)
+	}
+
+	// The state file lists the attachments written so far, for --resume. A
+	// resumed run still reads the whole backup to rebuild the database, but
+	// skips writing the attachments already there.
+	statePath := filepath.Join(base, progressFileName)
+	state := newResumeState(identifyBackup(bf))
+	var (
+		resumed     *resumeState
+		resumeFrame int64
+	)
+	if c.Bool("resume") {
+		if resumed, err = loadResumeState(statePath, state.Backup); err != nil {
+			return nil, err
+		}
+		if resumed != nil {
+			status(c, fmt.Sprintf("Resuming with %d files already written", resumed.count()))
+			state, resumeFrame = resumed, resumed.Frame
+		}
+	}
+	defer func() {
+		// Record everything written before the failure, not just the last save
+		if result != nil && state.count() > 0 {
+			state.save(statePath, true)
+		}
+	}()
+
+	// Workers add warnings too
+	var warningsMu sync.Mutex
+	addWarning := func(w Warning) {
+		warningsMu.Lock()
+		defer warningsMu.Unlock()
+		warnings = append(warnings, w)
+	}
+	warner := func(kind string, id interface{}) warnFunc {
+		return func(format string, a ...interface{}) {
+			w := Warning{kind, fmt.Sprint(id), fmt.Sprintf(format, a...)}
+			logging.WithFields(logging.Fields{"kind": w.Kind, "id": w.ID}).Warnf("%s", w.Message)
+			addWarning(w)
+		}
+	}
+
+	workers := newWorkerPool(c.Int("jobs"))
+	defer workers.close()
+
+	p := newAttachmentPipeline(c, bf, base)
+	p.layout = layout
+	p.store, p.workers, p.warner = store, workers, warner
+	p.statePath, p.state, p.resumed = statePath, state, resumed
+	p.mimeFilter, p.dates, p.sample, p.prior = mimeFilter, dates, sample, prior
 
 	var (
 		schema_stmt = make(map[string]string)
 		schema      = make(map[string]*types.Schema)
 		section     = make(map[string]bool)
-		attachments = make(map[int64]attachmentInfo)
-		timestamp   = make(map[int64][]attachmentFile)
+		usable      = make(map[string]bool) // table has the columns read below
 		avatars     = make(map[string]avatarInfo)
+		groupTitles = make(map[string]string) //canonical group id -> title
 		stickers    = make(map[int64]stickerInfo)
 		prefs       = make(map[string]map[string]interface{})
+		framePos    int64
+		frameNumber int64
+		counter     uint32 // bf.Counter after the current frame header
+		frameCount  = make(map[string]int) // attachment, avatar, sticker
 	)
 	var (
 		debug_table string
@@ -191,6 +721,21 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 	)
 
 	fns := types.ConsumeFuncs{
+		FrameFunc: func(f *signal.BackupFrame, pos int64, _ uint32) error {
+			framePos = pos
+			frameNumber++
+			counter = bf.Counter
+			if frameNumber == resumeFrame && (pos != resumed.Offset || counter != resumed.Counter) {
+				return errors.Errorf("backup does not match %s at frame %d; remove it to start afresh", statePath, frameNumber)
+			}
+
+			// Consume has already logged these; only count them
+			if fields := types.UnknownFields(f); len(fields) > 0 {
+				msg := fmt.Sprintf("frame at %#x has unhandled field(s) %v", pos, fields)
+				addWarning(Warning{"frame", fmt.Sprint(pos), msg})
+			}
+			return nil
+		},
 		StatementFunc: func(s *signal.SqlStatement) error {
 			defer func() {
 				if r := recover(); r != nil {
@@ -210,7 +755,7 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 
 				if strings.HasPrefix(table, "sqlite_") {
 					if !c.Bool("database") {
-						log.Printf("*** Skipping RESERVED table name %s", table)
+						logging.Warnf("Skipping RESERVED table name %s", table)
 					}
 					return nil
 				}
@@ -247,8 +792,9 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 					}
 				}
 				if target != "" {
-					return errors.New(fmt.Sprintf("no suitable column in `%s` for %s", table, target))
+					logging.Warnf("no suitable column in `%s` for %s, it will be left empty", table, target)
 				}
+				usable[table] = checkColumns(table, sch)
 
 			} else if strings.HasPrefix(stmt, "INSERT INTO ") {
 				a := strings.SplitN(stmt, " ", 4)
@@ -258,71 +804,82 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 					// Log each new section to give a sense of progress
 					if _, found := section[table]; !found {
 						section[table] = true
-						log.Printf("Populating table `%s` ...", table)
+						logging.Debugf("Populating table `%s` ...", table)
 					}
 				}
 
 				sch := schema[table]
 				ps := s.GetParameters()
-				switch table {
+				lookup := table
+				if !usable[table] {
+					lookup = "" // skip the lookups below, but still insert the row
+				}
+				switch lookup {
 				case "attachment":
-					id := *sch.Field(ps, "_id").(*int64)
-					attachments[id] = attachmentInfo{
-						msg:    *sch.Field(ps, "message_id").(*int64),
-						mime:    sch.Field(ps, "content_type").(*string),
-						size:   *sch.Field(ps, "data_size").(*int64),
-						name:    sch.Field(ps, "file_name").(*string),
-						time:   *sch.Field(ps, "upload_timestamp").(*int64),
+					id := fieldInt(sch, ps, "_id")
+					err := store.addRow(id, id, attachmentInfo{
+						msg:    fieldInt(sch, ps, "message_id"),
+						mime:   fieldString(sch, ps, "content_type"),
+						size:   fieldInt(sch, ps, "data_size"),
+						name:   fieldString(sch, ps, "file_name"),
+						time:   fieldInt(sch, ps, "upload_timestamp"),
+						data:   fieldString(sch, ps, "data_file"),
+					})
+					if err != nil {
+						return err
 					}
 
 				case "part":
-					id   := *sch.Field(ps, "unique_id").(*int64)
-					time := *sch.Field(ps, "upload_timestamp").(*int64)
+					id   := fieldInt(sch, ps, "unique_id")
+					time := fieldInt(sch, ps, "upload_timestamp")
 					if time > id || time == 0 {
 						time = id
 					}
-					attachments[id] = attachmentInfo{
-						msg:    *sch.Field(ps, "mid").(*int64),
-						mime:    sch.Field(ps, "ct").(*string),
-						size:   *sch.Field(ps, "data_size").(*int64),
-						name:    sch.Field(ps, "file_name").(*string),
-						time:    time,
+					err := store.addRow(fieldInt(sch, ps, "_id"), id, attachmentInfo{
+						msg:    fieldInt(sch, ps, "mid"),
+						mime:   fieldString(sch, ps, "ct"),
+						size:   fieldInt(sch, ps, "data_size"),
+						name:   fieldString(sch, ps, "file_name"),
+						time:   time,
+						data:   fieldString(sch, ps, "_data"),
+					})
+					if err != nil {
+						return err
 					}
 
 				case "recipient":
-					n_id := *sch.Field(ps, "_id").(*int64)
+					n_id := fieldInt(sch, ps, "_id")
 					s_id := fmt.Sprintf("%d", n_id)
 					avatars[s_id] = avatarInfo{
-						DisplayName:    sch.Field(ps, field_DisplayName).(*string),
-						ProfileName:    sch.Field(ps, field_ProfileName).(*string),
-						fetchTime:     *sch.Field(ps, "last_profile_fetch").(*int64),
+						DisplayName:   fieldName(sch, ps, field_DisplayName),
+						ProfileName:   fieldName(sch, ps, field_ProfileName),
+						fetchTime:     fieldInt(sch, ps, "last_profile_fetch"),
+						groupId:       fieldGroupId(sch, ps, "group_id"),
+					}
+
+				case "groups":
+					if title := fieldName(sch, ps, "title"); title != nil && *title != "" {
+						groupTitles[fieldGroupId(sch, ps, "group_id")] = *title
 					}
 
 				case "sticker":
-					id := *sch.Field(ps, "_id").(*int64)
+					id := fieldInt(sch, ps, "_id")
 					stickers[id] = stickerInfo{
-						Pack_id:    *sch.Field(ps, "pack_id").(*string),
-						Title:      *sch.Field(ps, "pack_title").(*string),
-						Author:     *sch.Field(ps, "pack_author").(*string),
-						size:       *sch.Field(ps, "file_length").(*int64),
-						sticker_id: *sch.Field(ps, "sticker_id").(*int64),
-						cover:     (*sch.Field(ps, "cover").(*int64) != 0),
+						Pack_id:    fieldText(sch, ps, "pack_id"),
+						Title:      fieldText(sch, ps, "pack_title"),
+						Author:     fieldText(sch, ps, "pack_author"),
+						size:       fieldInt(sch, ps, "file_length"),
+						sticker_id: fieldInt(sch, ps, "sticker_id"),
+						cover:      fieldInt(sch, ps, "cover") != 0,
+						file_path:  fieldText(sch, ps, "file_path"),
 					}
 
 				case "message", "mms":
-					id   := *sch.Field(ps, "_id").(*int64)
-					rcv  := *sch.Field(ps, "date_received").(*int64)
-					time := *sch.Field(ps, field_MessageDate).(*int64)
-					for _, info := range timestamp[id] {
-						if time > info.time && info.time != 0 {
-							time = info.time
-						}
-						if time > rcv {
-							time = rcv
-						}
-						if err := setFileTimestamp(info.path, time); err != nil {
-							return err
-						}
+					id   := fieldInt(sch, ps, "_id")
+					rcv  := fieldInt(sch, ps, "date_received")
+					time := fieldInt(sch, ps, field_MessageDate)
+					if err := p.messageRow(id, time, rcv); err != nil {
+						return err
 					}
 				}
 
@@ -333,7 +890,7 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 			}
 
 			if !c.Bool("database") {
-				_, err := db.Exec(stmt, param...)
+				err := batch.exec(stmt, param...)
 				if err != nil {
 					detail := fmt.Sprintf("%s\n%v\nSQL Exec", stmt, param)
 					return errors.Wrap(err, detail)
@@ -346,92 +903,87 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 
 	if !c.Bool("attachments") {
 		fns.AttachmentFunc = func(a *signal.Attachment) error {
-			id := int64(a.GetRowId())
-			if a.AttachmentId != nil {
-				id = int64(*a.AttachmentId)
-			}
-			info, hasInfo := attachments[id]
-
-			fileName := fmt.Sprintf("%06d", id)
-			mime := ""
-			time := int64(0)
-			
-			if !hasInfo {
-				log.Printf("attachment `%v` has no associated SQL entry", id)
-			} else {
-				if info.size != int64(a.GetLength()) {
-					log.Printf("attachment length (%d) mismatches SQL entry.size (%d)", a.GetLength(), info.size)
-				}
-				if info.name != nil {
-					fileName += "." + *info.name
-				}
-				if info.mime == nil {
-					log.Printf("file `%v` has no declared MIME type", id)
-				} else {
-					mime = *info.mime
-				}
-				time = info.time
-			}
-
-			safeFileName := escapeFileName(fileName)
-			pathName := filepath.Join(base, FolderAttachment, safeFileName)
-			if err := writeAttachment(pathName, a.GetLength(), bf); err != nil {
-				return errors.Wrap(err, "attachment")
-			} else if newName, err := fixFileExtension(pathName, mime); err != nil {
-				return errors.Wrap(err, "attachment")
-			} else {
-				timestamp[info.msg] = append(timestamp[info.msg], attachmentFile{time, newName})
-			}
-			return nil
+			frameCount["attachment"]++
+			return p.attachment(a, framePos, frameNumber, counter)
 		}
 	}
 	if !c.Bool("avatars") {
 		fns.AvatarFunc = func(a *signal.Avatar) error {
 			id := *a.RecipientId
 			info, hasInfo := avatars[id]
+			warn := warner("avatar", id)
+			frameCount["avatar"]++
 
 			fileName := fmt.Sprintf("%v", id)
 			mtime := int64(0)
 
 			if !hasInfo {
-				log.Printf("avatar `%v` has no associated SQL entry", id)
+				p.noEntry("avatar", id, framePos, a.GetLength(), warn)
 			} else {
-				if info.DisplayName != nil {
+				if p.android {
+					// files are named by recipient id alone
+				} else if info.DisplayName != nil {
 					fileName += fmt.Sprintf(" (%s)", *info.DisplayName)
 				} else if info.ProfileName != nil {
 					fileName += fmt.Sprintf(" (%s)", *info.ProfileName)
+				} else if title, ok := groupTitles[info.groupId]; ok {
+					fileName += fmt.Sprintf(" (%s)", title)
+				} else if info.groupId != "" {
+					fileName += fmt.Sprintf(" (%s)", info.groupId)
 				}
 				mtime = info.fetchTime
 			}
 
-			pathName := filepath.Join(base, FolderAvatar, fileName)
+			if r, ok := resumed.avatar(base, id, a.GetLength()); ok {
+				p.addManifest("avatar", id, filepath.Join(base, r.Path), "", nil, int64(a.GetLength()), !hasInfo)
+				return bf.DecryptAttachment(a.GetLength(), nil)
+			}
+			pathName := filepath.Join(base, layout.avatars, escapeFileName(fileName))
 			if err := writeAttachment(pathName, a.GetLength(), bf); err != nil {
+				if c.Bool("skip-bad") && skipBad(err, pathName, warn) {
+					return nil
+				}
 				return errors.Wrap(err, "avatar")
-			} else if newName, err := fixFileExtension(pathName, ""); err != nil {
+			}
+			newName, err := p.fixExtension(pathName, "", warn)
+			if err != nil {
 				return errors.Wrap(err, "avatar")
 			} else if err := setFileTimestamp(newName, mtime); err != nil {
 				return errors.Wrap(err, "avatar")
 			}
-			return nil
+			p.addManifest("avatar", id, newName, "", nil, int64(a.GetLength()), !hasInfo)
+			rel, _ := filepath.Rel(base, newName)
+			state.Avatars[id] = resumedAttachment{Path: rel, Length: a.GetLength()}
+			return state.save(statePath, false)
 		}
 	}
 	if !c.Bool("stickers") {
 		fns.StickerFunc = func(a *signal.Sticker) error {
 			id := int64(*a.RowId)
 			info, hasInfo := stickers[id]
+			warn := warner("sticker", id)
+			frameCount["sticker"]++
 
 			fileName := fmt.Sprintf("%v", id)
-			packPath := filepath.Join(base, FolderSticker)
+			packPath := filepath.Join(base, layout.stickers)
 
 			if !hasInfo {
-				log.Printf("sticker `%v` has no associated SQL entry", id)
+				p.noEntry("sticker", id, framePos, a.GetLength(), warn)
 			} else {
 				if info.size != int64(a.GetLength()) {
-					log.Printf("sticker length (%d) mismatches SQL entry.size (%d)", a.GetLength(), info.size)
+					warn("sticker length (%d) mismatches SQL entry.size (%d)", a.GetLength(), info.size)
 				}
 				fileName = fmt.Sprintf("%d", info.sticker_id)
+			}
 
-				packPath = filepath.Join(packPath, info.Pack_id)
+			if p.android {
+				// stickers of all packs share one directory
+				fileName = fmt.Sprintf("sticker%d.mms", id)
+				if hasInfo && info.file_path != "" {
+					fileName = escapeFileName(path.Base(info.file_path))
+				}
+			} else if hasInfo {
+				packPath = filepath.Join(packPath, escapeFileName(info.Pack_id))
 				if err := os.MkdirAll(packPath, 0755); err != nil {
 					msg := fmt.Sprintf("unable to create sticker pack directory: %s", packPath)
 					return errors.Wrap(err, msg)
@@ -443,13 +995,51 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 				}
 			}
 
+			var declared *int64
+			if hasInfo {
+				declared = &info.size
+			}
+			if r, ok := resumed.sticker(base, id, a.GetLength(), info.size); ok {
+				size := r.Size
+				if size == 0 {
+					size = int64(a.GetLength())
+				}
+				p.addManifest("sticker", fmt.Sprint(id), filepath.Join(base, r.Path), "", declared, size, !hasInfo)
+				return bf.DecryptAttachment(a.GetLength(), nil)
+			}
 			pathName := filepath.Join(packPath, fileName)
 			if err := writeAttachment(pathName, a.GetLength(), bf); err != nil {
+				if c.Bool("skip-bad") && skipBad(err, pathName, warn) {
+					return nil
+				}
 				return errors.Wrap(err, "sticker")
-			} else if _, err := fixFileExtension(pathName, ""); err != nil {
+			}
+			newName, err := p.fixExtension(pathName, "", warn)
+			if err != nil {
 				return errors.Wrap(err, "sticker")
 			}
-			return nil
+			r := resumedAttachment{Length: a.GetLength()}
+			if convert := c.String("convert-stickers"); convert != "" {
+				converted, err := convertSticker(newName, convert == "png-only", warn)
+				if err != nil {
+					return errors.Wrap(err, "sticker")
+				}
+				if converted != newName {
+					fi, err := os.Stat(converted)
+					if err != nil {
+						return errors.Wrap(err, "sticker")
+					}
+					newName, r.Size = converted, fi.Size()
+				}
+			}
+			size := r.Size
+			if size == 0 {
+				size = int64(a.GetLength())
+			}
+			p.addManifest("sticker", fmt.Sprint(id), newName, "", declared, size, !hasInfo)
+			r.Path, _ = filepath.Rel(base, newName)
+			state.Stickers[id] = r
+			return state.save(statePath, false)
 		}
 	}
 	if !c.Bool("settings") {
@@ -461,60 +1051,598 @@ func ExtractFiles(bf *types.BackupFile, c *cli.Context, base string) error {
 				prefs[file] = m
 			}
 
-			key := *p.Key
-			if p.GetIsStringSetValue() {
-				m[key] = p.GetStringSetValue()
-			} else if p.BooleanValue != nil {
-				m[key] = p.GetBooleanValue()
-			} else {
-				m[key] = p.Value
-			}
-
+			m[*p.Key] = preferenceValue(p)
 			return nil
 		}
 		fns.KeyValueFunc = func(kv *signal.KeyValue) error {
-			file := "signal"
+			file := keyValueFile
 			m, exist := prefs[file]
 			if !exist {
 				m = make(map[string]interface{})
 				prefs[file] = m
 			}
 
-			key := *kv.Key
-			if        kv.BooleanValue != nil {
-				m[key] = kv.GetBooleanValue()
-			} else if kv.FloatValue != nil {
-				m[key] = kv.GetFloatValue()
-			} else if kv.IntegerValue != nil {
-				m[key] = kv.GetIntegerValue()
-			} else if kv.LongValue != nil {
-				m[key] = kv.GetLongValue()
-			} else if kv.StringValue != nil {
-				m[key] = kv.GetStringValue()
-			} else {
-				m[key] = kv.BlobValue
+			m[*kv.Key] = keyValueValue(kv)
+			return nil
+		}
+	}
+
+	progress := newProgress(c, bf.FileSize)
+	if progress != nil {
+		fns.ProgressFunc = progress.update
+	}
+
+	// Ctrl-C stops extraction between frames, so that the partial database
+	// is removed and the attachments written so far are kept for --resume
+	ctx, stop := interruptContext()
+	err = bf.ConsumeContext(ctx, fns)
+	stop()
+	// Finish the files already handed to the workers, even if interrupted
+	if werr := workers.drain(true); err == nil {
+		err = werr
+	}
+	if progress != nil {
+		progress.done()
+	}
+	if err == context.Canceled {
+		msg := "interrupted"
+		if state.count() > 0 {
+			msg += "; run the same command with --resume to continue"
+		}
+		return warnings, errors.New(msg)
+	} else if err != nil {
+		return warnings, err
+	}
+
+	if err := p.finishPending(); err != nil {
+		return warnings, err
+	}
+
+	reportOrphans(c, frameCount, p.orphans)
+	if prior != nil {
+		status(c, fmt.Sprintf("Skipped %d attachments already in an earlier extraction", p.priorSkipped))
+	}
+	if dates != nil {
+		status(c, fmt.Sprintf("Skipped %d attachments outside the date range", p.datesSkipped))
+	}
+
+	p.dropRemoved()
+
+	if c.Bool("by-thread") {
+		// The threads are only all known once the database is complete
+		if err := batch.commit(); err != nil {
+			return warnings, err
+		}
+		folders, err := threadFolders(db)
+		if err != nil {
+			return warnings, err
+		}
+		moved := make(map[string]string)
+		for _, e := range p.manifest {
+			if e.Category != "attachment" {
+				continue
+			}
+			pathName := filepath.Join(base, e.Path)
+			folder := threadUnknown
+			if msg, ok := p.fileMessages[pathName]; ok && folders[msg] != "" {
+				folder = folders[msg]
 			}
+			newName, err := moveToThread(pathName, folder)
+			if err != nil {
+				return warnings, err
+			}
+			moved[pathName] = newName
+		}
+		p.renamed(moved)
+	}
 
-			return nil
+	// Run once every file is final, so that no first copy is removed later
+	if c.Bool("dedup") {
+		replaced, err := dedupAttachments(filepath.Join(base, layout.attachments))
+		if err != nil {
+			return warnings, err
 		}
+		p.renamed(replaced)
+		status(c, fmt.Sprintf("Replaced %d duplicate attachments with links to their first copy", len(replaced)))
 	}
 
-	if err := bf.Consume(fns); err != nil {
-		return err
+	if pathName := c.String("index-csv"); pathName != "" {
+		if err := writeIndexCSV(pathName, p.index, p.reportMACs); err != nil {
+			return warnings, errors.Wrap(err, "index")
+		}
+	}
+	if err := writeJson(filepath.Join(base, manifestFilename), manifest{p.manifest}); err != nil {
+		return warnings, errors.Wrap(err, "manifest")
 	}
 
 	for fileName, kv := range prefs {
-		pathName := filepath.Join(base, FolderSettings, fileName + ".json")
+		pathName := filepath.Join(base, layout.settings, escapeFileName(fileName) + ".json")
 		if err := writeJson(pathName, kv); err != nil {
-			return errors.Wrap(err, "settings")
+			return warnings, errors.Wrap(err, "settings")
 		}
 	}
 
-	log.Println("Done!")
+	if db != nil {
+		if err := batch.commit(); err != nil {
+			return warnings, err
+		}
+		if c.Bool("verify-db") {
+			if err := verifyDB(db); err != nil {
+				return warnings, err
+			}
+		}
+		if err := db.Close(); err != nil {
+			return warnings, errors.Wrap(err, "closing database")
+		}
+		if err := os.Rename(pathTemp, pathDB); err != nil {
+			return warnings, errors.Wrap(err, "replacing database")
+		}
+
+		sum, err := fileSHA256(pathDB)
+		if err != nil {
+			return warnings, err
+		}
+		shown := pathDB
+		if zipPath := c.String("zip"); zipPath != "" {
+			shown = filepath.ToSlash(layout.db) + " in " + zipPath
+		}
+		status(c, fmt.Sprintf("SHA-256 %s  %s", sum, shown))
+		if c.Bool("checksum") {
+			// Same layout as sha256sum, so `sha256sum -c` can verify it later
+			line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(layout.db))
+			err := writeFile(pathDB + ".sha256", func(file io.Writer) error {
+				_, err := io.WriteString(file, line)
+				return err
+			})
+			if err != nil {
+				return warnings, errors.Wrap(err, "checksum")
+			}
+		}
+	}
+
+	if pool := c.String("store"); pool != "" {
+		added, linked, err := poolAttachments(filepath.Join(base, layout.attachments), pool)
+		if err != nil {
+			return warnings, err
+		}
+		status(c, fmt.Sprintf("Linked %d attachments to %s, %d of them new to it", linked, pool, added))
+	}
+
+	// Nothing is left to resume
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return warnings, errors.Wrap(err, "progress file")
+	}
 
+	// Checked last, so that a mismatch still leaves a complete extraction
+	if c.Bool("verify-sizes") {
+		if err := verifySizes(c, base, p.index); err != nil {
+			return warnings, err
+		}
+	}
+
+	if p.failed > 0 {
+		return warnings, failedError(p.failed)
+	}
+
+	logging.Infof("Done!")
+
+	return warnings, nil
+}
+
+// failedError is returned by ExtractFiles, once the extraction is otherwise
+// complete, when --keep-going left out attachments that could not be written.
+type failedError int
+
+func (n failedError) Error() string {
+	return fmt.Sprintf("%d attachments could not be written (see the warnings)", int(n))
+}
+
+// extractParts are the parts of a backup that --only can select, each
+// named after the flag that skips it.
+var extractParts = []string{"database", "attachments", "avatars", "stickers", "settings"}
+
+// applyOnly turns the --only selection into the equivalent skip flags.
+func applyOnly(c *cli.Context) error {
+	if !c.IsSet("only") {
+		return nil
+	}
+	only := make(map[string]bool)
+	for _, arg := range c.StringSlice("only") {
+		for _, part := range strings.Split(arg, ",") {
+			part = strings.ToLower(strings.TrimSpace(part))
+			if part == "" {
+				continue
+			}
+			if !slices.Contains(extractParts, part) {
+				return errors.Errorf("--only part '%s' not recognised", part)
+			}
+			only[part] = true
+		}
+	}
+	if len(only) == 0 {
+		return errors.New("--only lists no parts to extract")
+	}
+	for _, part := range extractParts {
+		if only[part] && c.Bool(part) {
+			return errors.Errorf("--only %s and --%s cannot be used together", part, part)
+		}
+		if !only[part] {
+			if err := c.Set(part, "true"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keyValueFile is the settings file name that KeyValue entries are grouped under.
+const keyValueFile = "signal"
+
+func preferenceValue(p *signal.SharedPreference) interface{} {
+	if p.GetIsStringSetValue() {
+		return p.GetStringSetValue()
+	} else if p.BooleanValue != nil {
+		return p.GetBooleanValue()
+	}
+	return p.Value
+}
+
+func keyValueValue(kv *signal.KeyValue) interface{} {
+	if        kv.BooleanValue != nil {
+		return kv.GetBooleanValue()
+	} else if kv.FloatValue != nil {
+		return kv.GetFloatValue()
+	} else if kv.IntegerValue != nil {
+		return kv.GetIntegerValue()
+	} else if kv.LongValue != nil {
+		return kv.GetLongValue()
+	} else if kv.StringValue != nil {
+		return kv.GetStringValue()
+	} else if kv.BlobValue != nil {
+		return newBlobSetting(kv.BlobValue)
+	}
 	return nil
 }
 
+// GetSetting reads the backup only as far as the setting named by "FILE:KEY",
+// as it would appear in Settings/FILE.json, and prints its value as JSON.
+func GetSetting(bf *types.BackupFile, name string, out io.Writer) error {
+	file, key, ok := strings.Cut(name, ":")
+	if !ok || file == "" || key == "" {
+		return errors.Errorf("setting '%s' must be given as FILE:KEY", name)
+	}
+
+	var (
+		value interface{}
+		found bool
+	)
+	fns := types.ConsumeFuncs{
+		PreferenceFunc: func(p *signal.SharedPreference) error {
+			if p.GetFile() != file || p.GetKey() != key {
+				return nil
+			}
+			value, found = preferenceValue(p), true
+			return types.ErrStopConsume
+		},
+		KeyValueFunc: func(kv *signal.KeyValue) error {
+			if file != keyValueFile || kv.GetKey() != key {
+				return nil
+			}
+			value, found = keyValueValue(kv), true
+			return types.ErrStopConsume
+		},
+	}
+	if err := bf.Consume(fns); err != nil {
+		return err
+	}
+	if !found {
+		return errors.Errorf("setting '%s' not found", name)
+	}
+
+	b, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json encode")
+	}
+	_, err = fmt.Fprintf(out, "%s\n", b)
+	return err
+}
+
+// blobSetting tags a KeyValue blob with its detected content type.
+// Raw always holds the original bytes (base64 in JSON) for fidelity.
+type blobSetting struct {
+	Type string  `json:"type"` // "text" or "binary"
+	Text *string `json:"text,omitempty"`
+	Raw  []byte  `json:"raw"`
+}
+
+func newBlobSetting(blob []byte) blobSetting {
+	b := blobSetting{Type: "binary", Raw: blob}
+	if isText(blob) {
+		s := string(blob)
+		b.Type = "text"
+		b.Text = &s
+	}
+	return b
+}
+
+// Valid UTF-8 without control characters is assumed to be a string;
+// anything else (typically a serialized protobuf) is left as binary.
+func isText(blob []byte) bool {
+	if !utf8.Valid(blob) {
+		return false
+	}
+	for _, r := range string(blob) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMimeFilter splits comma-separated MIME patterns and validates them.
+// A nil result means no filter was given.
+func parseMimeFilter(args []string) ([]string, error) {
+	var patterns []string
+	for _, arg := range args {
+		for _, p := range strings.Split(arg, ",") {
+			p = strings.ToLower(strings.TrimSpace(p))
+			if p == "" {
+				continue
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, errors.Wrap(err, "invalid --mime pattern "+p)
+			}
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, nil
+}
+
+// dateFilter keeps attachments by the date of their message, in milliseconds
+// since the Unix epoch. A zero bound is open.
+type dateFilter struct {
+	after, before int64
+	orphans       bool // keep attachments that belong to no message
+}
+
+// parseDateFilter reads --after, --before and --include-orphans. A nil result
+// means no range was given.
+func parseDateFilter(c *cli.Context) (*dateFilter, error) {
+	if c.String("after") == "" && c.String("before") == "" {
+		if c.Bool("include-orphans") {
+			return nil, errors.New("--include-orphans needs --after or --before")
+		}
+		return nil, nil
+	}
+	f := &dateFilter{orphans: c.Bool("include-orphans")}
+	var err error
+	if f.after, err = parseTimeFlag("after", c.String("after")); err != nil {
+		return nil, err
+	}
+	if f.before, err = parseTimeFlag("before", c.String("before")); err != nil {
+		return nil, err
+	}
+	if f.after != 0 && f.before != 0 && f.before <= f.after {
+		return nil, errors.New("--before must be later than --after")
+	}
+	return f, nil
+}
+
+// dateLayout is a date given alone as a time flag, which means the start of
+// that day in local time.
+const dateLayout = "2006-01-02"
+
+// parseTimeFlag reads a time given as RFC 3339, as a date (dateLayout) or as
+// milliseconds since the Unix epoch into milliseconds.
+func parseTimeFlag(name, s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	if t, err := time.ParseInLocation(dateLayout, s, time.Local); err == nil {
+		return t.UnixMilli(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.Errorf("--%s time '%s' not recognised; use RFC 3339, YYYY-MM-DD or Unix milliseconds", name, s)
+	}
+	return t.UnixMilli(), nil
+}
+
+// keeps reports whether an attachment of a message sent at time is kept; ok is
+// false for an attachment with no message.
+func (f *dateFilter) keeps(time int64, ok bool) bool {
+	if f == nil {
+		return true
+	}
+	if !ok {
+		return f.orphans
+	}
+	return (f.after == 0 || time >= f.after) && (f.before == 0 || time < f.before)
+}
+
+// declaredMime reports whether a declared MIME type says what the attachment
+// is; a missing or generic one is no use to --mime.
+func declaredMime(mime string) bool {
+	return mime != "" && !strings.EqualFold(mime, "application/octet-stream")
+}
+
+// detectMime returns the MIME type detected from a file's contents, or "".
+func detectMime(pathName string) string {
+	kind, err := filetype.MatchFile(pathName)
+	if err != nil || kind == filetype.Unknown {
+		return ""
+	}
+	return kind.MIME.Value
+}
+
+func matchMime(patterns []string, mime string) bool {
+	mime = strings.ToLower(mime)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, mime); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupAttachment finds the SQL row describing an attachment frame.
+//
+// Legacy "part" rows are keyed by unique_id, which the frame carries as
+// AttachmentId. Modern "attachment" rows are keyed by _id, which the frame
+// carries as RowId. The lookup tries, in order:
+//   1. AttachmentId as a part.unique_id or attachment._id
+//   2. RowId as a part._id or attachment._id
+//   3. AttachmentId as a part._id
+// If none match, the returned id is AttachmentId if present, else RowId.
+func lookupAttachment(a *signal.Attachment, store attachmentStore) (int64, attachmentInfo, bool, error) {
+	rowId := int64(a.GetRowId())
+	id := rowId
+	if a.AttachmentId != nil {
+		id = int64(*a.AttachmentId)
+		if info, ok, err := store.info(id); ok || err != nil {
+			return id, info, ok, err
+		}
+	}
+	for _, row := range []int64{rowId, id} {
+		if key, ok, err := store.key(row); err != nil {
+			return id, attachmentInfo{}, false, err
+		} else if ok {
+			info, _, err := store.info(key)
+			return key, info, true, err
+		}
+	}
+	return id, attachmentInfo{}, false, nil
+}
+
+// verifyDB runs SQLite's integrity check and reports any problems found.
+func verifyDB(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return errors.Wrap(err, "PRAGMA integrity_check failed")
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return errors.Wrap(err, "scan")
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("database integrity check failed:\n%s", strings.Join(problems, "\n"))
+	}
+	logging.Infof("Database integrity check: ok")
+	return nil
+}
+
+func fileSHA256(pathName string) (string, error) {
+	digest := sha256.New()
+	_, err := readFile(pathName, func(file io.Reader) (int64, error) {
+		return io.Copy(digest, file)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "checksum")
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// Columns read from each table while extracting. A missing optional column
+// is read as empty; a missing required one disables that table's lookups,
+// so its attachments, avatars or stickers are written without their details.
+var extractColumns = map[string]struct{ required, optional []string }{
+	"attachment": {[]string{"_id", "message_id"}, []string{"content_type", "data_size", "file_name", "upload_timestamp"}},
+	"part":       {[]string{"_id", "unique_id", "mid"}, []string{"ct", "data_size", "file_name", "upload_timestamp"}},
+	"recipient":  {[]string{"_id"}, []string{"last_profile_fetch", "group_id"}},
+	"groups":     {[]string{"group_id"}, []string{"title"}},
+	"sticker":    {[]string{"_id", "pack_id"}, []string{"pack_title", "pack_author", "file_length", "sticker_id", "cover"}},
+	"message":    {[]string{"_id"}, []string{"date_received"}},
+	"mms":        {[]string{"_id"}, []string{"date_received"}},
+}
+
+// checkColumns logs any columns of extractColumns missing from the schema of
+// table, and reports whether every required one is present.
+func checkColumns(table string, sch *types.Schema) bool {
+	cols, ok := extractColumns[table]
+	if !ok {
+		return true
+	}
+	usable := true
+	for _, column := range cols.required {
+		if !sch.HasField(column) {
+			logging.Warnf("table `%s` has no column `%s`, its rows will not be used to name files", table, column)
+			usable = false
+		}
+	}
+	for _, column := range cols.optional {
+		if !sch.HasField(column) {
+			logging.Warnf("table `%s` has no column `%s`, it will be left empty", table, column)
+		}
+	}
+	return usable
+}
+
+// fieldInt returns the integer in column, or 0 if it is missing or null.
+func fieldInt(sch *types.Schema, ps []*signal.SqlStatement_SqlParameter, column string) int64 {
+	if v, ok := sch.Field(ps, column); ok {
+		if n, ok := v.(*int64); ok && n != nil {
+			return *n
+		}
+	}
+	return 0
+}
+
+// fieldString returns the string in column, or nil if it is missing or null.
+func fieldString(sch *types.Schema, ps []*signal.SqlStatement_SqlParameter, column string) *string {
+	if v, ok := sch.Field(ps, column); ok {
+		if s, ok := v.(*string); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// fieldName is fieldString for a contact name, in Unicode NFC form so that
+// the same name always gives the same file name.
+func fieldName(sch *types.Schema, ps []*signal.SqlStatement_SqlParameter, column string) *string {
+	if s := fieldString(sch, ps, column); s != nil {
+		name := norm.NFC.String(*s)
+		return &name
+	}
+	return nil
+}
+
+// fieldGroupId returns the group id in column in its canonical text form,
+// whether it is stored as text or as raw bytes, or "" if there is none.
+func fieldGroupId(sch *types.Schema, ps []*signal.SqlStatement_SqlParameter, column string) string {
+	v, _ := sch.Field(ps, column)
+	switch id := v.(type) {
+	case *string:
+		if id != nil {
+			return message.CanonicalGroupId([]byte(*id))
+		}
+	case []byte:
+		if id != nil {
+			return message.CanonicalGroupId(id)
+		}
+	}
+	return ""
+}
+
+// fieldText is fieldString with an empty string for a missing value.
+func fieldText(sch *types.Schema, ps []*signal.SqlStatement_SqlParameter, column string) string {
+	if s := fieldString(sch, ps, column); s != nil {
+		return *s
+	}
+	return ""
+}
+
 func findColumn(sch *types.Schema, cols []string) string {
 	for _, column := range cols {
 		if sch.HasField(column) {
@@ -524,6 +1652,153 @@ func findColumn(sch *types.Schema, cols []string) string {
 	return ""
 }
 
+// orphanFraction is the share of a kind of frame with no SQL row above which the
+// rows were probably not recognised at all, rather than a few being missing.
+const orphanFraction = 0.5
+
+// reportOrphans sums up the frames that had no SQL row, by kind. When most frames
+// of a kind have none, the schema was likely misread, so that is said loudly.
+func reportOrphans(c *cli.Context, frameCount, orphans map[string]int) {
+	if c.Bool("quiet") {
+		return
+	}
+	for _, kind := range []string{"attachment", "avatar", "sticker"} {
+		n, total := orphans[kind], frameCount[kind]
+		if n == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d %s frames had no associated SQL entry\n", n, total, kind)
+		if float64(n) > orphanFraction*float64(total) {
+			fmt.Fprintf(os.Stderr, "WARNING: most %s frames could not be matched to the database. The schema\n"+
+				"may not have been parsed correctly (for example, a renamed id column).\n"+
+				"Run `signal-back analyse` on the backup to check.\n", kind)
+		}
+	}
+}
+
+// verifySizes compares each extracted attachment file with its declared size,
+// reports every mismatch and fails if there were any.
+func verifySizes(c *cli.Context, base string, index []indexEntry) error {
+	checked, bad, unknown := 0, 0, 0
+	for _, e := range index {
+		if e.Path == "" {
+			// Skipped after failing its MAC check
+			continue
+		}
+		if e.declared < 0 {
+			unknown++
+			continue
+		}
+		pathName, err := resolveDuplicate(filepath.Join(base, e.Path))
+		if err != nil {
+			return errors.Wrap(err, "verify sizes")
+		}
+		info, err := os.Stat(pathName)
+		if err != nil {
+			return errors.Wrap(err, "verify sizes")
+		}
+		checked++
+		if info.Size() != e.declared {
+			bad++
+			fmt.Fprintf(os.Stderr, "size mismatch: %s is %d bytes, database declares %d\n", e.Path, info.Size(), e.declared)
+		}
+	}
+
+	summary := fmt.Sprintf("Size check: %d attachments checked, %d mismatched", checked, bad)
+	if unknown > 0 {
+		summary += fmt.Sprintf(", %d with no declared size", unknown)
+	}
+	if bad > 0 {
+		return errors.New(summary + ", FAIL")
+	}
+	status(c, summary+", PASS")
+	return nil
+}
+
+// writeIndexCSV writes the attachment index, with a mac column if macs is set.
+func writeIndexCSV(pathName string, index []indexEntry, macs bool) error {
+	return writeFile(pathName, func(file io.Writer) error {
+		w := csv.NewWriter(file)
+		header := []string{"id", "message_id", "mime", "size", "path"}
+		if macs {
+			header = append(header, "mac")
+		}
+		w.Write(header)
+		for _, e := range index {
+			record := []string{fmt.Sprint(e.ID), fmt.Sprint(e.MessageID), e.Mime, fmt.Sprint(e.Size), filepath.ToSlash(e.Path)}
+			if macs {
+				record = append(record, e.MAC)
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// readIndexIDs returns the attachment ids listed in the manifests or index
+// files written by earlier runs with --index-csv. Attachments listed as
+// corrupt, with no path, were never written and are left out.
+func readIndexIDs(pathNames []string) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	for _, pathName := range pathNames {
+		if strings.EqualFold(filepath.Ext(pathName), ".json") {
+			if err := readManifestIDs(pathName, ids); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		file, err := os.Open(pathName)
+		if err != nil {
+			return nil, errors.Wrap(err, "earlier index")
+		}
+		records, err := csv.NewReader(file).ReadAll()
+		file.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "earlier index " + pathName)
+		}
+		if len(records) == 0 || len(records[0]) < 5 || records[0][0] != "id" || records[0][4] != "path" {
+			return nil, errors.Errorf("%s is not an attachment index written by --index-csv", pathName)
+		}
+		for i, record := range records[1:] {
+			if record[4] == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(record[0], 10, 64)
+			if err != nil {
+				return nil, errors.Errorf("%s line %d: bad attachment id '%s'", pathName, i+2, record[0])
+			}
+			ids[id] = true
+		}
+	}
+	return ids, nil
+}
+
+// readManifestIDs adds the ids of the attachments in the manifest.json at
+// pathName to ids.
+func readManifestIDs(pathName string, ids map[int64]bool) error {
+	data, err := os.ReadFile(pathName)
+	if err != nil {
+		return errors.Wrap(err, "earlier manifest")
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return errors.Wrap(err, "earlier manifest " + pathName)
+	}
+	for i, e := range m.Files {
+		if e.Category != "attachment" {
+			continue
+		}
+		id, err := strconv.ParseInt(e.ID, 10, 64)
+		if err != nil {
+			return errors.Errorf("%s file %d: bad attachment id '%s'", pathName, i+1, e.ID)
+		}
+		ids[id] = true
+	}
+	return nil
+}
+
+// writeJson is reproducible: encoding/json writes map keys in sorted order.
 func writeJson(pathName string, value interface{}) error {
 	data, err := json.MarshalIndent(value, "", "\t")
 	if err != nil {
@@ -535,10 +1810,97 @@ func writeJson(pathName string, value interface{}) error {
 	})
 }
 
+// convertSticker writes a PNG copy of a WebP sticker, removing the original if
+// replace is set. Other formats, and animated stickers, which the decoder does
+// not support, are left as they are. It returns the file left standing for the
+// sticker: the copy if it replaced the original, or else pathName.
+func convertSticker(pathName string, replace bool, warn warnFunc) (string, error) {
+	kind, err := filetype.MatchFile(pathName)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read " + pathName)
+	}
+	if kind.MIME.Value != "image/webp" {
+		return pathName, nil
+	}
+
+	file, err := os.Open(pathName)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open " + pathName)
+	}
+	img, err := webp.Decode(file)
+	file.Close()
+	if err != nil {
+		warn("sticker `%v` could not be converted: %v", filepath.Base(pathName), err)
+		return pathName, nil
+	}
+
+	pngName := strings.TrimSuffix(pathName, filepath.Ext(pathName)) + ".png"
+	if err := writeFile(pngName, func(w io.Writer) error { return png.Encode(w, img) }); err != nil {
+		return "", err
+	}
+	if replace {
+		return pngName, os.Remove(pathName)
+	}
+	return pathName, nil
+}
+
+// skipBad removes a partially written file if err is a MAC failure, reporting whether
+// extraction may continue. Only the payload of the file was damaged in that case, and it
+// has been read to the end, so the next frame is still aligned.
+func skipBad(err error, pathName string, warn warnFunc) bool {
+	if errors.Cause(err) != types.ErrAttachmentMAC {
+		return false
+	}
+	warn("data for `%v` is corrupt (MAC mismatch), skipped", filepath.Base(pathName))
+	if err := os.Remove(pathName); err != nil && !os.IsNotExist(err) {
+		logging.Warnf("unable to remove partial file: %s", err)
+	}
+	return true
+}
+
+// outputError is a failure to write out an attachment whose data was still
+// read in full, so the next frame is aligned and extraction may continue.
+type outputError struct {
+	error
+}
+
+// writeAttachment writes the next attachment in the backup to pathName. When
+// the file cannot be created or written, the data is read to its end all the
+// same, and the error is an outputError.
 func writeAttachment(pathName string, length uint32, bf *types.BackupFile) error {
-	return writeFile(pathName, func(file io.Writer) error {
-		return bf.DecryptAttachment(length, file)
+	var read error
+	started := false
+	err := writeFile(pathName, func(file io.Writer) error {
+		started = true
+		out := &failedWriter{w: file}
+		if read = bf.DecryptAttachment(length, out); read != nil {
+			return read
+		}
+		return out.err
 	})
+	if err == nil || read != nil {
+		return err
+	}
+	if !started {
+		if err := bf.DecryptAttachment(length, nil); err != nil {
+			return err
+		}
+	}
+	return outputError{err}
+}
+
+// failedWriter passes writes on to w until one fails, then drops the rest,
+// keeping the first error.
+type failedWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (f *failedWriter) Write(p []byte) (int, error) {
+	if f.err == nil {
+		_, f.err = f.w.Write(p)
+	}
+	return len(p), nil
 }
 
 func writeFile(pathName string, write func(w io.Writer) error) error {
@@ -569,9 +1931,14 @@ func setFileTimestamp(pathName string, milliseconds int64) error {
 	return nil
 }
 
-// Convert illegal filename characters into url-style %XX substrings
+// Convert illegal filename characters into url-style %XX substrings.
+// Names made only of dots are escaped too, so "." and ".." cannot
+// escape the intended directory.
 func escapeFileName(fileName string) (string) {
 	const illegal = `<>:"/\|?*`
+	if strings.Trim(fileName, ".") == "" {
+		return strings.ReplaceAll(fileName, ".", "%2E")
+	}
 	s := ""
 	for _, c := range fileName {
 		if c < ' ' || strings.IndexRune(illegal, c) >= 0 {
@@ -583,7 +1950,7 @@ func escapeFileName(fileName string) (string) {
 	return s
 }
 
-func fixFileExtension(pathName string, mimeType string) (string, error) {
+func fixFileExtension(pathName string, mimeType string, warn warnFunc) (string, error) {
 	fileName := filepath.Base(pathName)
 
 	// Set default extension by MIME type
@@ -593,29 +1960,29 @@ func fixFileExtension(pathName string, mimeType string) (string, error) {
 		if hasExt {
 			ext = mimeExt
 		} else {
-			log.Printf("mime type `%s` not recognised [%v]", mimeType, fileName)
+			warn("mime type `%s` not recognised [%v]", mimeType, fileName)
 		}
 	}
 
 	// Inspect the file data itself to detect proper extension
 	if kind, err := filetype.MatchFile(pathName); err != nil {
-		log.Println("MatchFile:", err.Error())
+		logging.Warnf("MatchFile: %v", err)
 	} else {
 		if kind != filetype.Unknown {
 			if ext != "" && (kind.MIME.Value != mimeType || kind.Extension != ext) {
-				log.Printf("detected file type: %s (.%s) [%v]", kind.MIME.Value, kind.Extension, fileName)
-				log.Printf("mismatches declared type: %s (.%s)", mimeType, ext)
+				logging.Infof("detected file type: %s (.%s) [%v]", kind.MIME.Value, kind.Extension, fileName)
+				logging.Infof("mismatches declared type: %s (.%s)", mimeType, ext)
 			}
 			ext = kind.Extension
 		} else {
-			log.Printf("unable to detect file type [%v]", fileName)
+			warn("unable to detect file type [%v]", fileName)
 			if ext != "" {
-				log.Printf("using declared MIME type: %s (.%s)", mimeType, ext)
+				logging.Infof("using declared MIME type: %s (.%s)", mimeType, ext)
 			} else if strings.HasPrefix(mimeType, "text/") {
-				log.Printf("assuming contents are `text`")
+				logging.Infof("assuming contents are `text`")
 			} else {
-				log.Println("*** Please create a PR or issue if you think it have should been.")
-				log.Printf("*** If you can provide details on the file `%v` as well, it would be appreciated", fileName)
+				logging.Infof("*** Please create a PR or issue if you think it have should been.")
+				logging.Infof("*** If you can provide details on the file `%v` as well, it would be appreciated", fileName)
 			}
 		}
 	}
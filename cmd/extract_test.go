@@ -0,0 +1,543 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/backuptest"
+	"github.com/xeals/signal-back/signal"
+	"github.com/xeals/signal-back/types"
+	"github.com/xeals/signal-back/types/message"
+)
+
+// extractBackup writes the backup built by b to a temporary folder, extracts
+// it there with the extra args, and returns the output folder.
+func extractBackup(tb testing.TB, b *backuptest.Builder, args ...string) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	backup := filepath.Join(dir, "test.backup")
+	if err := b.WriteFile(backup); err != nil {
+		tb.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := runExtract(append(args, "-o", out, backup)...); err != nil {
+		tb.Fatal(err)
+	}
+	return out
+}
+
+func runExtract(args ...string) error {
+	app := cli.NewApp()
+	app.Commands = []cli.Command{Extract}
+	args = append([]string{"signal-back", "extract", "-q", "-p", backuptest.Password, "--kdf-rounds", "1"}, args...)
+	return app.Run(args)
+}
+
+// manyRows returns a backup with n rows in one table, inserted by two
+// alternating statements and interrupted by an UPDATE, so that statementBatch
+// reuses prepared statements across several transactions.
+func manyRows(n int) *backuptest.Builder {
+	b := backuptest.New(backuptest.Password, backuptest.WithKDFRounds(1))
+	b.Statement("CREATE TABLE t (_id INTEGER PRIMARY KEY, n INTEGER, s TEXT)")
+	for i := 1; i <= n; i++ {
+		if i%2 == 0 {
+			b.Statement("INSERT INTO t VALUES (?,?,?)", backuptest.Integer(int64(i)), backuptest.Integer(int64(-i)), backuptest.String(fmt.Sprint(i)))
+		} else {
+			b.Statement("INSERT INTO t (s, n, _id) VALUES (?,?,?)", backuptest.String(""), backuptest.Null(), backuptest.Integer(int64(i)))
+		}
+		if i == n/2 {
+			b.Statement("UPDATE t SET s = 'updated' WHERE _id < 10")
+		}
+	}
+	b.End()
+	return b
+}
+
+// manyAttachments returns a backup of n messages with an attachment each, of
+// two kinds and sizes. Every third attachment comes before its message row.
+func manyAttachments(n int) *backuptest.Builder {
+	b := backuptest.New(backuptest.Password, backuptest.WithKDFRounds(1))
+	b.Statement("CREATE TABLE message (_id INTEGER PRIMARY KEY, thread_id INTEGER, date_sent INTEGER, date_received INTEGER, body TEXT)")
+	b.Statement("CREATE TABLE attachment (_id INTEGER PRIMARY KEY, message_id INTEGER, content_type TEXT, data_size INTEGER, file_name TEXT, upload_timestamp INTEGER)")
+	for i := 1; i <= n; i++ {
+		id := backuptest.Integer(int64(i))
+		mime, data := "image/png", backuptest.AttachmentData
+		if i%2 == 0 {
+			mime, data = "text/plain", []byte(strings.Repeat(fmt.Sprint(i), i))
+		}
+		b.Statement("INSERT INTO attachment VALUES (?,?,?,?,?,?)", id, id, backuptest.String(mime), backuptest.Integer(int64(len(data))), backuptest.Null(), backuptest.Integer(0))
+		message := func() {
+			b.Statement("INSERT INTO message VALUES (?,?,?,?,?)", id, backuptest.Integer(1), backuptest.Integer(1600000000000+int64(i)), backuptest.Integer(1600000001000+int64(i)), backuptest.String(fmt.Sprint(i)))
+		}
+		if i%3 != 0 {
+			message()
+		}
+		b.Attachment(uint64(i), uint64(i), data)
+		if i%3 == 0 {
+			message()
+		}
+	}
+	b.End()
+	return b
+}
+
+// replay decrypts the backup built by b and passes each statement to exec
+// with its parameters converted as ExtractFiles does. It returns the names of
+// the tables created.
+func replay(tb testing.TB, b *backuptest.Builder, exec func(stmt string, param ...interface{}) error) []string {
+	tb.Helper()
+	bf, err := types.NewBackupFileFromReader(bytes.NewReader(b.Bytes()), int64(len(b.Bytes())), backuptest.Password, types.WithKDFRounds(1))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	schema := make(map[string]*types.Schema)
+	var tables []string
+	err = bf.Consume(types.ConsumeFuncs{
+		StatementFunc: func(s *signal.SqlStatement) error {
+			stmt := s.GetStatement()
+			a := strings.SplitN(stmt, " ", 4)
+			if strings.HasPrefix(stmt, "CREATE TABLE ") {
+				table := types.Unwrap(a[2], `""`)
+				schema[table] = types.NewSchema(a[3])
+				tables = append(tables, table)
+			}
+			param := make([]interface{}, len(s.Parameters))
+			if strings.HasPrefix(stmt, "INSERT INTO ") {
+				param = schema[types.Unwrap(a[2], `""`)].RowValues(s.Parameters)
+			}
+			return exec(stmt, param...)
+		},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tables
+}
+
+func TestStatementBatchPrepared(t *testing.T) {
+	backups := map[string]*backuptest.Builder{
+		"legacy":    backuptest.Legacy(backuptest.WithKDFRounds(1)),
+		"unified":   backuptest.Unified(backuptest.WithKDFRounds(1)),
+		"many rows": manyRows(2*statementBatchSize + 3),
+	}
+	for name, b := range backups {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			plain, err := createDB(filepath.Join(dir, "plain.db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer plain.Close()
+			prepared, err := createDB(filepath.Join(dir, "prepared.db"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer prepared.Close()
+			batch := &statementBatch{db: prepared}
+			defer batch.rollback()
+
+			tables := replay(t, b, func(stmt string, param ...interface{}) error {
+				if _, err := plain.Exec(stmt, param...); err != nil {
+					return err
+				}
+				return batch.exec(stmt, param...)
+			})
+			if err := batch.commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, table := range tables {
+				_, want, err := SelectEntireTable(plain, table)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, got, err := SelectEntireTable(prepared, table)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(StringifyRows(got, -1), StringifyRows(want, -1)) {
+					t.Errorf("table %s differs with prepared statements", table)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkExtractStatements compares building the database one statement
+// at a time with building it in the transactions of statementBatch.
+func BenchmarkExtractStatements(b *testing.B) {
+	backup := manyRows(20000)
+	execs := []struct {
+		name string
+		exec func(db *sql.DB) (func(string, ...interface{}) error, func() error)
+	}{
+		{"autocommit", func(db *sql.DB) (func(string, ...interface{}) error, func() error) {
+			return func(stmt string, param ...interface{}) error {
+				_, err := db.Exec(stmt, param...)
+				return err
+			}, func() error { return nil }
+		}},
+		{"batched", func(db *sql.DB) (func(string, ...interface{}) error, func() error) {
+			batch := &statementBatch{db: db}
+			return batch.exec, batch.commit
+		}},
+	}
+	for _, e := range execs {
+		b.Run(e.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db, err := createDB(filepath.Join(b.TempDir(), "signal.db"), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				exec, commit := e.exec(db)
+				replay(b, backup, exec)
+				if err := commit(); err != nil {
+					b.Fatal(err)
+				}
+				db.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkExtract runs the whole extract command on a backup of 20000 rows.
+func BenchmarkExtract(b *testing.B) {
+	backup := manyRows(20000)
+	for i := 0; i < b.N; i++ {
+		extractBackup(b, backup)
+	}
+}
+
+func TestFieldGroupId(t *testing.T) {
+	// As stored by Signal: a prefix and the hex of the 32-byte group id
+	const v2 = "__signal_group__v2__!0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+	raw, err := hex.DecodeString(strings.TrimPrefix(v2, message.GroupIdPrefixV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sch := types.NewSchema("(_id INTEGER PRIMARY KEY, group_id TEXT)")
+	tests := []struct {
+		name  string
+		param *signal.SqlStatement_SqlParameter
+		want  string
+	}{
+		{"text", backuptest.String(v2), v2},
+		{"v1 text", backuptest.String("__textsecure_group__!00112233445566778899aabbccddeeff"), "__textsecure_group__!00112233445566778899aabbccddeeff"},
+		{"blob", &signal.SqlStatement_SqlParameter{BlobParameter: raw}, v2},
+		{"prefixed blob", &signal.SqlStatement_SqlParameter{BlobParameter: append([]byte(message.GroupIdPrefixV2), raw...)}, v2},
+		{"null", backuptest.Null(), ""},
+	}
+	for _, tt := range tests {
+		ps := []*signal.SqlStatement_SqlParameter{backuptest.Integer(1), tt.param}
+		if got := fieldGroupId(sch, ps, "group_id"); got != tt.want {
+			t.Errorf("%s: fieldGroupId = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLookupAttachment(t *testing.T) {
+	store := newMemoryAttachments()
+	// A legacy part row, keyed by unique_id, and a modern attachment row
+	if err := store.addRow(5, 1600000003001, attachmentInfo{msg: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.addRow(7, 7, attachmentInfo{msg: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := func(n uint64) *uint64 { return &n }
+	tests := []struct {
+		name  string
+		frame *signal.Attachment
+		id    int64
+		msg   int64
+		found bool
+	}{
+		{"AttachmentId is part.unique_id", &signal.Attachment{RowId: ref(5), AttachmentId: ref(1600000003001)}, 1600000003001, 1, true},
+		{"RowId is attachment._id", &signal.Attachment{RowId: ref(7), AttachmentId: ref(99)}, 7, 2, true},
+		{"RowId alone", &signal.Attachment{RowId: ref(7)}, 7, 2, true},
+		{"AttachmentId is part._id", &signal.Attachment{RowId: ref(99), AttachmentId: ref(5)}, 1600000003001, 1, true},
+		{"no match", &signal.Attachment{RowId: ref(43), AttachmentId: ref(42)}, 42, 0, false},
+		{"no match without AttachmentId", &signal.Attachment{RowId: ref(43)}, 43, 0, false},
+	}
+	for _, tt := range tests {
+		id, info, found, err := lookupAttachment(tt.frame, store)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if id != tt.id || info.msg != tt.msg || found != tt.found {
+			t.Errorf("%s: lookupAttachment = %d, msg %d, %t, want %d, msg %d, %t", tt.name, id, info.msg, found, tt.id, tt.msg, tt.found)
+		}
+	}
+}
+
+// TestJobsSameOutput extracts with several workers and with one, which must
+// write the same files and list them the same way.
+func TestJobsSameOutput(t *testing.T) {
+	backup := manyAttachments(60)
+	read := func(jobs string) (files, manifest, index []byte) {
+		dir := t.TempDir()
+		out := extractBackup(t, backup, "--jobs", jobs, "--index-csv", filepath.Join(dir, "index.csv"))
+		var err error
+		if manifest, err = os.ReadFile(filepath.Join(out, manifestFilename)); err != nil {
+			t.Fatal(err)
+		}
+		if index, err = os.ReadFile(filepath.Join(dir, "index.csv")); err != nil {
+			t.Fatal(err)
+		}
+		return attachmentFiles(t, out), manifest, index
+	}
+
+	files, manifest, index := read("1")
+	if len(bytes.Split(files, []byte("\n"))) != 60 {
+		t.Fatalf("%d attachments written, want 60", len(bytes.Split(files, []byte("\n"))))
+	}
+	for i := 0; i < 5; i++ {
+		f, m, x := read("4")
+		if !bytes.Equal(f, files) {
+			t.Errorf("--jobs 4 writes other files")
+		}
+		if !bytes.Equal(m, manifest) {
+			t.Errorf("--jobs 4 gives another manifest")
+		}
+		if !bytes.Equal(x, index) {
+			t.Errorf("--jobs 4 gives another index")
+		}
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC-4", -4*60*60)
+	defer func() { time.Local = local }()
+
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"", 0},
+		{"1600000000000", 1600000000000},
+		{"2020-09-13T12:26:40Z", 1600000000000},
+		{"2020-09-13T08:26:40-04:00", 1600000000000},
+		{"2020-09-13", 1599969600000}, // midnight in UTC-4
+	}
+	for _, tt := range tests {
+		got, err := parseTimeFlag("after", tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("parseTimeFlag(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+	if _, err := parseTimeFlag("after", "13/09/2020"); err == nil {
+		t.Error("parseTimeFlag(13/09/2020) succeeded")
+	}
+}
+
+func TestEscapeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"résumé 2.pdf", "résumé 2.pdf"},
+		{".hidden", ".hidden"},
+		{"..name", "..name"},
+		{".", "%2E"},
+		{"..", "%2E%2E"},
+		{"...", "%2E%2E%2E"},
+		{"../../etc/passwd", "..%2F..%2Fetc%2Fpasswd"},
+		{"/etc/passwd", "%2Fetc%2Fpasswd"},
+		{`..\windows`, "..%5Cwindows"},
+		{"a\x00b", "a%00b"},
+		{"\x00", "%00"},
+		{"line\nbreak\t", "line%0Abreak%09"},
+		{`a<b>c:"d"|e?f*`, "a%3Cb%3Ec%3A%22d%22%7Ce%3Ff%2A"},
+	}
+	for _, tt := range tests {
+		if got := escapeFileName(tt.name); got != tt.want {
+			t.Errorf("escapeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// attachmentFiles lists the name and contents of each file in the attachments
+// folder of out, one to a line.
+func attachmentFiles(tb testing.TB, out string) []byte {
+	tb.Helper()
+	entries, err := os.ReadDir(filepath.Join(out, FolderAttachment))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(out, FolderAttachment, e.Name()))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		names = append(names, fmt.Sprintf("%s %x", e.Name(), data))
+	}
+	return []byte(strings.Join(names, "\n"))
+}
+
+// TestResume interrupts an extraction by putting a folder where one of the
+// attachments goes, then resumes it once the folder is gone.
+func TestResume(t *testing.T) {
+	backup := manyAttachments(30)
+	clean := extractBackup(t, backup)
+
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "test.backup")
+	if err := backup.WriteFile(backupPath); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	blocker := filepath.Join(out, FolderAttachment, "000020")
+	if err := os.MkdirAll(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runExtract("-o", out, backupPath); err == nil {
+		t.Fatal("extraction into a blocked folder succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(out, filenameDB)); !os.IsNotExist(err) {
+		t.Errorf("interrupted extraction left %s: %v", filenameDB, err)
+	}
+	b, err := os.ReadFile(filepath.Join(out, progressFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state resumeState
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Attachments) == 0 || len(state.Attachments) >= 20 {
+		t.Fatalf("progress file lists %d attachments, want some of the first 19", len(state.Attachments))
+	}
+
+	// Overwrite the files written, keeping their size, so that writing one
+	// again shows
+	for _, r := range state.Attachments {
+		pathName := filepath.Join(out, r.Path)
+		info, err := os.Stat(pathName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pathName, bytes.Repeat([]byte("x"), int(info.Size())), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := runExtract("--resume", "-o", out, backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, r := range state.Attachments {
+		pathName := filepath.Join(out, r.Path)
+		data, err := os.ReadFile(pathName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bytes.Trim(data, "x")) > 0 {
+			t.Errorf("attachment %d was written again", id)
+		}
+		// Put back what the clean run wrote, for the comparison below
+		data, err = os.ReadFile(filepath.Join(clean, r.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pathName, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := attachmentFiles(t, out), attachmentFiles(t, clean); !bytes.Equal(got, want) {
+		t.Errorf("resumed extraction wrote\n%s\nwant\n%s", got, want)
+	}
+	for _, name := range []string{manifestFilename, filenameDB} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(filepath.Join(clean, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("resumed extraction gives another %s", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, progressFileName)); !os.IsNotExist(err) {
+		t.Errorf("progress file is left after resuming: %v", err)
+	}
+}
+
+// TestLayoutPerRun extracts with --android-layout and then without, in one
+// process, as the layout of one run must not carry over to the next.
+func TestLayoutPerRun(t *testing.T) {
+	runs := []struct {
+		args  []string
+		files []string
+	}{
+		{[]string{"--android-layout"}, []string{filepath.Join("databases", "signal.db"), filepath.Join("app_parts", "part1.mms")}},
+		{nil, []string{"signal.db", filepath.Join("Attachments", "000001.png")}},
+	}
+	for _, r := range runs {
+		out := extractBackup(t, backuptest.Minimal(backuptest.WithKDFRounds(1)), r.args...)
+		for _, f := range r.files {
+			if _, err := os.Stat(filepath.Join(out, f)); err != nil {
+				t.Errorf("with %q: %v", r.args, err)
+			}
+		}
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	out := extractBackup(t, backuptest.Minimal(backuptest.WithKDFRounds(1)))
+	pathName := filepath.Join(out, manifestFilename)
+
+	data, err := os.ReadFile(pathName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(backuptest.AttachmentData))
+	want := []manifestEntry{{
+		Category:     "attachment",
+		ID:           "1",
+		Path:         filepath.Join("Attachments", "000001.png"),
+		Mime:         "image/png",
+		DeclaredSize: &size,
+		Size:         size,
+		Extension:    "png",
+	}}
+	if !reflect.DeepEqual(m.Files, want) {
+		t.Errorf("manifest files = %+v, want %+v", m.Files, want)
+	}
+
+	ids, err := readIndexIDs([]string{pathName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, map[int64]bool{1: true}) {
+		t.Errorf("ids read back = %v, want [1]", ids)
+	}
+
+	// A second run since that manifest has no attachment left to write
+	again := extractBackup(t, backuptest.Minimal(backuptest.WithKDFRounds(1)), "--since-manifest", pathName)
+	if _, err := os.Stat(filepath.Join(again, "Attachments", "000001.png")); !os.IsNotExist(err) {
+		t.Errorf("attachment written again: %v", err)
+	}
+}
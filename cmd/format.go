@@ -2,7 +2,7 @@ package cmd
 
 import (
 	"bytes"
-	"cmp"
+	"compress/gzip"
 	"database/sql"
 	"encoding/base64"
 	"encoding/csv"
@@ -10,22 +10,267 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
-	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/logging"
 	"github.com/xeals/signal-back/types"
 	"github.com/xeals/signal-back/types/message"
+	"golang.org/x/text/encoding/unicode"
 )
 
-type options struct {
+// FormatOptions controls what the formatters, and LoadMessages, include in their output.
+type FormatOptions struct {
 	EmbedAttachments bool
-	Limit            int
+	EmbedMaxSize     int64
+	OnlyArchived     bool
+	SkipArchived     bool
+	FilterEmpty      bool
+	AndroidNames     bool
+
+	// If set, referenced (not embedded) attachments are copied into this
+	// directory and src points at the copies, relative to ReferenceRoot.
+	ExtractReferenced string
+	ReferenceRoot     string
+
+	Sample           int  // if set, keep only this many messages of varied kinds
+	Redact           bool // replace message bodies with placeholder text
+	NoBodies         bool // replace message text with its length
+	Receipts         bool // include delivery and read receipts of sent messages
+	Newline          string // if set, line endings in text are converted to this
+	Limit            int // maximum rows read from each table, or -1 for all
+	Avatars          string // if set, the folder of avatars shown beside each sender
+	XMLEncoding      string // UTF-8 or UTF-16; empty is UTF-8
+	Thread           int64 // if set, only the messages of this thread
+	Recipient        string // if set, only messages with this phone number, as normalizePhone gives
+	After            int64 // if set, only messages dated at or after this, in ms since the epoch
+	Before           int64 // if set, only messages dated before this, in ms since the epoch
+	Dates            message.Dates // time zone of readable dates, or numeric dates only
+
+	markers map[int64][]string // message id -> attachment markers for the body
+}
+
+// normalizeNewlines converts every line ending in s (\r\n, \n or a lone \r)
+// to opt.Newline.
+func (opt FormatOptions) normalizeNewlines(s string) string {
+	if !strings.ContainsRune(s, '\r') && opt.Newline == "\n" {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	if opt.Newline != "\n" {
+		s = strings.ReplaceAll(s, "\n", opt.Newline)
+	}
+	return s
+}
+
+// prepareRow makes the values of a table row ready to write: group ids are
+// given their text form, and normalizeNewlines is applied to text values.
+func (opt FormatOptions) prepareRow(headers []string, row []interface{}) {
+	if opt.NoBodies {
+		for i, name := range headers {
+			if s, ok := row[i].(*string); ok && s != nil && textColumns[name] {
+				*s = textLength(*s)
+			}
+		}
+	}
+	if opt.markers != nil {
+		opt.inlineMarkers(headers, row)
+	}
+	for i, v := range row {
+		if headers[i] == "group_id" {
+			switch id := v.(type) {
+			case *string:
+				if id != nil {
+					*id = message.CanonicalGroupId([]byte(*id))
+				}
+			case *[]byte:
+				s := message.CanonicalGroupId(*id)
+				row[i] = &s
+			}
+		}
+		if s, ok := row[i].(*string); ok && s != nil && opt.Newline != "" {
+			*s = opt.normalizeNewlines(*s)
+		}
+	}
+}
+
+// inlineMarkers appends the attachment markers of the row's message to its body.
+// Signal does not record where in the text an attachment was placed, so the
+// markers always follow the text.
+func (opt FormatOptions) inlineMarkers(headers []string, row []interface{}) {
+	id, body := -1, -1
+	for i, name := range headers {
+		switch name {
+		case "_id":
+			id = i
+		case "body":
+			body = i
+		}
+	}
+	if id < 0 || body < 0 {
+		return
+	}
+	msg, ok := row[id].(*int64)
+	if !ok || msg == nil || len(opt.markers[*msg]) == 0 {
+		return
+	}
+	text := strings.Join(opt.markers[*msg], " ")
+	if s, ok := row[body].(*string); ok && s != nil && *s != "" {
+		text = *s + " " + text
+	}
+	row[body] = &text
+}
+
+// loadAttachmentMarkers reads the attachments of every message in table, as
+// markers that stand in for them in a text-only export.
+func loadAttachmentMarkers(db *sql.DB, table string) (map[int64][]string, error) {
+	markers := make(map[int64][]string)
+	switch table {
+	case "message", "scheduled":
+		rows, err := SelectStructFromTable(db, message.DbAttachment{}, "attachment")
+		if err != nil {
+			return nil, errors.Wrap(err, "select attachment")
+		}
+		for _, row := range rows {
+			r := row.(*message.DbAttachment)
+			markers[r.MessageId] = append(markers[r.MessageId], attachmentMarker(r.ContentType.String, r.FileName.String))
+		}
+	case "mms":
+		rows, err := SelectStructFromTable(db, message.DbPart{}, "part")
+		if err != nil {
+			return nil, errors.Wrap(err, "select part")
+		}
+		for _, row := range rows {
+			r := row.(*message.DbPart)
+			// The text and layout of an MMS are parts too, but not attachments
+			if r.Ct == "text/plain" || r.Ct == "application/smil" {
+				continue
+			}
+			name := r.Fn.String
+			if name == "" {
+				name = r.Name.String
+			}
+			markers[r.Mid] = append(markers[r.Mid], attachmentMarker(r.Ct, name))
+		}
+	default:
+		return nil, errors.Errorf("--inline-attachments does not apply to table '%s'", table)
+	}
+	return markers, nil
+}
+
+// textColumns are the columns that hold what people wrote, across the legacy
+// and unified schemas, which --no-bodies leaves out.
+var textColumns = map[string]bool{
+	"body":          true,
+	"subject":       true,
+	"sub":           true,
+	"quote_body":    true,
+	"link_previews": true,
+}
+
+// textLength stands in for text by its length, as "[42 characters]", so that
+// exports without the text can still be analysed.
+func textLength(s string) string {
+	if s == "" {
+		return s
+	}
+	return fmt.Sprintf("[%d characters]", utf8.RuneCountInString(s))
+}
+
+// attachmentMarker describes an attachment as, for example, "[image: photo.jpg]",
+// falling back to its MIME type when it has no file name.
+func attachmentMarker(mime, name string) string {
+	kind := "file"
+	switch major := strings.SplitN(mime, "/", 2)[0]; major {
+	case "image", "video", "audio":
+		kind = major
+	}
+	if name == "" {
+		name = mime
+	}
+	if name == "" {
+		return "[" + kind + "]"
+	}
+	return "[" + kind + ": " + name + "]"
+}
+
+// skipThread reports whether messages of the thread with the given id and
+// archived state are excluded by the thread and archive filters.
+func (opt FormatOptions) skipThread(id int64, archived bool) bool {
+	if opt.Thread != 0 && id != opt.Thread {
+		return true
+	}
+	return (opt.OnlyArchived && !archived) || (opt.SkipArchived && archived)
+}
+
+// loadThreads reads the thread table by thread id. Older schemas name the
+// recipient column of a thread differently, so there only the id and archived
+// state are read.
+func loadThreads(db *sql.DB) (map[int64]message.DbThread, error) {
+	threads := make(map[int64]message.DbThread)
+	current, err := HasColumn(db, "thread", "recipient_id")
+	if err != nil {
+		return nil, err
+	}
+	if current {
+		rows, err := SelectStructFromTable(db, message.DbThread{}, "thread")
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			r := row.(*message.DbThread)
+			threads[r.ID] = *r
+		}
+		return threads, nil
+	}
+
+	rows, err := db.Query("SELECT _id, archived FROM thread")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t message.DbThread
+		if err := rows.Scan(&t.ID, &t.Archived); err != nil {
+			return nil, err
+		}
+		threads[t.ID] = t
+	}
+	return threads, rows.Err()
+}
+
+// skipRecipient reports whether a message is excluded by the recipient
+// filter, given the phone numbers of its thread and correspondents.
+func (opt FormatOptions) skipRecipient(phones ...sql.NullString) bool {
+	if opt.Recipient == "" {
+		return false
+	}
+	for _, phone := range phones {
+		if phone.Valid && normalizePhone(phone.String) == opt.Recipient {
+			return false
+		}
+	}
+	return true
+}
+
+// skipDate reports whether a message dated ms, in milliseconds since the
+// epoch, is outside the --after and --before window.
+func (opt FormatOptions) skipDate(ms uint64) bool {
+	return (opt.After != 0 && int64(ms) < opt.After) || (opt.Before != 0 && int64(ms) >= opt.Before)
+}
+
+// normalizePhone drops the spaces and any leading + from a phone number, so
+// that "+1 555 0100" and "15550100" match.
+func normalizePhone(phone string) string {
+	return strings.TrimPrefix(strings.Join(strings.Fields(phone), ""), "+")
 }
 
 // Format fulfils the `format` subcommand.
@@ -44,25 +289,168 @@ var Format = cli.Command{
 		},
 		&cli.StringFlag{
 			Name:  "format, f",
-			Usage: "Output messages as `FORMAT` (xml, csv, json).\n\t\t" +
+			Usage: "Output messages as `FORMAT` (xml, html, csv, json, ndjson for one\n\t\t" +
+			       "JSON object per line, vcf for contacts, or sql for --schema).\n\t\t" +
 			       "Default matches --output file extension,\n\t\t" +
 			       "or 'xml' if no output file specified.",
 		},
 		&cli.StringFlag{
 			Name:  "table, t",
-			Usage: "For csv|json, choose which `TABLE` to format (e.g. message, sms).\n\t\t" +
+			Usage: "For csv|json|ndjson, choose which `TABLE` to format (e.g. message, sms).\n\t\t" +
 			       "Default matches --output file basename,\n\t\t" +
-			       "or 'message' if no output file specified.",
+			       "or 'message' if no output file specified.\n\t\t" +
+			       "'draft' and 'scheduled' list unsent messages by thread name.",
+		},
+		&cli.BoolFlag{
+			Name:  "schema",
+			Usage: "Write the CREATE TABLE statements of the database instead of\n\t\t" +
+			       "its contents, referenced tables first (same as --format sql)",
+		},
+		&cli.BoolFlag{
+			Name:  "schema-all",
+			Usage: "With --schema, also write the indexes, triggers and views",
+		},
+		&cli.StringFlag{
+			Name:  "columns, c",
+			Usage: "For csv|json|ndjson, only include the comma-separated `COLUMNS`.\n\t\t" +
+			       "CSV columns are written in the order given; JSON keys stay sorted.",
+		},
+		&cli.BoolFlag{
+			Name:  "json-array-stream",
+			Usage: "For json, write each row as soon as it is read instead of\n\t\t" +
+			       "building the whole array in memory first. Use for very large tables.",
+		},
+		&cli.BoolFlag{
+			Name:  "gzip, z",
+			Usage: "Compress the output file with gzip, appending .gz to its name.\n\t\t" +
+			       "Requires --output; cannot be used when writing to the console.",
+		},
+		&cli.Int64Flag{
+			Name:  "thread",
+			Usage: "Only export the conversation with thread `ID`. For csv|json|ndjson the\n\t\t" +
+			       "table must have a thread_id column",
+		},
+		&cli.StringFlag{
+			Name:  "recipient",
+			Usage: "For xml or html, only export messages to, from or in the conversation\n\t\t" +
+			       "with `PHONE`; spaces and a leading + are ignored",
+		},
+		&cli.StringFlag{
+			Name:  "after",
+			Usage: "For xml or html, only export messages dated at or after `TIME`,\n\t\t" +
+			       "given as RFC 3339, YYYY-MM-DD or milliseconds since the Unix epoch",
+		},
+		&cli.StringFlag{
+			Name:  "before",
+			Usage: "For xml or html, only export messages dated before `TIME`, given as\n\t\t" +
+			       "RFC 3339, YYYY-MM-DD or milliseconds since the Unix epoch. Messages are dated\n\t\t" +
+			       "by when they were received, or for backups from 2022 or earlier sent",
+		},
+		&cli.BoolFlag{
+			Name:  "split-by-thread",
+			Usage: "For xml, html, csv, json or ndjson, treat --output as a directory\n\t\t" +
+			       "and write one file per conversation into it, named after the contact\n\t\t" +
+			       "or group, with _index.csv listing them. Requires --format",
 		},
 		&cli.BoolFlag{
 			Name:  "embed_attachments",
-			Usage: "For xml, embeds the entire attachment file in base64 encoding.\n\t\t" +
-			       "Default is to only include the file path of the attachment.",
+			Usage: "For xml or html, embeds the entire attachment file in base64 encoding.\n\t\t" +
+			       "Default is to only include the file path of the attachment.\n\t\t" +
+			       "Embedded images, audio and video play directly in the browser view.",
+		},
+		&cli.Int64Flag{
+			Name:  "embed-max-size",
+			Usage: "With --embed_attachments, files larger than `BYTES` are linked\n\t\t" +
+			       "by path instead of embedded (default 0, no limit)",
+		},
+		&cli.BoolFlag{
+			Name:  "only-archived",
+			Usage: "For xml, only export conversations that are archived",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-archived",
+			Usage: "For xml, only export conversations that are not archived",
+		},
+		&cli.StringFlag{
+			Name:  "timezone",
+			Usage: "Show readable dates in time zone `TZ`: 'local' (default), 'device'\n\t\t" +
+			       "for the phone's zone from the extracted settings, or a name like UTC",
+		},
+		&cli.StringFlag{
+			Name:  "extract-referenced",
+			Usage: "For xml or html, copy each attachment that is not embedded into `DIR`,\n\t\t" +
+			       "named <message id>_<seq>.<ext>, and point src at the copy",
+		},
+		&cli.StringFlag{
+			Name:  "avatars",
+			Usage: "For xml (2023 or later), show each sender's avatar from the extracted\n\t\t" +
+			       "Avatars folder `DIR` beside their messages, or their initials if none",
+		},
+		&cli.BoolFlag{
+			Name:  "android-names",
+			Usage: "For xml (2022 or earlier), name MMS parts that have no stored name\n\t\t" +
+			       "after their unique_id and content type, as Android does",
+		},
+		&cli.BoolFlag{
+			Name:  "filter-empty",
+			Usage: "For xml, skip messages with no body, attachments, edits or reactions",
+		},
+		&cli.StringFlag{
+			Name:  "normalize-newlines",
+			Usage: "Convert the line endings in message text to `STYLE`, 'lf' (\\n)\n\t\t" +
+			       "or 'crlf' (\\r\\n). For csv|json|ndjson this applies to every text value",
+		},
+		&cli.StringFlag{
+			Name:  "xml-encoding",
+			Usage: "For xml, write the file in `ENCODING` 'utf-8' (default) or 'utf-16',\n\t\t" +
+			       "for devices whose SMS Backup & Restore only imports UTF-16",
+		},
+		&cli.BoolFlag{
+			Name:  "numeric-dates",
+			Usage: "For xml, give every date only as epoch milliseconds, leaving out\n\t\t" +
+			       "readable_date (csv|json always give dates that way)",
+		},
+		&cli.BoolFlag{
+			Name:  "inline-attachments",
+			Usage: "For csv|json|ndjson of the message or mms table, add a marker such as\n\t\t" +
+			       "[image: photo.jpg] to the body for each of the message's attachments",
+		},
+		&cli.BoolFlag{
+			Name:  "receipts",
+			Usage: "For xml (2023 or later), add the delivered and read times of sent\n\t\t" +
+			       "messages for each recipient as <receipt> elements",
+		},
+		&cli.IntFlag{
+			Name:  "sample",
+			Usage: "For xml, export only `N` messages, picked to cover different kinds\n\t\t" +
+			       "(incoming, outgoing, group, with attachment, control), for bug reports",
+		},
+		&cli.BoolFlag{
+			Name:  "redact",
+			Usage: "For xml, replace message bodies with placeholder text of the same shape",
+		},
+		&cli.BoolFlag{
+			Name:  "no-bodies",
+			Usage: "Replace the text of every message with its length, such as\n\t\t" +
+			       "[42 characters], keeping dates, types, contacts and attachments",
 		},
 		&cli.BoolFlag{
 			Name:  "verbose, v",
 			Usage: "Enable verbose logging output",
 		},
+		&cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "Suppress all output except errors",
+		},
+		&cli.StringFlag{
+			Name:  "log-level",
+			Usage: "Write log lines of `LEVEL` and above: debug, info, warn or error\n\t\t" +
+			       "(default error; --verbose is the same as debug)",
+		},
+		&cli.BoolFlag{
+			Name:  "log-json",
+			Usage: "Write each log line as a JSON object",
+		},
 		// DEBUG FEATURES
 		&cli.IntFlag{
 			Name:  "limit",
@@ -71,15 +459,53 @@ var Format = cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) error {
-		opt := options{
+		opt := FormatOptions{
 			EmbedAttachments: c.Bool("embed_attachments"),
+			EmbedMaxSize: c.Int64("embed-max-size"),
+			OnlyArchived: c.Bool("only-archived"),
+			SkipArchived: c.Bool("skip-archived"),
+			FilterEmpty: c.Bool("filter-empty"),
+			AndroidNames: c.Bool("android-names"),
+			Sample: c.Int("sample"),
+			Redact: c.Bool("redact"),
+			NoBodies: c.Bool("no-bodies"),
+			Receipts: c.Bool("receipts"),
 			Limit: c.Int("limit"),
+			Avatars: c.String("avatars"),
+			Thread: c.Int64("thread"),
+			Recipient: normalizePhone(c.String("recipient")),
+		}
+		if opt.Thread < 0 {
+			return errors.Errorf("--thread id %d is not valid", opt.Thread)
+		}
+		if c.String("recipient") != "" && opt.Recipient == "" {
+			return errors.New("--recipient needs a phone number")
+		}
+		switch strings.ToLower(c.String("normalize-newlines")) {
+		case "":
+		case "lf":
+			opt.Newline = "\n"
+		case "crlf":
+			opt.Newline = "\r\n"
+		default:
+			return errors.Errorf("--normalize-newlines style '%s' not recognised", c.String("normalize-newlines"))
+		}
+		switch strings.ToLower(c.String("xml-encoding")) {
+		case "", "utf-8", "utf8":
+		case "utf-16", "utf16":
+			opt.XMLEncoding = "UTF-16"
+		default:
+			return errors.Errorf("--xml-encoding '%s' not recognised", c.String("xml-encoding"))
+		}
+		if opt.OnlyArchived && opt.SkipArchived {
+			return errors.New("--only-archived and --skip-archived cannot be used together")
+		}
+		if opt.Redact && opt.NoBodies {
+			return errors.New("--redact and --no-bodies cannot be used together")
 		}
 
-		if c.Bool("verbose") {
-			log.SetOutput(os.Stderr)
-		} else {
-			log.SetOutput(io.Discard)
+		if err := setupLogging(c); err != nil {
+			return err
 		}
 
 		var (
@@ -88,6 +514,15 @@ var Format = cli.Command{
 			err      error
 			out      io.Writer
 		)
+		if opt.After, err = parseTimeFlag("after", c.String("after")); err != nil {
+			return err
+		}
+		if opt.Before, err = parseTimeFlag("before", c.String("before")); err != nil {
+			return err
+		}
+		if opt.After != 0 && opt.Before != 0 && opt.Before <= opt.After {
+			return errors.New("--before must be later than --after")
+		}
 		if dbfile := c.Args().Get(0); dbfile == "" {
 			return errors.New("must specify a Signal database file")
 		} else if db, err = sql.Open("sqlite", dbfile); err != nil {
@@ -98,9 +533,66 @@ var Format = cli.Command{
 
 		pathAttachments := filepath.Join(pathBase, FolderAttachment)
 
+		if tz := c.String("timezone"); tz != "" {
+			loc, err := timeZone(tz, filepath.Join(pathBase, FolderSettings))
+			if err != nil {
+				return err
+			}
+			opt.Dates.Location = loc
+		}
+		opt.Dates.Numeric = c.Bool("numeric-dates")
+
 		output := c.String("output")
 		table := strings.ToLower(c.String("table"))
+
+		if dir := c.String("extract-referenced"); dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return errors.Wrap(err, "unable to create directory for attachments")
+			}
+			opt.ExtractReferenced = dir
+			opt.ReferenceRoot = filepath.Dir(output) // "." for the console
+		}
 		format := strings.ToLower(c.String("format"))
+		if c.Bool("schema") || c.Bool("schema-all") {
+			if format != "" && format != "sql" {
+				return errors.Errorf("--schema cannot be used with format '%s'", format)
+			}
+			format = "sql"
+		}
+
+		split := c.Bool("split-by-thread")
+		if split && opt.Thread != 0 {
+			return errors.New("--split-by-thread and --thread cannot be used together")
+		}
+		if split {
+			if output == "" {
+				return errors.New("--split-by-thread requires an --output directory")
+			}
+			if c.Bool("gzip") {
+				return errors.New("--split-by-thread and --gzip cannot be used together")
+			}
+			if format == "" {
+				return errors.New("--split-by-thread requires --format")
+			}
+			if table == "" {
+				table = "message"
+			}
+			opt.ReferenceRoot = output
+		}
+
+		if c.Bool("gzip") {
+			if output == "" {
+				return errors.New("--gzip requires an --output file")
+			}
+			if !strings.HasSuffix(output, ".gz") {
+				output += ".gz"
+			}
+		}
+
+		var (
+			gz   *gzip.Writer
+			file *os.File
+		)
 
 		if output == "" {
 			if format == "" {
@@ -109,9 +601,14 @@ var Format = cli.Command{
 				table = "message"
 			}
 			out = os.Stdout
-		} else {
-			ext := filepath.Ext(output)
-			base := filepath.Base(output)
+		} else if !split {
+			// detect format and table from the name inside the .gz wrapper
+			name := output
+			if c.Bool("gzip") {
+				name = strings.TrimSuffix(name, ".gz")
+			}
+			ext := filepath.Ext(name)
+			base := filepath.Base(name)
 
 			// remove extension from base
 			base = base[:len(base)-len(ext)]
@@ -123,46 +620,155 @@ var Format = cli.Command{
 				table = base
 			}
 
-			var file *os.File
-			file, err = os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-			out = io.Writer(file)
+			// Write to a temporary file and only replace the output once
+			// formatting succeeds, so a failed run keeps any previous export.
+			file, err = createTemp(output)
 			if err != nil {
 				return errors.Wrap(err, "unable to open output file")
 			}
+			out = io.Writer(file)
 			defer func() {
-				if file.Close() != nil {
-					log.Fatalf("unable to close output file: %s", err.Error())
+				if file != nil {
+					file.Close()
+					os.Remove(file.Name())
 				}
 			}()
+
+			if c.Bool("gzip") {
+				gz = gzip.NewWriter(file)
+				out = gz
+			}
+		}
+
+		if opt.Avatars != "" && strings.ToLower(format) != "xml" {
+			return errors.New("--avatars only applies to xml")
+		}
+		if opt.XMLEncoding != "" && strings.ToLower(format) != "xml" {
+			return errors.New("--xml-encoding only applies to xml")
+		}
+		if f := strings.ToLower(format); opt.Recipient != "" && f != "xml" && f != "html" {
+			return errors.New("--recipient only applies to xml or html")
+		}
+		if f := strings.ToLower(format); (opt.After != 0 || opt.Before != 0) && f != "xml" && f != "html" {
+			return errors.New("--after and --before only apply to xml or html")
 		}
 
-		switch strings.ToLower(format) {
-		case "json":
-			err = JSON(db, table, out, opt)
-		case "csv":
-			err = CSV(db, table, out, opt)
-		case "xml":
-			old, err := HasTable(db, "mms")
-			if err == nil {
+		if c.Bool("inline-attachments") {
+			if format = strings.ToLower(format); format != "csv" && format != "json" && format != "ndjson" {
+				return errors.New("--inline-attachments only applies to csv, json or ndjson")
+			}
+			if opt.markers, err = loadAttachmentMarkers(db, table); err != nil {
+				return err
+			}
+		}
+
+		format = strings.ToLower(format)
+		write := func(out io.Writer, opt FormatOptions) error {
+			switch format {
+			case "json":
+				source, err := tableColumnSource(db, table, c.String("columns"), opt.Thread)
+				if err != nil {
+					return err
+				}
+				if c.Bool("json-array-stream") {
+					return JSONStream(db, source, out, opt)
+				}
+				return JSON(db, source, out, opt)
+			case "ndjson":
+				source, err := tableColumnSource(db, table, c.String("columns"), opt.Thread)
+				if err != nil {
+					return err
+				}
+				return NDJSON(db, source, out, opt)
+			case "csv":
+				source, err := tableColumnSource(db, table, c.String("columns"), opt.Thread)
+				if err != nil {
+					return err
+				}
+				return CSV(db, source, out, opt)
+			case "sql":
+				return Schema(db, out, c.Bool("schema-all"))
+			case "xml":
+				// The legacy schema keeps multimedia messages in their own table
+				old, err := HasTable(db, "mms")
+				if err != nil {
+					return errors.Wrap(err, "failed to read database schema")
+				}
 				if old {
-					err = Synctech(db, pathAttachments, out, opt)
-				} else {
-					err = XML(db, pathAttachments, out, opt)
+					return Synctech(db, pathAttachments, out, opt)
 				}
+				return XML(db, pathAttachments, out, opt)
+			case "html":
+				return HTML(db, pathAttachments, out, opt)
+			case "vcf":
+				return VCard(db, out, opt)
 			}
+			return nil
+		}
+		switch format {
+		case "json", "ndjson", "csv", "sql", "xml", "html", "vcf":
 		default:
 			return errors.Errorf("format '%s' not recognised", format)
 		}
-		if err != nil {
+
+		if split {
+			return errors.Wrap(formatByThread(db, format, table, output, opt, write), "failed to format output")
+		}
+		if err = write(out, opt); err != nil {
 			return errors.Wrap(err, "failed to format output")
 		}
 
+		// gzip trailer must be flushed before the file is closed
+		if gz != nil {
+			if err = gz.Close(); err != nil {
+				return errors.Wrap(err, "unable to finish gzip output")
+			}
+		}
+
+		if file != nil {
+			if err = file.Close(); err != nil {
+				return errors.Wrap(err, "unable to close output file")
+			}
+			if err = os.Rename(file.Name(), output); err != nil {
+				return errors.Wrap(err, "unable to replace output file")
+			}
+			file = nil
+		}
+
 		return nil
 	},
 }
 
+// tableColumnSource is tableSource restricted to a comma-separated list of
+// columns, if one is given, and to the rows of one thread, if thread is set.
+func tableColumnSource(db *sql.DB, table string, columns string, thread int64) (string, error) {
+	source, err := tableSource(db, table)
+	if err != nil {
+		return "", err
+	}
+	if thread != 0 {
+		if err := requireThreadColumn(db, table, source); err != nil {
+			return "", err
+		}
+		source = fmt.Sprintf("(SELECT * FROM %s WHERE thread_id = %d)", source, thread)
+	}
+	if columns == "" {
+		return source, nil
+	}
+	var names []string
+	for _, name := range strings.Split(columns, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", errors.New("--columns lists no column names")
+	}
+	return projectColumns(db, table, source, names)
+}
+
 // JSON dumps an entire table into a JSON format.
-func JSON(db *sql.DB, table string, out io.Writer, opt options) error {
+func JSON(db *sql.DB, table string, out io.Writer, opt FormatOptions) error {
 	headers, rows, err := SelectEntireTable(db, table)
 	if err != nil {
 		return errors.Wrap(err, "selecting table")
@@ -175,6 +781,7 @@ func JSON(db *sql.DB, table string, out io.Writer, opt options) error {
 		if i == opt.Limit {
 			break
 		}
+		opt.prepareRow(headers, row)
 		values := make(map[string]interface{}, n)
 		for i, name := range headers {
 			values[name] = row[i]
@@ -192,8 +799,77 @@ func JSON(db *sql.DB, table string, out io.Writer, opt options) error {
 	return nil
 }
 
+// JSONStream dumps an entire table into the same JSON format as JSON, but
+// encodes each row as it is scanned so memory use is bounded by one row.
+func JSONStream(db *sql.DB, table string, out io.Writer, opt FormatOptions) error {
+	var buf bytes.Buffer
+	jsonEncoder := json.NewEncoder(&buf)
+	jsonEncoder.SetEscapeHTML(false)
+	jsonEncoder.SetIndent("\t", "\t")
+
+	w := types.NewMultiWriter(out)
+	w.W([]byte("["))
+
+	n := 0
+	err := ScanEntireTable(db, table, func(headers []string, row []interface{}) error {
+		if n == opt.Limit {
+			return ErrStopScan
+		}
+		opt.prepareRow(headers, row)
+		values := make(map[string]interface{}, len(headers))
+		for i, name := range headers {
+			values[name] = row[i]
+		}
+
+		buf.Reset()
+		if n > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n\t")
+		if err := jsonEncoder.Encode(values); err != nil {
+			return errors.Wrap(err, "json encode")
+		}
+		buf.Truncate(buf.Len() - 1) //trailing newline from Encode
+		w.W(buf.Bytes())
+		n++
+		return w.Error()
+	})
+	if err != nil {
+		return errors.Wrap(err, "selecting table")
+	}
+
+	if n > 0 {
+		w.W([]byte("\n"))
+	}
+	w.W([]byte("]\n"))
+	return errors.WithMessage(w.Error(), "failed to write out JSON")
+}
+
+// NDJSON dumps an entire table as newline-delimited JSON, one object per
+// row with the same keys as JSON. Rows are encoded as they are scanned, so
+// memory use is bounded by one row.
+func NDJSON(db *sql.DB, table string, out io.Writer, opt FormatOptions) error {
+	jsonEncoder := json.NewEncoder(out)
+	jsonEncoder.SetEscapeHTML(false)
+
+	n := 0
+	err := ScanEntireTable(db, table, func(headers []string, row []interface{}) error {
+		if n == opt.Limit {
+			return ErrStopScan
+		}
+		opt.prepareRow(headers, row)
+		values := make(map[string]interface{}, len(headers))
+		for i, name := range headers {
+			values[name] = row[i]
+		}
+		n++
+		return errors.Wrap(jsonEncoder.Encode(values), "json encode")
+	})
+	return errors.Wrap(err, "selecting table")
+}
+
 // CSV dumps an entire table into a comma-separated value format.
-func CSV(db *sql.DB, table string, out io.Writer, opt options) error {
+func CSV(db *sql.DB, table string, out io.Writer, opt FormatOptions) error {
 	headers, rowsI, err := SelectEntireTable(db, table)
 	if err != nil {
 		return errors.Wrap(err, "selecting table")
@@ -204,6 +880,10 @@ func CSV(db *sql.DB, table string, out io.Writer, opt options) error {
 		return errors.Wrap(err, "unable to write CSV headers")
 	}
 
+	for _, row := range rowsI {
+		opt.prepareRow(headers, row)
+	}
+	// Values with line breaks, including a lone \r, are quoted by csv.Writer
 	rows := StringifyRows(rowsI, opt.Limit)
 	if err := w.WriteAll(rows); err != nil {
 		return errors.Wrap(err, "unable to format CSV")
@@ -219,133 +899,71 @@ func CSV(db *sql.DB, table string, out io.Writer, opt options) error {
 }
 
 // XML puts the messages into a format viewable with a browser.
-func XML(db *sql.DB, pathAttachments string, out io.Writer, opt options) error {
-	var (
-		correspondents = make(map[int64]message.DbCorrespondent)
-		threads        = make(map[int64]message.DbThread)
-		groups         = make(map[int64]message.DbGroup)
-		msgAttachments = make(map[int64][]*message.DbAttachment) //key: message id
-		msgs           = message.Messages{}
-	)
-
-	rows, err := SelectStructFromTable(db, message.DbCorrespondent{}, "recipient")
+func XML(db *sql.DB, pathAttachments string, out io.Writer, opt FormatOptions) error {
+	m, err := loadExportMessages(db, pathAttachments, opt)
 	if err != nil {
-		return errors.Wrap(err, "xml select recipient")
+		return err
 	}
-	for _, row := range rows {
-		r := row.(*message.DbCorrespondent)
-		correspondents[r.ID] = *r
+	msgs := message.Messages{Count: len(m), Messages: m}
+	if opt.Avatars != "" {
+		if msgs.Avatars, err = addAvatars(db, opt.Avatars, m); err != nil {
+			return err
+		}
 	}
 
-	rows, err = SelectStructFromTable(db, message.DbThread{}, "thread")
+	x, err := xml.MarshalIndent(msgs, "", "  ")
 	if err != nil {
-		return errors.Wrap(err, "xml select thread")
-	}
-	for _, row := range rows {
-		r := row.(*message.DbThread)
-		threads[r.ID] = *r
+		return errors.Wrap(err, "unable to format XML")
 	}
 
-	rows, err = SelectStructFromTable(db, message.DbGroup{}, "groups")
-	if err != nil {
-		return errors.Wrap(err, "xml select groups")
-	}
-	for _, row := range rows {
-		r := row.(*message.DbGroup)
-		groups[r.RecipientId] = *r
-	}
+	return writeXML(out, opt, "messages.xsl", x)
+}
 
-	rows, err = SelectStructFromTable(db, message.DbMessage{}, "message")
+// loadExportMessages loads the messages and applies the sampling and text
+// options that the XML and HTML formats share.
+func loadExportMessages(db *sql.DB, pathAttachments string, opt FormatOptions) ([]message.Message, error) {
+	m, err := LoadMessages(db, pathAttachments, opt)
 	if err != nil {
-		return errors.Wrap(err, "xml select message")
+		return nil, err
 	}
-	for i, row := range rows {
-		if i == opt.Limit {
-			break
-		}
-		msg := row.(*message.DbMessage)
-		xml := message.NewMessage(*msg)
-		message.SetMessageContact(msg, &xml, correspondents, threads, groups)
-		msgs.Messages = append(msgs.Messages, xml)
+	if opt.Sample > 0 {
+		m = sampleMessages(m, opt.Sample)
 	}
-
-	rows, err = SelectStructFromTable(db, message.DbAttachment{}, "attachment")
-	if err != nil {
-		return errors.Wrap(err, "xml select attachment")
+	if opt.Redact {
+		mapMessageText(m, redactText)
 	}
-	for _, row := range rows {
-		r := row.(*message.DbAttachment)
-		mid := r.MessageId
-		msgAttachments[mid] = append(msgAttachments[mid], r)
+	if opt.NoBodies {
+		mapMessageText(m, textLength)
 	}
+	if opt.Newline != "" {
+		mapMessageText(m, opt.normalizeNewlines)
+	}
+	return m, nil
+}
 
-	for i, msg := range msgs.Messages {
-		var messageSize uint64
-		id := msg.MessageId
-		if attachments, ok := msgAttachments[id]; ok {
-			for _, attachment := range attachments {
-				xml := message.NewAttachment(*attachment)
-
-				stem := fmt.Sprintf("%06d", attachment.ID)
-				prefix := filepath.Join(pathAttachments, stem)
-				size, result, err := getAttachmentData(prefix, opt.EmbedAttachments)
-				if err != nil {
-					return err
-				}
-
-				if size == 0 {
-					msg := fmt.Sprintf("missing file '%v/%v'", pathAttachments, prefix)
-					if xml.ContentType == "application/x-signal-view-once" {
-						msg += ", it was marked 'View Once'"
-					} else if attachment.TransferState > 0 {
-						msg += fmt.Sprintf(", transfer state incomplete (%v)", attachment.TransferState)
-					}
-					log.Print(msg)
-				} else if size != attachment.DataSize {
-					log.Printf("attachment (id %v) file size (%v) mismatches declared size (%v)", prefix, size, attachment.DataSize)
-				}
-				messageSize += size
-
-				if opt.EmbedAttachments {
-					xml.Data = result
-				} else {
-					xml.Src = result
-				}
-				msg.AttachmentList.Attachments = append(msg.AttachmentList.Attachments, xml)
-			}
-		}
-
-		sizeString := strconv.FormatUint(messageSize, 10)
-		if msg.MSize != "null" && msg.MSize != sizeString {
-			log.Printf("MessageID %v declared size %v != calculated size %v\n", id, msg.MSize, sizeString)
-		}
-		msg.MSize = sizeString
-
-		msgs.Messages[i] = msg
+// writeXML writes an XML document, declared and encoded as opt.XMLEncoding
+// (UTF-8 by default), that refers to the XSL file stylesheet.
+func writeXML(out io.Writer, opt FormatOptions, stylesheet string, x []byte) error {
+	encoding := "UTF-8"
+	if opt.XMLEncoding != "" {
+		encoding = opt.XMLEncoding
 	}
+	var doc bytes.Buffer
+	doc.WriteString("<?xml version='1.0' encoding='" + encoding + "' standalone='yes' ?>\n")
+	doc.WriteString("<?xml-stylesheet type=\"text/xsl\" href=\"" + stylesheet + "\" ?>\n")
+	doc.Write(x)
 
-	m := msgs.Messages
-	msgs.Count = len(m)
-	slices.SortStableFunc(m, func(a, b message.Message) int {
-		c := cmp.Compare(a.GroupDate, b.GroupDate)
-		if c == 0 {
-			c = cmp.Compare(stringPtr(a.GroupName), stringPtr(b.GroupName))
-			if c == 0 {
-				c = cmp.Compare(a.DateSent, b.DateSent)
-			}
+	data := doc.Bytes()
+	if encoding == "UTF-16" {
+		// Little-endian with a byte order mark, as Android itself writes UTF-16
+		var err error
+		if data, err = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes(data); err != nil {
+			return errors.Wrap(err, "unable to encode XML as UTF-16")
 		}
-		return c
-	})
-
-	x, err := xml.MarshalIndent(msgs, "", "  ")
-	if err != nil {
-		return errors.Wrap(err, "unable to format XML")
 	}
 
 	w := types.NewMultiWriter(out)
-	w.W([]byte("<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>\n"))
-	w.W([]byte("<?xml-stylesheet type=\"text/xsl\" href=\"messages.xsl\" ?>\n"))
-	w.W(x)
+	w.W(data)
 	return errors.WithMessage(w.Error(), "failed to write out XML")
 }
 
@@ -360,52 +978,119 @@ func stringPtr(s *string) string {
 // Synctech() formats the backup into an XML format compatible with
 // SMS Backup & Restore by SyncTech. Layout described at their website
 // https://www.synctech.com.au/sms-backup-restore/fields-in-xml-backup-files/
-func Synctech(db *sql.DB, pathAttachments string, out io.Writer, opt options) error {
+func Synctech(db *sql.DB, pathAttachments string, out io.Writer, opt FormatOptions) error {
+	if opt.Avatars != "" {
+		return errors.New("--avatars needs a database from 2023 or later")
+	}
+	smses, err := loadSynctech(db, pathAttachments, opt)
+	if err != nil {
+		return err
+	}
+	x, err := xml.MarshalIndent(smses, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to format XML")
+	}
+
+	return writeXML(out, opt, "sms.xsl", x)
+}
+
+// loadSynctech reads the SMS and MMS records of a database from before 2023,
+// with their parts, and applies the sampling and text options, as
+// loadExportMessages does for later databases.
+func loadSynctech(db *sql.DB, pathAttachments string, opt FormatOptions) (*message.SMSes, error) {
 	recipients := map[int64]message.DbRecipient{}
+	archived := map[int64]bool{} //key: thread id
 	smses := &message.SMSes{}
 	mmses := []message.MMS{}
 	mmsParts := map[int64][]message.MMSPart{} //key: message id
+	msgBox := map[int64]int64{} //key: message id
+	dropped := 0
 
 	rows, err := SelectStructFromTable(db, message.DbRecipient{}, "recipient")
 	if err != nil {
-		return errors.Wrap(err, "xml select recipient")
+		return nil, errors.Wrap(err, "xml select recipient")
 	}
 	for _, row := range rows {
 		r := row.(*message.DbRecipient)
 		recipients[r.ID] = *r
 	}
 
+	if opt.OnlyArchived || opt.SkipArchived {
+		threads, err := loadThreads(db)
+		if err != nil {
+			return nil, errors.Wrap(err, "xml select thread")
+		}
+		for id, t := range threads {
+			archived[id] = t.Archived != 0
+		}
+	}
+
 	rows, err = SelectStructFromTable(db, message.DbSMS{}, "sms")
 	if err != nil {
-		return errors.Wrap(err, "xml select sms")
+		return nil, errors.Wrap(err, "xml select sms")
 	}
 	for i, row := range rows {
 		if i == opt.Limit {
 			break
 		}
 		sms := row.(*message.DbSMS)
+		if opt.skipThread(sms.ThreadId, archived[sms.ThreadId]) {
+			continue
+		}
+		if opt.FilterEmpty && (!sms.Body.Valid || sms.Body.String == "") {
+			dropped++
+			continue
+		}
+		if opt.skipDate(sms.DateSent) {
+			continue
+		}
 		rcp := recipients[sms.Address]
-		xml := message.NewSMS(*sms, rcp)
+		if opt.skipRecipient(rcp.Phone) {
+			continue
+		}
+		xml, err := message.NewSMS(*sms, rcp, opt.Dates)
+		if err != nil {
+			// Exported regardless, as type 0, rather than losing the message
+			logging.Warnf("%v", err)
+		}
 		smses.SMS = append(smses.SMS, xml)
 	}
+	if dropped > 0 {
+		logging.Infof("dropped %d empty messages", dropped)
+	}
 
 	rows, err = SelectStructFromTable(db, message.DbMMS{}, "mms")
 	if err != nil {
-		return errors.Wrap(err, "xml select mms")
+		return nil, errors.Wrap(err, "xml select mms")
 	}
+	unknownTypes := make(map[uint64]bool) // warned about once each
 	for i, row := range rows {
 		if i == opt.Limit {
 			break
 		}
 		mms := row.(*message.DbMMS)
+		if opt.skipThread(mms.ThreadId, archived[mms.ThreadId]) {
+			continue
+		}
+		if opt.skipDate(mms.Date) { // sent, as for SMS
+			continue
+		}
 		rcp := recipients[mms.Address]
-		xml := message.NewMMS(*mms, rcp)
+		if opt.skipRecipient(rcp.Phone) {
+			continue
+		}
+		xml, err := message.NewMMS(*mms, rcp, opt.Dates)
+		if err != nil && !unknownTypes[mms.MType] {
+			unknownTypes[mms.MType] = true
+			logging.Warnf("MMS message type %d is not supported; such messages are written as sent or received by their message box", mms.MType)
+		}
 		mmses = append(mmses, xml)
+		msgBox[mms.ID] = mms.MsgBox
 	}
 
 	rows, err = SelectStructFromTable(db, message.DbPart{}, "part")
 	if err != nil {
-		return errors.Wrap(err, "xml select part")
+		return nil, errors.Wrap(err, "xml select part")
 	}
 	for _, row := range rows {
 		r := row.(*message.DbPart)
@@ -421,9 +1106,9 @@ func Synctech(db *sql.DB, pathAttachments string, out io.Writer, opt options) er
 			for i, part := range parts {
 				stem := fmt.Sprintf("%v", part.UniqueId)
 				prefix := filepath.Join(pathAttachments, stem)
-				size, result, err := getAttachmentData(prefix, opt.EmbedAttachments)
+				size, result, embedded, err := getAttachmentData(prefix, opt.EmbedAttachments, opt.EmbedMaxSize)
 				if err != nil {
-					return err
+					return nil, err
 				}
 
 				if size == 0 {
@@ -431,21 +1116,33 @@ func Synctech(db *sql.DB, pathAttachments string, out io.Writer, opt options) er
 					if part.PendingPush > 0 {
 						msg += fmt.Sprintf(", pending push incomplete (%v)", part.PendingPush)
 					}
-					log.Print(msg)
+					logging.Warnf("%s", msg)
 				} else if size != part.DataSize {
-					log.Printf("attachment (id %v) file size (%v) mismatches declared size (%v)", prefix, size, part.DataSize)
+					logging.Warnf("attachment (id %v) file size (%v) mismatches declared size (%v)", prefix, size, part.DataSize)
 				}
 				messageSize += size
 				
-				if opt.EmbedAttachments {
+				if embedded {
 					parts[i].Data = result
+				} else if size > 0 && opt.ExtractReferenced != "" {
+					if parts[i].Src, err = copyReferenced(*result, fmt.Sprintf("%d_%d", id, i), opt); err != nil {
+						return nil, err
+					}
 				} else {
 					parts[i].Src = result
 				}
+				if opt.AndroidNames {
+					setAndroidPartName(&parts[i], stem)
+				}
 			}
 		}
 		if mms.Body != nil && len(*mms.Body) > 0 {
-			parts = append(parts, message.NewPartText(mms))
+			text := message.NewPartText(mms)
+			if opt.AndroidNames {
+				text.Cl = "" // replace the numeric txt%06d.txt name
+				setAndroidPartName(&text, fmt.Sprintf("text_%d", len(parts)))
+			}
+			parts = append(parts, text)
 			messageSize += uint64(len(*mms.Body))
 			if len(parts) == 1 {
 				mms.TextOnly = 1
@@ -458,61 +1155,186 @@ func Synctech(db *sql.DB, pathAttachments string, out io.Writer, opt options) er
 
 		sizeString := strconv.FormatUint(messageSize, 10)
 		if mms.MSize != "null" && mms.MSize != sizeString {
-			log.Printf("MessageID %v declared size %v != calculated size %v\n", id, mms.MSize, sizeString)
+			logging.Warnf("MessageID %v declared size %v != calculated size %v\n", id, mms.MSize, sizeString)
 		}
 		mms.MSize = sizeString
 
 		if mms.MType == nil {
-			if message.SetMMSMessageType(message.MMSSendReq, &mms) != nil {
-				panic("logic error: this should never happen")
-			}
-			smses.MMS = append(smses.MMS, mms)
-			if message.SetMMSMessageType(message.MMSRetrieveConf, &mms) != nil {
-				panic("logic error: this should never happen")
+			// Without a message type of its own, the record's direction is
+			// taken from the message box. Only if that is unknown too is it
+			// written both ways, as sent and as received.
+			if mtype, ok := message.MMSTypeForBox(msgBox[id]); ok {
+				if message.SetMMSMessageType(mtype, &mms) != nil {
+					panic("logic error: this should never happen")
+				}
+			} else {
+				if message.SetMMSMessageType(message.MMSSendReq, &mms) != nil {
+					panic("logic error: this should never happen")
+				}
+				smses.MMS = append(smses.MMS, mms)
+				if message.SetMMSMessageType(message.MMSRetrieveConf, &mms) != nil {
+					panic("logic error: this should never happen")
+				}
 			}
 		}
 		smses.MMS = append(smses.MMS, mms)
 	}
 
-	smses.Count = len(smses.SMS)
-	x, err := xml.MarshalIndent(smses, "", "  ")
+	if opt.Sample > 0 {
+		sampleSynctech(smses, opt.Sample)
+	}
+	if opt.Redact {
+		mapSynctechText(smses, redactText)
+	}
+	if opt.NoBodies {
+		mapSynctechText(smses, textLength)
+	}
+	if opt.Newline != "" {
+		mapSynctechText(smses, opt.normalizeNewlines)
+	}
+
+	// SMS Backup & Restore counts every message, SMS and MMS alike
+	smses.Count = len(smses.SMS) + len(smses.MMS)
+	return smses, nil
+}
+
+// setAndroidPartName fills in the name, file name, content id and content
+// location of an MMS part the way the Android MMS provider names them:
+// stem plus the extension of the content type (e.g. 1600000000.jpg, <1600000000>).
+// Values that were stored in the database are kept.
+func setAndroidPartName(part *message.MMSPart, stem string) {
+	name := stem
+	if part.Ct == "text/plain" {
+		name += ".txt"
+	} else if ext, ok := GetExtension(part.Ct); ok {
+		name += "." + ext
+	}
+	unset := func(s string) bool {
+		return s == "" || s == "null"
+	}
+	if unset(part.Name) {
+		part.Name = name
+	}
+	if unset(part.Fn) {
+		part.Fn = name
+	}
+	if unset(part.Cl) {
+		part.Cl = name
+	}
+	if unset(part.CID) {
+		part.CID = "<" + stem + ">"
+	}
+}
+
+// timeZone resolves the --timezone option. The device time zone is looked for
+// in the extracted settings; it falls back to UTC if none is found.
+func timeZone(name string, pathSettings string) (*time.Location, error) {
+	switch strings.ToLower(name) {
+	case "local":
+		return time.Local, nil
+	case "device":
+		if loc := deviceTimeZone(pathSettings); loc != nil {
+			return loc, nil
+		}
+		logging.Infof("no device time zone found in settings, using UTC")
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
 	if err != nil {
-		return errors.Wrap(err, "unable to format XML")
+		return nil, errors.Wrap(err, "unknown time zone")
 	}
+	return loc, nil
+}
 
-	w := types.NewMultiWriter(out)
-	w.W([]byte("<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>\n"))
-	w.W([]byte("<?xml-stylesheet type=\"text/xsl\" href=\"sms.xsl\" ?>\n"))
-	w.W(x)
-	return errors.WithMessage(w.Error(), "failed to write out XML")
+// deviceTimeZone searches the settings files for a value that names a time
+// zone, under a key that mentions one. Signal has no single key for this.
+func deviceTimeZone(pathSettings string) *time.Location {
+	files, _ := filepath.Glob(filepath.Join(pathSettings, "*.json"))
+	for _, file := range files {
+		var settings map[string]interface{}
+		data, err := os.ReadFile(file)
+		if err != nil || json.Unmarshal(data, &settings) != nil {
+			continue
+		}
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			k := strings.ToLower(key)
+			if !strings.Contains(k, "timezone") && !strings.Contains(k, "time_zone") && !strings.HasSuffix(k, ".tz") {
+				continue
+			}
+			if s, ok := settings[key].(string); ok && s != "" && s != "Local" {
+				if loc, err := time.LoadLocation(s); err == nil {
+					logging.Infof("using device time zone %s from %s", s, key)
+					return loc
+				}
+			}
+		}
+	}
+	return nil
 }
 
-func getAttachmentData(prefix string, embed bool) (uint64, *string, error) {
+// getAttachmentData returns the size of the attachment file matching prefix,
+// along with either its base64 contents or its path. The result is embedded
+// only if embed is set and the file is no larger than maxSize (0 means any size).
+func getAttachmentData(prefix string, embed bool, maxSize int64) (uint64, *string, bool, error) {
 	if path, err := findAttachment(prefix); err != nil {
 		if err != os.ErrNotExist {
-			return 0, nil, errors.Wrap(err, "find attachment")
+			return 0, nil, false, errors.Wrap(err, "find attachment")
 		} else {
-			return 0, &prefix, nil
+			return 0, &prefix, false, nil
 		}
-	} else if embed {
+	} else if path, err = resolveDuplicate(path); err != nil {
+		return 0, nil, false, errors.Wrap(err, "find attachment")
+	} else if info, err := os.Stat(path); err != nil {
+		return 0, nil, false, errors.Wrap(err, "attachment size")
+	} else if embed && (maxSize <= 0 || info.Size() <= maxSize) {
 		if size, data, err := readFileAsBase64(path); err != nil {
-			return 0, nil, errors.Wrap(err, "read attachment")
+			return 0, nil, false, errors.Wrap(err, "read attachment")
 		} else {
-			return size, &data, nil
+			return size, &data, true, nil
 		}
 	} else {
-		if info, err := os.Stat(path); err != nil {
-			return 0, nil, errors.Wrap(err, "attachment size")
-		} else {
-			size := uint64(info.Size())
-			return size, &path, nil
-		}
+		size := uint64(info.Size())
+		return size, &path, false, nil
 	}
 }
 
+// copyReferenced copies an attachment file into opt.ExtractReferenced under
+// the name stem, keeping its extension, and returns the path of the copy.
+func copyReferenced(pathName string, stem string, opt FormatOptions) (*string, error) {
+	dest := filepath.Join(opt.ExtractReferenced, stem + filepath.Ext(pathName))
+	_, err := readFile(pathName, func(r io.Reader) (int64, error) {
+		var n int64
+		err := writeFile(dest, func(w io.Writer) (err error) {
+			n, err = io.Copy(w, r)
+			return err
+		})
+		return n, err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "copy attachment")
+	}
+	rel, err := filepath.Rel(opt.ReferenceRoot, dest)
+	if err != nil {
+		rel = dest
+	}
+	rel = filepath.ToSlash(rel)
+	return &rel, nil
+}
+
 func findAttachment(prefix string) (string, error) {
 	if matches, err := filepath.Glob(prefix + "*"); err != nil {
 		return "", err
+	} else if len(matches) > 0 {
+		return matches[0], nil
+	}
+	// Extracted with --by-thread, in a folder per thread
+	if matches, err := filepath.Glob(filepath.Join(filepath.Dir(prefix), "*", filepath.Base(prefix)) + "*"); err != nil {
+		return "", err
 	} else if len(matches) == 0 {
 		return "", os.ErrNotExist
 	} else {
@@ -523,7 +1345,6 @@ func findAttachment(prefix string) (string, error) {
 func readFileAsBase64(pathName string) (uint64, string, error) {
 	var buffer bytes.Buffer
 	encoder := base64.NewEncoder(base64.StdEncoding, &buffer)
-	defer encoder.Close()
 
 	copier := func(file io.Reader) (int64, error) {
 		return io.Copy(encoder, file)
@@ -532,6 +1353,10 @@ func readFileAsBase64(pathName string) (uint64, string, error) {
 	if err != nil {
 		return 0, "", err
 	}
+	// The last partial group of bytes is only written on Close
+	if err := encoder.Close(); err != nil {
+		return 0, "", err
+	}
 	return uint64(n), buffer.String(), nil
 }
 
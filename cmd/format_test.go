@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/backuptest"
+)
+
+// hostile is a message body that breaks any format written without escaping.
+const hostile = "<script>alert(\"x\")</script> it's a & b\x00end"
+
+// hostileDB extracts the unified test backup and gives its first message the
+// hostile body. The names of its recipients are already hostile.
+func hostileDB(t *testing.T) (*sql.DB, string) {
+	return hostileEra(t, backuptest.Unified(backuptest.WithKDFRounds(1)), "message")
+}
+
+// hostileLegacyDB is hostileDB for the legacy test backup, whose first SMS is
+// given the hostile body.
+func hostileLegacyDB(t *testing.T) (*sql.DB, string) {
+	return hostileEra(t, backuptest.Legacy(backuptest.WithKDFRounds(1)), "sms")
+}
+
+func hostileEra(t *testing.T, b *backuptest.Builder, table string) (*sql.DB, string) {
+	out := extractBackup(t, b)
+	db, err := sql.Open("sqlite", filepath.Join(out, filenameDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("UPDATE "+table+" SET body = ? WHERE _id = 1", hostile); err != nil {
+		t.Fatal(err)
+	}
+	return db, filepath.Join(out, FolderAttachment)
+}
+
+// checkEscapedXML checks that an XML document is well-formed, with the hostile
+// body and name as text and not as markup.
+func checkEscapedXML(t *testing.T, doc []byte) {
+	t.Helper()
+	var bodies, names []string
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("XML is not well-formed: %v", err)
+		}
+		if e, ok := tok.(xml.StartElement); ok {
+			if e.Name.Local == "script" {
+				t.Fatal("body became a script element")
+			}
+			for _, a := range e.Attr {
+				switch a.Name.Local {
+				case "body":
+					bodies = append(bodies, a.Value)
+				case "contact_name":
+					names = append(names, a.Value)
+				}
+			}
+		}
+	}
+	// XML 1.0 cannot carry a NUL, even escaped
+	want := strings.ReplaceAll(hostile, "\x00", "\uFFFD")
+	if !contains(bodies, want) {
+		t.Errorf("bodies = %q, want one of %q", bodies, want)
+	}
+	if !contains(names, "Alice <A&B>") {
+		t.Errorf("contact names = %q, want Alice <A&B>", names)
+	}
+}
+
+func TestEscapeXML(t *testing.T) {
+	db, attachments := hostileDB(t)
+	var out bytes.Buffer
+	if err := XML(db, attachments, &out, FormatOptions{Limit: -1}); err != nil {
+		t.Fatal(err)
+	}
+	checkEscapedXML(t, out.Bytes())
+}
+
+func TestEscapeSynctech(t *testing.T) {
+	db, attachments := hostileLegacyDB(t)
+	var out bytes.Buffer
+	if err := Synctech(db, attachments, &out, FormatOptions{Limit: -1}); err != nil {
+		t.Fatal(err)
+	}
+	checkEscapedXML(t, out.Bytes())
+}
+
+func TestEscapeJSON(t *testing.T) {
+	db, _ := hostileDB(t)
+	formats := map[string]func(*sql.DB, string, io.Writer, FormatOptions) error{
+		"json": JSON, "json stream": JSONStream, "ndjson": NDJSON,
+	}
+	for name, format := range formats {
+		var out bytes.Buffer
+		if err := format(db, "message", &out, FormatOptions{Limit: -1}); err != nil {
+			t.Fatal(err)
+		}
+		// A JSON array, or one object to a line
+		var rows []map[string]interface{}
+		if name == "ndjson" {
+			for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+				var row map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &row); err != nil {
+					t.Fatalf("%s: line %q is not JSON: %v", name, line, err)
+				}
+				rows = append(rows, row)
+			}
+		} else if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+			t.Fatalf("%s is not valid JSON: %v", name, err)
+		}
+		// JSON can carry any character, so the body reads back exactly, NUL included
+		var bodies []string
+		for _, row := range rows {
+			if body, ok := row["body"].(string); ok {
+				bodies = append(bodies, body)
+			}
+		}
+		if !contains(bodies, hostile) {
+			t.Errorf("%s: bodies = %q, want one of %q", name, bodies, hostile)
+		}
+	}
+}
+
+func TestEscapeVCard(t *testing.T) {
+	db, _ := hostileDB(t)
+	const name = "Alice, \"A\"; a\\b\r\nBEGIN:VCARD"
+	if _, err := db.Exec("UPDATE recipient SET system_joined_name = ? WHERE _id = 1", name); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := VCard(db, &out, FormatOptions{Limit: -1}); err != nil {
+		t.Fatal(err)
+	}
+	// Unfolded, each content line is one property
+	lines := strings.Split(strings.ReplaceAll(out.String(), "\r\n ", ""), "\r\n")
+	n := 0
+	for _, line := range lines {
+		if line == "BEGIN:VCARD" {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("%d cards, want 2", n)
+	}
+	if want := `FN:Alice\, "A"\; a\\b\nBEGIN:VCARD`; !contains(lines, want) {
+		t.Errorf("lines = %q, want one of %q", lines, want)
+	}
+}
+
+func TestEscapeHTML(t *testing.T) {
+	db, attachments := hostileDB(t)
+	var out bytes.Buffer
+	if err := HTML(db, attachments, &out, FormatOptions{Limit: -1}); err != nil {
+		t.Fatal(err)
+	}
+	s := out.String()
+	for _, raw := range []string{"<script>", "<A&B>", "\x00"} {
+		if strings.Contains(s, raw) {
+			t.Errorf("HTML contains %q unescaped", raw)
+		}
+	}
+	for _, escaped := range []string{"&lt;script&gt;", "&lt;A&amp;B&gt;", "a &amp; b"} {
+		if !strings.Contains(s, escaped) {
+			t.Errorf("HTML does not contain %q", escaped)
+		}
+	}
+}
+
+func TestEscapeCSV(t *testing.T) {
+	db, _ := hostileDB(t)
+	var out bytes.Buffer
+	if err := CSV(db, "message", &out, FormatOptions{Limit: -1}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := -1
+	for i, h := range records[0] {
+		if h == "body" {
+			body = i
+		}
+	}
+	if body < 0 || len(records) < 2 {
+		t.Fatalf("no body column or no rows in %q", records)
+	}
+	// CSV can carry any byte, so the body reads back exactly, NUL included
+	if got := records[1][body]; got != hostile {
+		t.Errorf("body = %q, want %q", got, hostile)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	const mixed = "dos\r\nunix\nmac\rend\r\n\r\n"
+	tests := []struct {
+		newline string
+		want    string
+	}{
+		{"\n", "dos\nunix\nmac\nend\n\n"},
+		{"\r\n", "dos\r\nunix\r\nmac\r\nend\r\n\r\n"},
+		{"\r", "dos\runix\rmac\rend\r\r"},
+	}
+	for _, tt := range tests {
+		opt := FormatOptions{Newline: tt.newline}
+		if got := opt.normalizeNewlines(mixed); got != tt.want {
+			t.Errorf("normalizeNewlines(%q) to %q = %q, want %q", mixed, tt.newline, got, tt.want)
+		}
+		if got := opt.normalizeNewlines("no breaks"); got != "no breaks" {
+			t.Errorf("normalizeNewlines(%q) to %q = %q", "no breaks", tt.newline, got)
+		}
+	}
+}
+
+// TestFormatDatesPerRun formats one database several times in one process, as
+// the date options must not carry over from one run to the next.
+func TestFormatDatesPerRun(t *testing.T) {
+	out := extractBackup(t, backuptest.Unified(backuptest.WithKDFRounds(1)))
+	app := cli.NewApp()
+	app.Commands = []cli.Command{Format}
+
+	// A local zone other than UTC, so that a --timezone left over shows
+	local := time.Local
+	time.Local = time.FixedZone("UTC-4", -4*60*60)
+	defer func() { time.Local = local }()
+
+	runs := []struct {
+		args []string
+		want string // in the readable_date of message 1, or "" for none
+	}{
+		{[]string{"--timezone", "UTC"}, "Sep 13, 2020 12:26:40 PM"},
+		{nil, "Sep 13, 2020 8:26:40 AM"},
+		{[]string{"--numeric-dates"}, ""},
+		{nil, "Sep 13, 2020 8:26:40 AM"},
+	}
+	for _, r := range runs {
+		xmlPath := filepath.Join(t.TempDir(), "messages.xml")
+		args := append([]string{"signal-back", "format", "-q", "-o", xmlPath}, r.args...)
+		if err := app.Run(append(args, filepath.Join(out, filenameDB))); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(xmlPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if i := bytes.Index(data, []byte(`readable_date="`)); i >= 0 {
+			got = string(data[i+15 : i+15+bytes.IndexByte(data[i+15:], '"')])
+		}
+		if got != r.want {
+			t.Errorf("with %q: readable_date = %q, want %q", r.args, got, r.want)
+		}
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/types/message"
+)
+
+// htmlThread is one conversation of the HTML export, in order of its first
+// message.
+type htmlThread struct {
+	ID       int64
+	Name     string
+	Messages []htmlMessage
+}
+
+type htmlMessage struct {
+	message.Message
+	Date     string
+	Sender   string
+	Outgoing bool
+	Media    []htmlMedia
+}
+
+// htmlMedia is an attachment, shown by the element named in Tag, or linked to
+// if Tag is empty. Src is empty if there is neither a file nor data.
+type htmlMedia struct {
+	Tag  string
+	Src  template.URL
+	Name string
+}
+
+// Labels of the special kinds of message, as in messages.xsl.
+var htmlSpecial = map[string]string{
+	"story":             "Story",
+	"story_reply":       "Reply to a story",
+	"story_reaction":    "Reaction to a story",
+	"gift_badge":        "Gift badge",
+	"payment":           "Payment",
+	"payment_request":   "Request to activate payments",
+	"payment_activated": "Payments activated",
+}
+
+var htmlTemplate = template.Must(template.New("html").Funcs(template.FuncMap{
+	"date": func(readable *string, ms uint64) string {
+		if readable != nil {
+			return *readable
+		}
+		return fmt.Sprint(ms)
+	},
+	"special": func(kind string) string {
+		if label, ok := htmlSpecial[kind]; ok {
+			return label
+		}
+		return "Special message"
+	},
+	"text": stringPtr,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Messages</title>
+<style>
+body { font-family: arial, sans-serif; font-size: 13px; color: #333; }
+table { font-size: 1em; margin: 0 0 1em; border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 6px 12px; text-align: left; vertical-align: top; }
+th { background-color: #dee8f1; }
+.date { min-width: 160px; }
+.sent { background-color: #f3f7fb; }
+.body { white-space: pre-wrap; max-width: 680px; }
+.edit { color: #888; font-size: 0.9em; }
+img, video { max-height: 300px; max-width: 680px; }
+</style>
+</head>
+<body>
+<h1>Messages</h1>
+<ul>
+{{- range .}}
+<li><a href="#thread-{{.ID}}">{{.Name}}</a> ({{len .Messages}})</li>
+{{- end}}
+</ul>
+{{- range .}}
+<h2 id="thread-{{.ID}}">{{.Name}}</h2>
+<table>
+<tr><th>Date</th><th>From</th><th>Message</th></tr>
+{{- range .Messages}}
+<tr{{if .Outgoing}} class="sent"{{end}}>
+<td class="date">{{.Date}}</td>
+<td>{{.Sender}}</td>
+<td>
+{{- if .Forwarded}}<div class="edit"><i>Forwarded</i></div>{{end}}
+{{- if .Special}}<div class="edit"><i>{{special .Special}}</i></div>{{end}}
+{{- range .Media}}
+{{- if not .Src}}<i>Missing attachment {{.Name}}</i><br>
+{{- else if eq .Tag "img"}}<a href="{{.Src}}"><img src="{{.Src}}" alt="{{.Name}}"></a><br>
+{{- else if eq .Tag "audio"}}<audio controls src="{{.Src}}"></audio><br>
+{{- else if eq .Tag "video"}}<video controls src="{{.Src}}"></video><br>
+{{- else}}<a href="{{.Src}}">{{.Name}}</a><br>
+{{- end}}
+{{- end}}
+{{- with .Body}}<div class="body">{{.}}</div>{{end}}
+{{- range .Edits}}
+<div class="edit">Edited from ({{date .ReadableDate .DateSent}}):<div class="body">{{text .Body}}</div></div>
+{{- end}}
+{{- if .Reactions}}
+<div class="edit">{{range .Reactions}}<span title="{{text .Author}}">{{.Emoji}}</span>{{end}}</div>
+{{- end}}
+{{- range .Receipts}}
+<div class="edit">
+{{- if eq .Status "read"}}Read{{else if eq .Status "viewed"}}Viewed{{else if eq .Status "delivered"}}Delivered{{else}}Sent{{end}}
+{{- with .ContactName}} by {{.}}{{end}}
+{{- with .ReadableDate}} at {{.}}{{end}}</div>
+{{- end}}
+</td>
+</tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+// HTML writes the messages as a single HTML page, one table per conversation.
+// Attachments are shown from their files, or from the page itself with
+// --embed_attachments.
+func HTML(db *sql.DB, pathAttachments string, out io.Writer, opt FormatOptions) error {
+	old, err := HasTable(db, "mms")
+	if err != nil {
+		return errors.Wrap(err, "failed to read database schema")
+	}
+	var m []message.Message
+	if old {
+		m, err = loadLegacyMessages(db, pathAttachments, opt)
+	} else {
+		m, err = loadExportMessages(db, pathAttachments, opt)
+	}
+	if err != nil {
+		return err
+	}
+
+	var threads []*htmlThread
+	byID := make(map[int64]*htmlThread)
+	for _, msg := range m {
+		t, ok := byID[msg.ThreadId]
+		if !ok {
+			t = &htmlThread{ID: msg.ThreadId, Name: fmt.Sprintf("Thread %d", msg.ThreadId)}
+			if msg.GroupName != nil {
+				t.Name = *msg.GroupName
+			} else if msg.ContactName != nil {
+				t.Name = *msg.ContactName
+			}
+			byID[msg.ThreadId] = t
+			threads = append(threads, t)
+		}
+		t.Messages = append(t.Messages, newHTMLMessage(msg, opt.Dates))
+	}
+
+	return errors.Wrap(htmlTemplate.Execute(out, threads), "failed to write out HTML")
+}
+
+// loadLegacyMessages gives the records that loadSynctech reads from a database
+// from before 2023 as messages, in order of date, so that the page is built
+// the same way for both schemas.
+func loadLegacyMessages(db *sql.DB, pathAttachments string, opt FormatOptions) ([]message.Message, error) {
+	smses, err := loadSynctech(db, pathAttachments, opt)
+	if err != nil {
+		return nil, err
+	}
+	var m []message.Message
+	for _, sms := range smses.SMS {
+		body := sms.Body
+		msg := message.Message{
+			ThreadId:     sms.ThreadId,
+			Type:         sms.Type,
+			Body:         &body,
+			DateSent:     sms.Date,
+			DateReceived: sms.Date,
+			ContactName:  sms.ContactName,
+		}
+		if sms.DateSent != nil && *sms.DateSent != 0 {
+			msg.DateSent = *sms.DateSent
+		}
+		m = append(m, msg)
+	}
+	for _, mms := range smses.MMS {
+		msg := message.Message{
+			ThreadId:     mms.ThreadId,
+			MessageId:    mms.MId,
+			Type:         message.SMSReceived,
+			DateSent:     mms.DateSent * 1000,
+			DateReceived: mms.Date,
+			ContactName:  mms.ContactName,
+		}
+		if opt.Dates.Numeric {
+			msg.DateSent = mms.DateSent // not converted to seconds
+		}
+		if mms.MsgBox == 2 {
+			msg.Type = message.SMSSent
+		}
+		parts := mms.PartList.Parts
+		if mms.Body != nil && len(*mms.Body) > 0 {
+			// The last part holds the body, with the text options applied
+			text := parts[len(parts)-1].Text
+			msg.Body = &text
+			parts = parts[:len(parts)-1]
+		}
+		for _, part := range parts {
+			a := message.Attachment{ContentType: part.Ct, Data: part.Data, Src: part.Src}
+			for _, name := range []string{part.Fn, part.Name} {
+				if name != "" && name != "null" {
+					a.FileName = name
+					break
+				}
+			}
+			msg.AttachmentList.Attachments = append(msg.AttachmentList.Attachments, a)
+		}
+		m = append(m, msg)
+	}
+	slices.SortStableFunc(m, func(a, b message.Message) int {
+		return cmp.Compare(a.DateSent, b.DateSent)
+	})
+	return m, nil
+}
+
+func newHTMLMessage(msg message.Message, dates message.Dates) htmlMessage {
+	h := htmlMessage{Message: msg, Sender: "Unknown"}
+	h.Date = stringPtr(dates.Readable(&msg.DateSent))
+	if h.Date == "" {
+		h.Date = fmt.Sprint(msg.DateSent)
+	}
+	switch {
+	case msg.GroupName == nil && isOutgoing(msg.Type):
+		h.Sender, h.Outgoing = "Me", true
+	case msg.ContactName != nil:
+		h.Sender = *msg.ContactName
+	}
+
+	for _, a := range msg.AttachmentList.Attachments {
+		media := htmlMedia{Name: a.FileName}
+		if media.Name == "" {
+			media.Name = a.ContentType
+		}
+		if kind, _, _ := strings.Cut(a.ContentType, "/"); kind == "image" || kind == "audio" || kind == "video" {
+			media.Tag = strings.Replace(kind, "image", "img", 1)
+		}
+		if a.Data != nil {
+			media.Src = template.URL("data:" + a.ContentType + ";base64," + *a.Data)
+		} else if a.Src != nil {
+			media.Src = template.URL(fileURL(*a.Src))
+		}
+		h.Media = append(h.Media, media)
+	}
+	return h
+}
+
+// isOutgoing reports whether a direct message was sent from this device.
+func isOutgoing(t message.SMSType) bool {
+	switch t {
+	case message.SMSSent, message.SMSOutbox, message.SMSFailed, message.SMSQueued, message.SMSDraft:
+		return true
+	}
+	return false
+}
+
+// fileURL turns the path of an attachment file into a URL for the page, which
+// is relative if the path is.
+func fileURL(pathName string) string {
+	if filepath.IsAbs(pathName) {
+		p := filepath.ToSlash(pathName)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p // a Windows drive
+		}
+		return (&url.URL{Scheme: "file", Path: p}).String()
+	}
+	u := (&url.URL{Path: filepath.ToSlash(pathName)}).EscapedPath()
+	// A colon in the first segment would be taken for a scheme
+	if first, _, _ := strings.Cut(u, "/"); strings.Contains(first, ":") {
+		u = "./" + u
+	}
+	return u
+}
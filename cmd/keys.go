@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Keys fulfils the hidden `keys` subcommand.
+var Keys = cli.Command{
+	Name:               "keys",
+	Usage:              "Print the keys derived from a backup's password",
+	Description:        "Print the hex-encoded cipher key, MAC key, IV and salt of a backup, for use\n"+
+	                    "with other decryption tools. These keys decrypt the entire backup just as\n"+
+	                    "the password does: keep them as secret as the password itself.",
+	CustomHelpTemplate: SubcommandHelp,
+	ArgsUsage:          "BACKUPFILE",
+	Hidden:             true,
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "i-understand-the-risk",
+			Usage: "Required: acknowledge that the printed keys decrypt the whole backup",
+		},
+	}, coreFlags...),
+	Action: func(c *cli.Context) error {
+		if !c.Bool("i-understand-the-risk") {
+			return errors.New("the keys fully decrypt the backup; pass --i-understand-the-risk to print them")
+		}
+
+		bf, err := setup(c)
+		if err != nil {
+			return err
+		}
+		defer bf.Close()
+
+		// The IV is overwritten by the frame counter once reading starts
+		iv := append([]byte{}, bf.IV...)
+
+		// Keys derived from a wrong password are of no use, so check them
+		// against the first frame before printing anything
+		if err := bf.ValidatePassword(); err != nil {
+			return errors.Wrap(err, "unable to verify the keys")
+		}
+
+		fmt.Printf("CipherKey %s\n", hex.EncodeToString(bf.CipherKey))
+		fmt.Printf("MacKey    %s\n", hex.EncodeToString(bf.MacKey))
+		fmt.Printf("IV        %s\n", hex.EncodeToString(iv))
+		fmt.Printf("Salt      %s\n", hex.EncodeToString(bf.Salt))
+		fmt.Printf("Version   %d\n", bf.Version)
+		fmt.Printf("Rounds    %d\n", bf.KDFRounds)
+		return nil
+	},
+}
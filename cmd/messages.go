@@ -0,0 +1,426 @@
+package cmd
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/internal/logging"
+	"github.com/xeals/signal-back/types/message"
+)
+
+// LoadMessages reads every message from a decrypted database (2023 or later
+// schema) and resolves its contact names, attachments, edits and reactions.
+// Attachment files are looked up in pathAttachments. The messages are sorted
+// the same way the XML format presents them.
+func LoadMessages(db *sql.DB, pathAttachments string, opt FormatOptions) ([]message.Message, error) {
+	var (
+		correspondents = make(map[int64]message.DbCorrespondent)
+		threads        = make(map[int64]message.DbThread)
+		groups         = make(map[int64]message.DbGroup)
+		msgAttachments = make(map[int64][]*message.DbAttachment) //key: message id
+		msgReactions   = make(map[int64][]message.Reaction)      //key: message id
+		msgEdits       = make(map[int64][]message.Edit)          //key: latest revision id
+		superseded     = make(map[int64]bool)
+		m              = []message.Message{}
+	)
+
+	rows, err := SelectStructFromTable(db, message.DbCorrespondent{}, "recipient")
+	if err != nil {
+		return nil, errors.Wrap(err, "messages select recipient")
+	}
+	for _, row := range rows {
+		r := row.(*message.DbCorrespondent)
+		correspondents[r.ID] = *r
+	}
+
+	rows, err = SelectStructFromTable(db, message.DbThread{}, "thread")
+	if err != nil {
+		return nil, errors.Wrap(err, "messages select thread")
+	}
+	for _, row := range rows {
+		r := row.(*message.DbThread)
+		threads[r.ID] = *r
+	}
+
+	rows, err = SelectStructFromTable(db, message.DbGroup{}, "groups")
+	if err != nil {
+		return nil, errors.Wrap(err, "messages select groups")
+	}
+	for _, row := range rows {
+		r := row.(*message.DbGroup)
+		groups[r.RecipientId] = *r
+	}
+
+	// Edited messages keep each prior revision as its own row.
+	// Only the latest revision appears in the timeline, carrying the others.
+	hasEdits, err := HasColumn(db, "message", "latest_revision_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "messages message columns")
+	}
+	if hasEdits {
+		rows, err = SelectStructFromTable(db, message.DbRevision{}, "message")
+		if err != nil {
+			return nil, errors.Wrap(err, "messages select message revisions")
+		}
+		for _, row := range rows {
+			r := row.(*message.DbRevision)
+			if r.LatestRevisionId.Valid {
+				latest := r.LatestRevisionId.Int64
+				msgEdits[latest] = append(msgEdits[latest], message.NewEdit(*r, opt.Dates))
+				superseded[r.ID] = true
+			}
+		}
+	}
+
+	forwarded, err := forwardedMessages(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "messages forwarded")
+	}
+	stories, err := storyMessages(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "messages stories")
+	}
+
+	var groupReceipts, directReceipts map[int64][]message.Receipt
+	if opt.Receipts {
+		if groupReceipts, err = loadGroupReceipts(db, correspondents, opt.Dates); err != nil {
+			return nil, errors.Wrap(err, "messages group receipts")
+		}
+		if directReceipts, err = loadDirectReceipts(db, correspondents, opt.Dates); err != nil {
+			return nil, errors.Wrap(err, "messages receipts")
+		}
+	}
+
+	hasReactions, err := HasTable(db, "reaction")
+	if err != nil {
+		return nil, errors.Wrap(err, "messages reaction table")
+	}
+	if hasReactions {
+		rows, err = SelectStructFromTable(db, message.DbReaction{}, "reaction")
+		if err != nil {
+			return nil, errors.Wrap(err, "messages select reaction")
+		}
+		for _, row := range rows {
+			r := row.(*message.DbReaction)
+			mid := r.MessageId
+			msgReactions[mid] = append(msgReactions[mid], message.NewReaction(*r, correspondents, opt.Dates))
+		}
+	}
+
+	rows, err = SelectStructFromTable(db, message.DbMessage{}, "message")
+	if err != nil {
+		return nil, errors.Wrap(err, "messages select message")
+	}
+	for i, row := range rows {
+		if i == opt.Limit {
+			break
+		}
+		msg := row.(*message.DbMessage)
+		if superseded[msg.ID] {
+			continue
+		}
+		if opt.skipThread(msg.ThreadId, threads[msg.ThreadId].Archived != 0) {
+			continue
+		}
+		if opt.skipDate(msg.DateReceived) {
+			continue
+		}
+		if opt.skipRecipient(correspondents[threads[msg.ThreadId].RecipientId].E164,
+			correspondents[msg.FromRecipientId].E164, correspondents[msg.ToRecipientId].E164) {
+			continue
+		}
+		xml, err := message.NewMessage(*msg, opt.Dates)
+		if err != nil {
+			// Exported regardless, as type 0, rather than losing the message
+			logging.Warnf("%v", err)
+		}
+		if kind, ok := stories[msg.ID]; ok {
+			xml.Special = kind
+		}
+		message.SetMessageContact(msg, &xml, correspondents, threads, groups)
+		xml.ThreadId = msg.ThreadId
+		if edits, ok := msgEdits[msg.ID]; ok {
+			slices.SortStableFunc(edits, func(a, b message.Edit) int {
+				return cmp.Compare(a.Revision, b.Revision)
+			})
+			xml.Edits = edits
+		}
+		xml.Reactions = msgReactions[msg.ID]
+		xml.Forwarded = forwarded[msg.ID]
+		if receipts, ok := groupReceipts[msg.ID]; ok {
+			xml.Receipts = receipts
+		} else if xml.Type == message.SMSSent {
+			xml.Receipts = directReceipts[msg.ID]
+		}
+		m = append(m, xml)
+	}
+
+	rows, err = SelectStructFromTable(db, message.DbAttachment{}, "attachment")
+	if err != nil {
+		return nil, errors.Wrap(err, "messages select attachment")
+	}
+	for _, row := range rows {
+		r := row.(*message.DbAttachment)
+		mid := r.MessageId
+		msgAttachments[mid] = append(msgAttachments[mid], r)
+	}
+
+	for i, msg := range m {
+		var messageSize uint64
+		id := msg.MessageId
+		if attachments, ok := msgAttachments[id]; ok {
+			for seq, attachment := range attachments {
+				xml := message.NewAttachment(*attachment)
+
+				stem := fmt.Sprintf("%06d", attachment.ID)
+				prefix := filepath.Join(pathAttachments, stem)
+				size, result, embedded, err := getAttachmentData(prefix, opt.EmbedAttachments, opt.EmbedMaxSize)
+				if err != nil {
+					return nil, err
+				}
+
+				if size == 0 {
+					msg := fmt.Sprintf("missing file '%v/%v'", pathAttachments, prefix)
+					if xml.ContentType == "application/x-signal-view-once" {
+						msg += ", it was marked 'View Once'"
+					} else if attachment.TransferState > 0 {
+						msg += fmt.Sprintf(", transfer state incomplete (%v)", attachment.TransferState)
+					}
+					logging.Warnf("%s", msg)
+				} else if size != attachment.DataSize {
+					logging.Warnf("attachment (id %v) file size (%v) mismatches declared size (%v)", prefix, size, attachment.DataSize)
+				}
+				messageSize += size
+
+				if embedded {
+					xml.Data = result
+				} else if size > 0 && opt.ExtractReferenced != "" {
+					if xml.Src, err = copyReferenced(*result, fmt.Sprintf("%d_%d", id, seq), opt); err != nil {
+						return nil, err
+					}
+				} else {
+					xml.Src = result
+				}
+				msg.AttachmentList.Attachments = append(msg.AttachmentList.Attachments, xml)
+			}
+		}
+
+		sizeString := strconv.FormatUint(messageSize, 10)
+		if msg.MSize != "null" && msg.MSize != sizeString {
+			logging.Warnf("MessageID %v declared size %v != calculated size %v\n", id, msg.MSize, sizeString)
+		}
+		msg.MSize = sizeString
+
+		m[i] = msg
+	}
+
+	if opt.FilterEmpty {
+		kept := m[:0]
+		for _, msg := range m {
+			if !isEmptyMessage(msg) {
+				kept = append(kept, msg)
+			}
+		}
+		if dropped := len(m) - len(kept); dropped > 0 {
+			logging.Infof("dropped %d empty messages", dropped)
+		}
+		m = kept
+	}
+
+	slices.SortStableFunc(m, func(a, b message.Message) int {
+		c := cmp.Compare(a.GroupDate, b.GroupDate)
+		if c == 0 {
+			c = cmp.Compare(stringPtr(a.GroupName), stringPtr(b.GroupName))
+			if c == 0 {
+				c = cmp.Compare(a.DateSent, b.DateSent)
+			}
+		}
+		return c
+	})
+
+	return m, nil
+}
+
+// forwardedMessages returns the ids of messages marked as forwarded, or
+// none if this Signal version has no such column.
+func forwardedMessages(db *sql.DB) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	for _, column := range []string{"forwarded", "is_forward"} {
+		has, err := HasColumn(db, "message", column)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			continue
+		}
+
+		q := fmt.Sprintf("SELECT _id FROM message WHERE %s > 0", column)
+		rows, err := db.Query(q)
+		if err != nil {
+			return nil, errors.Wrap(err, q)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return nil, errors.Wrap(err, "scan")
+			}
+			ids[id] = true
+		}
+		return ids, errors.Wrap(rows.Err(), q)
+	}
+	return ids, nil
+}
+
+// storyMessages returns the kind of each message that is a story, "story", or
+// a reply to one, "story_reply", or none if this Signal version has no stories.
+func storyMessages(db *sql.DB) (map[int64]string, error) {
+	kinds := make(map[int64]string)
+	for _, c := range []struct{ column, kind string }{
+		{"story_type", "story"},
+		{"parent_story_id", "story_reply"},
+	} {
+		has, err := HasColumn(db, "message", c.column)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			continue
+		}
+
+		q := fmt.Sprintf("SELECT _id FROM message WHERE %s > 0", c.column)
+		rows, err := db.Query(q)
+		if err != nil {
+			return nil, errors.Wrap(err, q)
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "scan")
+			}
+			kinds[id] = c.kind
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, q)
+		}
+	}
+	return kinds, nil
+}
+
+// loadGroupReceipts returns the receipts of each recipient of sent group
+// messages, keyed by message id.
+func loadGroupReceipts(db *sql.DB, correspondents map[int64]message.DbCorrespondent, dates message.Dates) (map[int64][]message.Receipt, error) {
+	receipts := make(map[int64][]message.Receipt)
+	has, err := HasColumn(db, "group_receipts", "mms_id")
+	if err != nil || !has {
+		return receipts, err
+	}
+
+	rows, err := SelectStructFromTable(db, message.DbGroupReceipt{}, "group_receipts")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		r := row.(*message.DbGroupReceipt)
+		mid := r.MmsId
+		receipts[mid] = append(receipts[mid], message.NewReceipt(r.Address, r.Status, r.Timestamp, correspondents, dates))
+	}
+	return receipts, nil
+}
+
+// loadDirectReceipts returns the receipt of messages that have one, from the
+// receipt columns of the message table, keyed by message id. Those columns
+// have been renamed between Signal versions; any that are missing are left out.
+func loadDirectReceipts(db *sql.DB, correspondents map[int64]message.DbCorrespondent, dates message.Dates) (map[int64][]message.Receipt, error) {
+	receipts := make(map[int64][]message.Receipt)
+
+	pick := func(names ...string) (string, error) {
+		for _, name := range names {
+			has, err := HasColumn(db, "message", name)
+			if err != nil {
+				return "", err
+			} else if has {
+				return name, nil
+			}
+		}
+		return "0", nil
+	}
+	delivered, err := pick("has_delivery_receipt", "delivery_receipt_count")
+	if err != nil {
+		return nil, err
+	}
+	read, err := pick("has_read_receipt", "read_receipt_count")
+	if err != nil {
+		return nil, err
+	}
+	viewed, err := pick("viewed", "viewed_receipt_count")
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := pick("receipt_timestamp")
+	if err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf("SELECT _id, to_recipient_id, %s, %s, %s, %s FROM message WHERE %s > 0 OR %s > 0 OR %s > 0",
+		delivered, read, viewed, timestamp, delivered, read, viewed)
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, q)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id, recipient, isDelivered, isRead, isViewed int64
+			ts                                           sql.NullInt64
+		)
+		if err := rows.Scan(&id, &recipient, &isDelivered, &isRead, &isViewed, &ts); err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		status := int64(message.ReceiptDelivered)
+		if isViewed > 0 {
+			status = message.ReceiptViewed
+		} else if isRead > 0 {
+			status = message.ReceiptRead
+		}
+		receipts[id] = []message.Receipt{message.NewReceipt(recipient, status, message.IntRef(ts), correspondents, dates)}
+	}
+	return receipts, errors.Wrap(rows.Err(), q)
+}
+
+// isEmptyMessage reports whether msg has no content of its own, as with
+// group control messages and other placeholder rows.
+func isEmptyMessage(msg message.Message) bool {
+	return (msg.Body == nil || *msg.Body == "") &&
+		len(msg.AttachmentList.Attachments) == 0 &&
+		len(msg.Edits) == 0 &&
+		len(msg.Reactions) == 0
+}
+
+// EachMessage calls fn for every message LoadMessages returns, in the same
+// order. It is a convenience over LoadMessages, not a stream: the messages
+// are all loaded and sorted first, so memory use is the same. Returning
+// ErrStopScan from fn stops the calls without error.
+func EachMessage(db *sql.DB, pathAttachments string, opt FormatOptions, fn func(msg message.Message) error) error {
+	m, err := LoadMessages(db, pathAttachments, opt)
+	if err != nil {
+		return err
+	}
+	for _, msg := range m {
+		if err := fn(msg); err != nil {
+			if err == ErrStopScan {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,556 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/logging"
+	"github.com/xeals/signal-back/signal"
+	"github.com/xeals/signal-back/types"
+)
+
+// attachmentPipeline follows each attachment of an extraction from its frame
+// to its final name, timestamp and index and manifest entries.
+//
+// Its methods run in backup order: on the goroutine reading the backup, or as
+// the follow-up of a job submitted to workers. The work done by the workers,
+// detecting file types and setting timestamps, touches none of the state
+// here, so it needs no locking.
+type attachmentPipeline struct {
+	c         *cli.Context
+	bf        *types.BackupFile
+	base      string
+	store     attachmentStore
+	workers   *workerPool
+	warner    func(kind string, id interface{}) warnFunc
+	statePath string
+	state     *resumeState // the files written so far, saved for --resume
+	resumed   *resumeState // the files of the run being resumed, or nil
+
+	mimeFilter []string
+	dates      *dateFilter
+	sample     *attachmentSample
+	prior      map[int64]bool // attachments of an earlier extraction, read but not written
+
+	layout        outputLayout
+	android       bool
+	originalNames bool
+	reportMACs    bool
+
+	inFlight     map[int64]int       // message id -> attachments still with the workers
+	pending      []pendingAttachment // written before their SQL row
+	undated      map[string]bool     // written before their message row
+	outOfRange   map[string]bool     // written, then removed by --after or --before
+	claimed      map[string]bool     // with --original-names, the names taken so far, lower-cased
+	fileMessages map[string]int64    // for --by-thread
+	orphans      map[string]int      // frames with no SQL row, by kind
+	index        []indexEntry
+	manifest     []manifestEntry
+
+	datesSkipped int
+	priorSkipped int
+	failed       int // left out by --keep-going
+}
+
+func newAttachmentPipeline(c *cli.Context, bf *types.BackupFile, base string) *attachmentPipeline {
+	return &attachmentPipeline{
+		c:             c,
+		bf:            bf,
+		base:          base,
+		android:       c.Bool("android-layout"),
+		originalNames: c.Bool("original-names"),
+		reportMACs:    c.Bool("report-macs"),
+		inFlight:      make(map[int64]int),
+		undated:       make(map[string]bool),
+		outOfRange:    make(map[string]bool),
+		claimed:       make(map[string]bool),
+		fileMessages:  make(map[string]int64),
+		orphans:       make(map[string]int),
+		manifest:      []manifestEntry{},
+	}
+}
+
+// fixExtension is fixFileExtension, except that files in the Android layout
+// keep their on-device names, which have no extensions.
+func (p *attachmentPipeline) fixExtension(pathName, mimeType string, warn warnFunc) (string, error) {
+	if p.android {
+		return pathName, nil
+	}
+	return fixFileExtension(pathName, mimeType, warn)
+}
+
+func (p *attachmentPipeline) attachmentName(id int64, info attachmentInfo) string {
+	fileName := fmt.Sprintf("%06d", id)
+	if p.android {
+		fileName = fmt.Sprintf("part%d.mms", id)
+		if info.data != nil && *info.data != "" {
+			fileName = path.Base(*info.data)
+		}
+	} else if info.name != nil {
+		fileName += "." + *info.name
+	}
+	return escapeFileName(fileName)
+}
+
+func attachmentMime(id int64, info attachmentInfo, length uint32, warn warnFunc) string {
+	if info.size != int64(length) {
+		warn("attachment length (%d) mismatches SQL entry.size (%d)", length, info.size)
+	}
+	if info.mime == nil {
+		warn("file `%v` has no declared MIME type", id)
+		return ""
+	}
+	return *info.mime
+}
+
+// dropFile removes an attachment written before its message date was known.
+func (p *attachmentPipeline) dropFile(pathName string) error {
+	p.datesSkipped++
+	p.outOfRange[pathName] = true
+	delete(p.undated, pathName)
+	return errors.Wrap(os.Remove(pathName), "attachment")
+}
+
+func (p *attachmentPipeline) addManifest(category, id, pathName, mime string, declared *int64, size int64, noEntry bool) {
+	rel, _ := filepath.Rel(p.base, pathName)
+	ext := strings.TrimPrefix(filepath.Ext(pathName), ".")
+	p.manifest = append(p.manifest, manifestEntry{category, id, rel, mime, declared, size, ext, noEntry})
+}
+
+// noEntry warns of a frame whose SQL row never turned up.
+func (p *attachmentPipeline) noEntry(kind string, id interface{}, pos int64, length uint32, warn warnFunc) {
+	p.orphans[kind]++
+	warn("%s `%v` has no associated SQL entry (frame at %#x, %d bytes);"+
+		" this may be a pre-schema frame or an orphaned %s", kind, id, pos, length, kind)
+}
+
+// recordIndex adds an attachment to the index; an empty pathName is one that
+// failed its MAC check and was skipped.
+func (p *attachmentPipeline) recordIndex(id int64, info attachmentInfo, hasInfo bool, mime, pathName string, length uint32) {
+	if pathName != "" {
+		var declared *int64
+		if hasInfo {
+			declared = &info.size
+			p.fileMessages[pathName] = info.msg
+		}
+		p.addManifest("attachment", fmt.Sprint(id), pathName, mime, declared, int64(length), !hasInfo)
+	}
+	if p.c.String("index-csv") != "" || p.c.Bool("verify-sizes") {
+		rel, mac := "", "corrupt"
+		if pathName != "" {
+			rel, _ = filepath.Rel(p.base, pathName)
+			mac = "ok"
+		}
+		if !p.reportMACs {
+			mac = ""
+		}
+		declared := info.size
+		if !hasInfo {
+			declared = -1
+		}
+		p.index = append(p.index, indexEntry{id, info.msg, mime, length, rel, mac, declared})
+	}
+}
+
+// skipFailed reports whether, with --keep-going, an attachment that cannot be
+// written is left out instead of ending the run.
+func (p *attachmentPipeline) skipFailed(err error, pathName string, warn warnFunc) bool {
+	if _, ok := errors.Cause(err).(outputError); !ok || !p.c.Bool("keep-going") {
+		return false
+	}
+	p.failed++
+	warn("unable to write `%v`, skipped: %v", filepath.Base(pathName), err)
+	// Whatever stood in the way of creating the file is left alone
+	if info, err := os.Lstat(pathName); err == nil && !info.IsDir() {
+		if err := os.Remove(pathName); err != nil {
+			logging.Warnf("unable to remove partial file: %s", err)
+		}
+	}
+	return true
+}
+
+// originalName renames an attachment written under its id-prefixed name to
+// its original name, numbered if that name is already taken. Collisions are
+// resolved in backup order, so a re-run gives the same names.
+func (p *attachmentPipeline) originalName(id int64, info attachmentInfo, pathName string) (string, error) {
+	prefix := fmt.Sprintf("%06d.", id)
+	name := filepath.Base(pathName)
+	if !p.originalNames || info.name == nil || *info.name == "" || !strings.HasPrefix(name, prefix) {
+		return pathName, nil
+	}
+	name = escapeFileName(strings.TrimPrefix(name, prefix))
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for n := 2; p.claimed[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+	p.claimed[strings.ToLower(name)] = true
+	newName := filepath.Join(filepath.Dir(pathName), name)
+	return newName, errors.Wrap(os.Rename(pathName, newName), "original name")
+}
+
+// claimAttachment gives an attachment with its extension its final name, and
+// records it.
+func (p *attachmentPipeline) claimAttachment(id int64, info attachmentInfo, hasInfo bool, mime, pathName string, length uint32) (string, error) {
+	newName, err := p.originalName(id, info, pathName)
+	if err != nil {
+		return "", err
+	}
+	p.recordIndex(id, info, hasInfo, mime, newName, length)
+	return newName, nil
+}
+
+// finishAttachment gives a written attachment its extension and records it.
+func (p *attachmentPipeline) finishAttachment(id int64, info attachmentInfo, hasInfo bool, mime, pathName string, length uint32, warn warnFunc) (string, error) {
+	newName, err := p.fixExtension(pathName, mime, warn)
+	if err != nil {
+		return "", err
+	}
+	return p.claimAttachment(id, info, hasInfo, mime, newName, length)
+}
+
+// attachment handles an attachment frame, whose data is next in the backup.
+// pos, frame and ctr locate the frame, for --resume.
+func (p *attachmentPipeline) attachment(a *signal.Attachment, pos, frame int64, ctr uint32) error {
+	id, info, hasInfo, err := lookupAttachment(a, p.store)
+	if err != nil {
+		return err
+	}
+	warn := p.warner("attachment", id)
+
+	if hasInfo && p.prior[id] {
+		p.priorSkipped++
+		return p.bf.DecryptAttachment(a.GetLength(), nil)
+	}
+	if !hasInfo {
+		return p.writeAhead(a, id, info, pos, warn)
+	}
+
+	mime := attachmentMime(id, info, a.GetLength(), warn)
+
+	// Filtered attachments must still be read to keep the stream aligned.
+	// Without a useful declared type, the written file is checked instead.
+	sniff := p.mimeFilter != nil && !declaredMime(mime)
+	if p.mimeFilter != nil && !sniff && !matchMime(p.mimeFilter, mime) {
+		return p.bf.DecryptAttachment(a.GetLength(), nil)
+	}
+	slot, ok := 0, true
+	if p.sample != nil {
+		slot, ok = p.sample.pick()
+	}
+	if !ok {
+		return p.bf.DecryptAttachment(a.GetLength(), nil)
+	}
+	// The message row may not have been read yet; if not, the file
+	// is written and removed once its date is known
+	msgTime, dated, err := p.store.messageTime(info.msg)
+	if err != nil {
+		return err
+	}
+	if p.dates != nil && dated && !p.dates.keeps(msgTime, true) {
+		p.datesSkipped++
+		return p.bf.DecryptAttachment(a.GetLength(), nil)
+	}
+
+	// keep records the file under its final name, in backup order
+	keep := func(newName string) error {
+		p.inFlight[info.msg]--
+		if p.sample != nil {
+			if err := p.sample.keep(slot, newName); err != nil {
+				return errors.Wrap(err, "attachment")
+			}
+		}
+		if p.dates != nil && !dated {
+			p.undated[newName] = true
+		}
+		return p.store.addFile(info.msg, attachmentFile{info.time, newName})
+	}
+
+	if r, ok := p.resumed.attachment(p.base, id, a.GetLength(), info.size); ok {
+		if err := p.bf.DecryptAttachment(a.GetLength(), nil); err != nil {
+			return err
+		}
+		newName := filepath.Join(p.base, r.Path)
+		p.inFlight[info.msg]++
+		return p.workers.submit(nil, func() error {
+			if p.originalNames {
+				p.claimed[strings.ToLower(filepath.Base(r.Path))] = true
+			}
+			p.recordIndex(id, info, true, r.Mime, newName, a.GetLength())
+			return keep(newName)
+		})
+	}
+
+	pathName := filepath.Join(p.base, p.layout.attachments, p.attachmentName(id, info))
+	if err := writeAttachment(pathName, a.GetLength(), p.bf); err != nil {
+		if p.c.Bool("skip-bad") && skipBad(err, pathName, warn) {
+			return p.workers.submit(nil, func() error {
+				p.recordIndex(id, info, true, mime, "", a.GetLength())
+				return nil
+			})
+		}
+		if p.skipFailed(err, pathName, warn) {
+			p.sample.unpick()
+			return nil
+		}
+		return errors.Wrap(err, "attachment")
+	}
+	if sniff && !matchMime(p.mimeFilter, detectMime(pathName)) {
+		p.sample.unpick()
+		return errors.Wrap(os.Remove(pathName), "attachment")
+	}
+
+	// The file type is detected by a worker; the rest waits for it
+	var fixed string
+	var fixErr error
+	p.inFlight[info.msg]++
+	return p.workers.submit(func() (err error) {
+		fixed, err = p.fixExtension(pathName, mime, warn)
+		if err != nil && p.c.Bool("keep-going") {
+			// Reported in order, with the others
+			fixErr = outputError{err}
+			return nil
+		}
+		return errors.Wrap(err, "attachment")
+	}, func() error {
+		newName, err := "", fixErr
+		if err == nil {
+			if newName, err = p.claimAttachment(id, info, true, mime, fixed, a.GetLength()); err != nil {
+				err = outputError{err}
+			}
+		}
+		if err != nil {
+			if fixed == "" {
+				fixed = pathName
+			}
+			if p.skipFailed(err, fixed, warn) {
+				p.inFlight[info.msg]--
+				p.sample.unpick()
+				return nil
+			}
+			return errors.Wrap(err, "attachment")
+		}
+		rel, _ := filepath.Rel(p.base, newName)
+		p.state.Attachments[id] = resumedAttachment{Path: rel, Mime: mime, Length: a.GetLength()}
+		p.state.Frame, p.state.Offset, p.state.Counter = frame, pos, ctr
+		if err := p.state.save(p.statePath, false); err != nil {
+			return err
+		}
+		return keep(newName)
+	})
+}
+
+// writeAhead writes an attachment whose SQL row has not been read. The row
+// may still follow, so the file is named and filtered by finishPending, once
+// the whole backup has been read.
+func (p *attachmentPipeline) writeAhead(a *signal.Attachment, id int64, info attachmentInfo, pos int64, warn warnFunc) error {
+	slot, ok := 0, true
+	if p.sample != nil {
+		slot, ok = p.sample.pick()
+	}
+	if !ok {
+		return p.bf.DecryptAttachment(a.GetLength(), nil)
+	}
+
+	pathName := filepath.Join(p.base, p.layout.attachments, p.attachmentName(id, info))
+	if err := writeAttachment(pathName, a.GetLength(), p.bf); err != nil {
+		if p.c.Bool("skip-bad") && skipBad(err, pathName, warn) {
+			if !p.reportMACs {
+				return nil
+			}
+			return p.workers.submit(nil, func() error {
+				p.pending = append(p.pending, pendingAttachment{a, pos, "", true})
+				return nil
+			})
+		}
+		if p.skipFailed(err, pathName, warn) {
+			p.sample.unpick()
+			return nil
+		}
+		return errors.Wrap(err, "attachment")
+	}
+	// Queued behind the workers, so that the sample keeps backup order
+	return p.workers.submit(nil, func() error {
+		if p.sample != nil {
+			if err := p.sample.keep(slot, pathName); err != nil {
+				return errors.Wrap(err, "attachment")
+			}
+		}
+		p.pending = append(p.pending, pendingAttachment{a, pos, pathName, false})
+		return nil
+	})
+}
+
+// messageRow dates the files of a message whose row has just been read,
+// received at rcv: their timestamps are set, or they are removed if outside
+// --after and --before.
+func (p *attachmentPipeline) messageRow(id, time, rcv int64) error {
+	seen := time
+	if seen > rcv {
+		seen = rcv
+	}
+	if err := p.store.setMessageTime(id, seen); err != nil {
+		return err
+	}
+	// The workers may still be naming this message's files
+	if p.inFlight[id] > 0 {
+		if err := p.workers.drain(true); err != nil {
+			return err
+		}
+	}
+	files, err := p.store.takeFiles(id)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		if p.sample.isDropped(info.path) || p.outOfRange[info.path] {
+			continue
+		}
+		if !p.dates.keeps(seen, true) {
+			if err := p.dropFile(info.path); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(p.undated, info.path)
+		if time > info.time && info.time != 0 {
+			time = info.time
+		}
+		if time > rcv {
+			time = rcv
+		}
+		pathName, mtime := info.path, time
+		err := p.workers.submit(func() error { return setFileTimestamp(pathName, mtime) }, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishPending names, filters and dates the attachments written ahead of
+// their SQL row, now that every row has been seen. Message rows have all been
+// seen too, so timestamps are set here rather than deferred.
+func (p *attachmentPipeline) finishPending() error {
+	for _, pa := range p.pending {
+		if p.sample.isDropped(pa.path) {
+			continue
+		}
+		id, info, hasInfo, err := lookupAttachment(pa.frame, p.store)
+		if err != nil {
+			return err
+		}
+		warn := p.warner("attachment", id)
+		mime := ""
+		if !hasInfo {
+			p.noEntry("attachment", id, pa.pos, pa.frame.GetLength(), warn)
+		} else {
+			mime = attachmentMime(id, info, pa.frame.GetLength(), warn)
+		}
+
+		if p.prior[id] {
+			p.priorSkipped++
+		}
+		msgTime, dated, err := p.store.messageTime(info.msg)
+		if err != nil {
+			return err
+		}
+		inRange := p.dates.keeps(msgTime, dated && hasInfo)
+		if !inRange && !p.prior[id] {
+			p.datesSkipped++
+		}
+		mimeOK := p.mimeFilter == nil || matchMime(p.mimeFilter, mime) ||
+			(!declaredMime(mime) && !pa.corrupt && matchMime(p.mimeFilter, detectMime(pa.path)))
+		if p.prior[id] || !mimeOK || !inRange {
+			if pa.corrupt {
+				continue
+			}
+			if err := os.Remove(pa.path); err != nil {
+				return errors.Wrap(err, "attachment")
+			}
+			continue
+		}
+		if pa.corrupt {
+			p.recordIndex(id, info, hasInfo, mime, "", pa.frame.GetLength())
+			continue
+		}
+
+		pathName := filepath.Join(p.base, p.layout.attachments, p.attachmentName(id, info))
+		if pathName != pa.path {
+			if err := os.Rename(pa.path, pathName); err != nil {
+				if p.skipFailed(outputError{err}, pa.path, warn) {
+					continue
+				}
+				return errors.Wrap(err, "attachment")
+			}
+		}
+		newName, err := p.finishAttachment(id, info, hasInfo, mime, pathName, pa.frame.GetLength(), warn)
+		if err != nil {
+			if p.skipFailed(outputError{err}, pathName, warn) {
+				continue
+			}
+			return errors.Wrap(err, "attachment")
+		}
+		if time := msgTime; dated && hasInfo {
+			if time > info.time && info.time != 0 {
+				time = info.time
+			}
+			if err := setFileTimestamp(newName, time); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Whatever is still undated belongs to a message that never turned up
+	if !p.dates.keeps(0, false) {
+		for pathName := range p.undated {
+			if err := p.dropFile(pathName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropRemoved leaves out of the index and manifest the files that a later
+// sampled attachment pushed out, or that turned out to be outside the date
+// range.
+func (p *attachmentPipeline) dropRemoved() {
+	if p.sample == nil && len(p.outOfRange) == 0 {
+		return
+	}
+	kept := p.index[:0]
+	for _, e := range p.index {
+		if pathName := filepath.Join(p.base, e.Path); !p.sample.isDropped(pathName) && !p.outOfRange[pathName] {
+			kept = append(kept, e)
+		}
+	}
+	p.index = kept
+	keptFiles := p.manifest[:0]
+	for _, e := range p.manifest {
+		if pathName := filepath.Join(p.base, e.Path); !p.sample.isDropped(pathName) && !p.outOfRange[pathName] {
+			keptFiles = append(keptFiles, e)
+		}
+	}
+	p.manifest = keptFiles
+}
+
+// renamed updates the index and manifest for files moved from each key of
+// moved to its value.
+func (p *attachmentPipeline) renamed(moved map[string]string) {
+	for i, e := range p.index {
+		if newName, ok := moved[filepath.Join(p.base, e.Path)]; ok {
+			p.index[i].Path, _ = filepath.Rel(p.base, newName)
+		}
+	}
+	for i, e := range p.manifest {
+		if newName, ok := moved[filepath.Join(p.base, e.Path)]; ok {
+			p.manifest[i].Path, _ = filepath.Rel(p.base, newName)
+		}
+	}
+}
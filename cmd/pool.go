@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// poolAttachments moves every attachment file under dir into the content-addressed
+// pool, as pool/<sha256>, and leaves a symlink to it in its place. A file whose
+// content is already pooled is removed instead, so the pool holds each content
+// once however many backups refer to it. It returns the number of files newly
+// added to the pool and the number linked.
+func poolAttachments(dir, pool string) (added, linked int, result error) {
+	pool, err := filepath.Abs(pool)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "attachment store")
+	}
+	if err := os.MkdirAll(pool, 0755); err != nil {
+		return 0, 0, errors.Wrap(err, "unable to create attachment store")
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	err = filepath.WalkDir(dir, func(pathName string, d fs.DirEntry, err error) error {
+		// Links from an earlier run are already pooled
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		sum, err := fileSHA256(pathName)
+		if err != nil {
+			return err
+		}
+		pooled := filepath.Join(pool, sum)
+
+		if _, err := os.Stat(pooled); err == nil {
+			if err := os.Remove(pathName); err != nil {
+				return errors.Wrap(err, "attachment store")
+			}
+		} else if os.IsNotExist(err) {
+			if err := moveFile(pathName, pooled); err != nil {
+				return errors.Wrap(err, "attachment store")
+			}
+			added++
+		} else {
+			return errors.Wrap(err, "attachment store")
+		}
+
+		if err := os.Symlink(pooled, pathName); err != nil {
+			return errors.Wrap(err, "attachment store")
+		}
+		linked++
+		return nil
+	})
+	return added, linked, err
+}
+
+// moveFile renames src to dst, copying it instead when they are on different
+// file systems. The copy keeps the mode and modification time of src.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Copied under a temporary name, so the pool never holds a partial file
+	out, err := createTemp(dst)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, digest), in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != filepath.Base(dst) {
+		os.Remove(out.Name())
+		return errors.Errorf("%s changed while being copied", src)
+	}
+	if err := os.Chmod(out.Name(), info.Mode().Perm()); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if err := os.Chtimes(out.Name(), info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(src)
+}
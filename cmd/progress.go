@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/logging"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// progressInterval is the least time between redraws of the progress line.
+const progressInterval = 250 * time.Millisecond
+
+// progressBarWidth is the number of characters in the bar at the start of the line.
+const progressBarWidth = 20
+
+// progressMeter draws a refreshing progress line with an estimate of the time
+// remaining. The estimate is made from bytes read rather than frames, since a
+// single attachment frame can take far longer than thousands of statements.
+type progressMeter struct {
+	size  int64
+	start time.Time
+	last  time.Time
+	width int
+}
+
+// newProgress returns a meter for reading a file of size bytes, or nil when
+// stderr is not a terminal, --quiet was given, or warnings are logged there.
+func newProgress(c *cli.Context, size int64) *progressMeter {
+	if c.Bool("quiet") || logging.Enabled(logging.Warn) || size <= 0 || !terminal.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+	return &progressMeter{size: size, start: time.Now()}
+}
+
+// update redraws the line for pos bytes read, at most every progressInterval.
+// It is a ConsumeFuncs.ProgressFunc; the total is the size given to newProgress.
+func (p *progressMeter) update(pos, _ int64) {
+	now := time.Now()
+	if now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+
+	fraction := float64(pos) / float64(p.size)
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+	line := fmt.Sprintf("[%s] %5.1f%%  %s of %s", bar, 100*fraction, byteCount(pos), byteCount(p.size))
+	if elapsed := now.Sub(p.start); pos > 0 && elapsed > time.Second {
+		remaining := time.Duration(float64(elapsed) * float64(p.size-pos) / float64(pos))
+		line += "  ETA " + remaining.Round(time.Second).String()
+	}
+	p.draw(line)
+}
+
+// done clears the progress line.
+func (p *progressMeter) done() {
+	if p.width > 0 {
+		p.draw("")
+		fmt.Fprint(os.Stderr, "\r")
+	}
+}
+
+func (p *progressMeter) draw(line string) {
+	pad := ""
+	if len(line) < p.width {
+		pad = strings.Repeat(" ", p.width-len(line))
+	}
+	fmt.Fprint(os.Stderr, "\r"+line+pad)
+	p.width = len(line)
+}
+
+// byteCount formats n bytes with a binary unit, such as "3.2 GiB".
+func byteCount(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
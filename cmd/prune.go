@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Prune fulfils the `prune` subcommand.
+var Prune = cli.Command{
+	Name:               "prune",
+	Usage:              "Write a copy of a signal database with only some of its messages",
+	Description:        "Copy the database, keeping only the messages of the chosen threads and dates\n"+
+	                    "along with the attachment rows, parts, threads, groups and recipients they\n"+
+	                    "refer to. Other tables are copied unchanged.",
+	CustomHelpTemplate: SubcommandHelp,
+	ArgsUsage:          "DBFILE",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "output, o",
+			Usage: "Write the pruned database to `FILE`",
+		},
+		&cli.IntSliceFlag{
+			Name:  "thread",
+			Usage: "Keep the messages of thread `ID`. May be repeated; default is every thread",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Keep messages sent on or after `TIME` (YYYY-MM-DD, RFC 3339 or Unix milliseconds)",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Keep messages sent on or before `TIME` (YYYY-MM-DD, RFC 3339 or Unix milliseconds)",
+		},
+		&cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "suppress all output except errors",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return errors.New("must specify a Signal database file")
+		}
+		output := c.String("output")
+		if output == "" {
+			return errors.New("must specify an --output file")
+		}
+
+		var f pruneFilter
+		f.threads = c.IntSlice("thread")
+		var err error
+		if f.since, err = parseTimeFlag("since", c.String("since")); err != nil {
+			return err
+		}
+		if f.until, err = parseTimeFlag("until", c.String("until")); err != nil {
+			return err
+		}
+		// A date alone includes the whole of that day
+		if _, err := time.Parse(dateLayout, c.String("until")); err == nil {
+			f.until = time.UnixMilli(f.until).AddDate(0, 0, 1).UnixMilli() - 1
+		}
+
+		db, err := openDB(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		// VACUUM INTO accepts an empty file, so the copy can be made in place
+		// of a temporary file and only renamed over the output once pruned.
+		file, err := createTemp(output)
+		if err != nil {
+			return errors.Wrap(err, "unable to open output file")
+		}
+		file.Close()
+		defer os.Remove(file.Name())
+
+		if _, err := db.Exec("VACUUM INTO ?", file.Name()); err != nil {
+			return errors.Wrap(err, "unable to copy database")
+		}
+
+		out, err := sql.Open("sqlite", file.Name())
+		if err != nil {
+			return errors.Wrap(err, "cannot open pruned database")
+		}
+		defer out.Close()
+		// One connection, so the temporary table is seen by every statement
+		out.SetMaxOpenConns(1)
+
+		kept, total, err := PruneDatabase(out, f)
+		if err != nil {
+			return errors.Wrap(err, "failed to prune")
+		}
+		if err := out.Close(); err != nil {
+			return errors.Wrap(err, "unable to close pruned database")
+		}
+		if err := os.Rename(file.Name(), output); err != nil {
+			return errors.Wrap(err, "unable to replace output file")
+		}
+		status(c, fmt.Sprintf("Kept %d of %d messages", kept, total))
+		return nil
+	},
+}
+
+// pruneFilter selects the messages that PruneDatabase keeps. Dates are in milliseconds,
+// and 0 leaves that end of the range open.
+type pruneFilter struct {
+	threads      []int
+	since, until int64
+}
+
+// where returns the SQL condition for a kept message in a table whose date is
+// held in dateColumn.
+func (f pruneFilter) where(dateColumn string) string {
+	conds := []string{"1"}
+	if len(f.threads) > 0 {
+		ids := make([]string, len(f.threads))
+		for i, id := range f.threads {
+			ids[i] = strconv.Itoa(id)
+		}
+		conds = append(conds, "thread_id IN ("+strings.Join(ids, ",")+")")
+	}
+	if f.since != 0 {
+		conds = append(conds, fmt.Sprintf("%s >= %d", dateColumn, f.since))
+	}
+	if f.until != 0 {
+		conds = append(conds, fmt.Sprintf("%s <= %d", dateColumn, f.until))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// Columns that hold a recipient id, in any table.
+var recipientColumns = []string{"recipient_id", "from_recipient_id", "to_recipient_id", "author_id", "address"}
+
+// PruneDatabase deletes the messages of db that f does not select, then every row that
+// only existed for them: attachment rows and parts, and the threads, groups and
+// recipients that no kept message refers to. It returns the number of messages
+// kept and the number there were.
+func PruneDatabase(db *sql.DB, f pruneFilter) (kept, total int64, result error) {
+	tables, err := tableNames(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	has := make(map[string]bool, len(tables))
+	columns := make(map[string][]string, len(tables))
+	for _, t := range tables {
+		has[t] = true
+		if columns[t], err = TableColumns(db, `"`+t+`"`); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Messages: the modern message table, or sms and mms before 2023
+	dateColumn := map[string]string{"message": "date_sent", "sms": "date", "mms": "date"}
+	var messageTables []string
+	for _, t := range []string{"message", "sms", "mms"} {
+		if has[t] {
+			messageTables = append(messageTables, t)
+		}
+	}
+	if len(messageTables) == 0 {
+		return 0, 0, errors.New("database has no message table")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "begin")
+	}
+	defer func() {
+		if result != nil {
+			tx.Rollback()
+		}
+	}()
+	exec := func(q string) error {
+		_, err := tx.Exec(q)
+		return errors.Wrap(err, q)
+	}
+	count := func(q string) (int64, error) {
+		var n int64
+		err := tx.QueryRow(q).Scan(&n)
+		return n, errors.Wrap(err, q)
+	}
+
+	var threadRefs []string
+	for _, t := range messageTables {
+		n, err := count("SELECT COUNT(*) FROM " + t)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += n
+		if err := exec(fmt.Sprintf("DELETE FROM %s WHERE NOT (%s)", t, f.where(dateColumn[t]))); err != nil {
+			return 0, 0, err
+		}
+		if n, err = count("SELECT COUNT(*) FROM " + t); err != nil {
+			return 0, 0, err
+		}
+		kept += n
+		threadRefs = append(threadRefs, "SELECT thread_id FROM "+t)
+	}
+
+	isMessageTable := func(t string) bool {
+		return t == "message" || t == "sms" || t == "mms"
+	}
+
+	// Rows that belong to a deleted message. Parts and receipts of the older
+	// schema name their message differently, and only ever refer to mms.
+	for _, t := range tables {
+		if isMessageTable(t) {
+			continue
+		}
+		for _, col := range columns[t] {
+			parent := ""
+			switch {
+			case col == "message_id" && has["message"]:
+				parent = "message"
+			case (col == "mid" || col == "mms_id") && has["mms"]:
+				parent = "mms"
+			}
+			if parent != "" {
+				if err := exec(fmt.Sprintf(`DELETE FROM "%s" WHERE %s NOT IN (SELECT _id FROM %s)`, t, col, parent)); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+
+	// Threads left without messages, and rows such as drafts that belong to them
+	if has["thread"] {
+		if err := exec("DELETE FROM thread WHERE _id NOT IN (" + strings.Join(threadRefs, " UNION ") + ")"); err != nil {
+			return 0, 0, err
+		}
+		for _, t := range tables {
+			if t != "thread" && !isMessageTable(t) && slices.Contains(columns[t], "thread_id") {
+				if err := exec(fmt.Sprintf(`DELETE FROM "%s" WHERE thread_id NOT IN (SELECT _id FROM thread)`, t)); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+		if has["groups"] && slices.Contains(columns["groups"], "recipient_id") {
+			if err := exec("DELETE FROM groups WHERE recipient_id NOT IN (SELECT recipient_id FROM thread)"); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	// Recipients that nothing kept refers to, keeping the members of kept groups
+	if has["recipient"] {
+		keep, err := keptRecipients(tx, tables, columns)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := exec("CREATE TEMP TABLE keep_recipient (id INTEGER PRIMARY KEY)"); err != nil {
+			return 0, 0, err
+		}
+		for id := range keep {
+			if _, err := tx.Exec("INSERT INTO keep_recipient VALUES (?)", id); err != nil {
+				return 0, 0, errors.Wrap(err, "keep recipient")
+			}
+		}
+		if err := exec("DELETE FROM recipient WHERE _id NOT IN (SELECT id FROM keep_recipient)"); err != nil {
+			return 0, 0, err
+		}
+		if err := exec("DROP TABLE keep_recipient"); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, errors.Wrap(err, "commit")
+	}
+	// Deleted rows stay in the file's free pages until it is rebuilt
+	if _, err := db.Exec("VACUUM"); err != nil {
+		return 0, 0, errors.Wrap(err, "vacuum")
+	}
+	return kept, total, nil
+}
+
+// keptRecipients collects the recipient ids referred to by the rows that remain,
+// including the members listed in each group.
+func keptRecipients(tx *sql.Tx, tables []string, columns map[string][]string) (map[int64]bool, error) {
+	keep := make(map[int64]bool)
+	collect := func(q string, split bool) error {
+		rows, err := tx.Query(q)
+		if err != nil {
+			return errors.Wrap(err, q)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var v sql.NullString
+			if err := rows.Scan(&v); err != nil {
+				return errors.Wrap(err, "scan")
+			}
+			values := []string{v.String}
+			if split {
+				values = strings.Split(v.String, ",")
+			}
+			for _, s := range values {
+				if id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+					keep[id] = true
+				}
+			}
+		}
+		return errors.Wrap(rows.Err(), q)
+	}
+
+	for _, t := range tables {
+		if t == "recipient" {
+			continue
+		}
+		for _, col := range columns[t] {
+			if slices.Contains(recipientColumns, col) {
+				if err := collect(fmt.Sprintf(`SELECT %s FROM "%s"`, col, t), false); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if slices.Contains(columns["groups"], "members") {
+		if err := collect("SELECT members FROM groups", true); err != nil {
+			return nil, err
+		}
+	}
+	return keep, nil
+}
+
+func tableNames(db *sql.DB) ([]string, error) {
+	q := "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'"
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, q)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		names = append(names, name)
+	}
+	return names, errors.Wrap(rows.Err(), q)
+}
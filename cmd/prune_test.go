@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/backuptest"
+)
+
+// pruneChild is a column whose rows must only point at kept rows of parent.
+type pruneChild struct {
+	table, column, parent string
+}
+
+// TestPruneConsistent prunes each test backup to its first thread, after
+// adding rows that refer to messages of both threads, and checks that nothing
+// left refers to a deleted message or recipient, and that every recipient
+// left is still referred to.
+func TestPruneConsistent(t *testing.T) {
+	eras := []struct {
+		name     string
+		b        *backuptest.Builder
+		setup    []string
+		children []pruneChild
+		refs     string  // every reference to a recipient, as id
+		kept     []int64 // recipients
+	}{
+		{"legacy", backuptest.Legacy(backuptest.WithKDFRounds(1)),
+			[]string{
+				"CREATE TABLE group_receipts (_id INTEGER PRIMARY KEY, mms_id INTEGER, address INTEGER, status INTEGER, timestamp INTEGER)",
+				"INSERT INTO group_receipts VALUES (1, 1, 5, 0, 0), (2, 2, 2, 0, 0)",
+				"INSERT INTO part (_id, mid, seq, ct) VALUES (9, 2, 0, 'image/jpeg')",
+				"INSERT INTO recipient (_id, phone) VALUES (4, '+15550004'), (5, '+15550005')",
+			},
+			[]pruneChild{{"part", "mid", "mms"}, {"group_receipts", "mms_id", "mms"}},
+			"SELECT recipient_id AS id FROM thread UNION SELECT address FROM sms UNION SELECT address FROM mms UNION SELECT address FROM group_receipts",
+			[]int64{1, 5}},
+		{"unified", backuptest.Unified(backuptest.WithKDFRounds(1)),
+			[]string{
+				"CREATE TABLE group_receipts (_id INTEGER PRIMARY KEY, message_id INTEGER, recipient_id INTEGER, status INTEGER, timestamp INTEGER)",
+				"INSERT INTO group_receipts VALUES (1, 3, 2, 0, 0), (2, 1, 5, 0, 0)",
+				"INSERT INTO attachment (_id, message_id, data_size, content_type) VALUES (8, 3, 4, 'text/plain')",
+				"INSERT INTO reaction VALUES (2, 3, 3, '👎', 1600000003800)",
+				"INSERT INTO recipient (_id, e164) VALUES (4, '+15550004'), (5, '+15550005')",
+			},
+			[]pruneChild{{"attachment", "message_id", "message"}, {"reaction", "message_id", "message"}, {"group_receipts", "message_id", "message"}},
+			"SELECT recipient_id AS id FROM thread UNION SELECT from_recipient_id FROM message UNION SELECT to_recipient_id FROM message" +
+				" UNION SELECT author_id FROM reaction UNION SELECT recipient_id FROM group_receipts UNION SELECT recipient_id FROM groups",
+			[]int64{1, 2, 5}},
+	}
+	app := cli.NewApp()
+	app.Commands = []cli.Command{Prune}
+
+	for _, era := range eras {
+		t.Run(era.name, func(t *testing.T) {
+			input := filepath.Join(extractBackup(t, era.b), filenameDB)
+			db, err := sql.Open("sqlite", input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range era.setup {
+				if _, err := db.Exec(q); err != nil {
+					t.Fatalf("%s: %v", q, err)
+				}
+			}
+			db.Close()
+
+			output := filepath.Join(t.TempDir(), "pruned.db")
+			if err := app.Run([]string{"signal-back", "prune", "-q", "--thread", "1", "-o", output, input}); err != nil {
+				t.Fatal(err)
+			}
+			db, err = sql.Open("sqlite", output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			ids := func(q string) []int64 {
+				t.Helper()
+				rows, err := db.Query(q)
+				if err != nil {
+					t.Fatalf("%s: %v", q, err)
+				}
+				defer rows.Close()
+				var ids []int64
+				for rows.Next() {
+					var id sql.NullInt64
+					if err := rows.Scan(&id); err != nil {
+						t.Fatal(err)
+					}
+					if id.Valid {
+						ids = append(ids, id.Int64)
+					}
+				}
+				if err := rows.Err(); err != nil {
+					t.Fatal(err)
+				}
+				return ids
+			}
+
+			for _, c := range era.children {
+				q := "SELECT " + c.column + " FROM " + c.table
+				if len(ids(q)) == 0 {
+					t.Errorf("%s: no rows left to check", c.table)
+				}
+				if dangling := ids(q + " WHERE " + c.column + " NOT IN (SELECT _id FROM " + c.parent + ")"); len(dangling) > 0 {
+					t.Errorf("%s.%s refers to deleted %s rows %v", c.table, c.column, c.parent, dangling)
+				}
+			}
+
+			kept := ids("SELECT _id FROM recipient ORDER BY _id")
+			if refs := ids("SELECT id FROM (" + era.refs + ") WHERE id IS NOT NULL ORDER BY id"); !reflect.DeepEqual(kept, refs) {
+				t.Errorf("recipients kept = %v, want those referred to, %v", kept, refs)
+			}
+			if !reflect.DeepEqual(kept, era.kept) {
+				t.Errorf("recipients kept = %v, want %v", kept, era.kept)
+			}
+		})
+	}
+}
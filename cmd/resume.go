@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/types"
+)
+
+// progressFileName is the state file an extraction keeps in the output
+// directory so that --resume can pick up after it is interrupted.
+const progressFileName = ".signal-back-progress"
+
+// progressSaveInterval is the least time between writes of the state file.
+const progressSaveInterval = 2 * time.Second
+
+// backupIdentity tells one backup from another: the salt and IV are chosen
+// afresh for every backup Signal makes.
+type backupIdentity struct {
+	Size int64  `json:"size"`
+	Salt string `json:"salt"`
+	IV   string `json:"iv"`
+}
+
+func identifyBackup(bf *types.BackupFile) backupIdentity {
+	return backupIdentity{bf.FileSize, hex.EncodeToString(bf.Salt), hex.EncodeToString(bf.IV)}
+}
+
+// resumedAttachment is an attachment, avatar or sticker file that an earlier
+// run finished writing.
+type resumedAttachment struct {
+	Path   string `json:"path"` // relative to the output directory
+	Mime   string `json:"mime,omitempty"`
+	Length uint32 `json:"length"` // of the frame
+	Size   int64  `json:"size,omitempty"` // of the file, if not Length, as for a converted sticker
+}
+
+// resumeState is what the state file records. Frame, Offset and Counter are the
+// frame number, file position and cipher counter of the last attachment frame
+// written, which a resumed run checks as it passes that frame again. They are
+// not used to seek there: the database is rebuilt from every statement, so a
+// resumed run reads the whole backup and only skips writing the files listed.
+type resumeState struct {
+	Backup      backupIdentity               `json:"backup"`
+	Frame       int64                        `json:"frame"`
+	Offset      int64                        `json:"offset"`
+	Counter     uint32                       `json:"counter"`
+	Attachments map[int64]resumedAttachment  `json:"attachments"`
+	Avatars     map[string]resumedAttachment `json:"avatars"` // by recipient id
+	Stickers    map[int64]resumedAttachment  `json:"stickers"`
+
+	saved time.Time
+}
+
+func newResumeState(backup backupIdentity) *resumeState {
+	return &resumeState{
+		Backup:      backup,
+		Attachments: make(map[int64]resumedAttachment),
+		Avatars:     make(map[string]resumedAttachment),
+		Stickers:    make(map[int64]resumedAttachment),
+	}
+}
+
+// count returns the number of files the state lists.
+func (s *resumeState) count() int {
+	return len(s.Attachments) + len(s.Avatars) + len(s.Stickers)
+}
+
+// loadResumeState reads the state file at pathName, returning nil if there is
+// none. A state file from another backup is an error.
+func loadResumeState(pathName string, backup backupIdentity) (*resumeState, error) {
+	b, err := os.ReadFile(pathName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to read progress file")
+	}
+	state := newResumeState(backupIdentity{})
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, errors.Wrap(err, "unable to read progress file")
+	}
+	if state.Backup != backup {
+		return nil, errors.Errorf("%s was written for a different backup; remove it to start afresh", pathName)
+	}
+	return state, nil
+}
+
+// attachment returns the file an earlier run wrote for attachment id, if it is
+// still there and complete. A file is complete if its size is that declared by
+// the SQL row, when declared is positive, or else the frame length.
+func (s *resumeState) attachment(base string, id int64, length uint32, declared int64) (resumedAttachment, bool) {
+	if s == nil {
+		return resumedAttachment{}, false
+	}
+	r, ok := s.Attachments[id]
+	return r, ok && r.complete(base, length, declared)
+}
+
+// avatar returns the file an earlier run wrote for the avatar of recipient id,
+// if it is still there and complete.
+func (s *resumeState) avatar(base string, id string, length uint32) (resumedAttachment, bool) {
+	if s == nil {
+		return resumedAttachment{}, false
+	}
+	r, ok := s.Avatars[id]
+	return r, ok && r.complete(base, length, 0)
+}
+
+// sticker returns the file an earlier run wrote for sticker id, if it is still
+// there and complete, as for attachment.
+func (s *resumeState) sticker(base string, id int64, length uint32, declared int64) (resumedAttachment, bool) {
+	if s == nil {
+		return resumedAttachment{}, false
+	}
+	r, ok := s.Stickers[id]
+	return r, ok && r.complete(base, length, declared)
+}
+
+// complete reports whether r was written from a frame of length bytes, and its
+// file is still there with the size expected of it.
+func (r resumedAttachment) complete(base string, length uint32, declared int64) bool {
+	if r.Length != length {
+		return false
+	}
+	size := r.Size
+	if size == 0 {
+		size = int64(length)
+		if declared > 0 {
+			size = declared
+		}
+	}
+	info, err := os.Stat(filepath.Join(base, r.Path))
+	return err == nil && info.Size() == size
+}
+
+// save writes the state to pathName, at most every progressSaveInterval
+// unless force is set.
+func (s *resumeState) save(pathName string, force bool) error {
+	if now := time.Now(); force || now.Sub(s.saved) >= progressSaveInterval {
+		s.saved = now
+	} else {
+		return nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "progress file")
+	}
+	file, err := createTemp(pathName)
+	if err != nil {
+		return errors.Wrap(err, "progress file")
+	}
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return errors.Wrap(err, "progress file")
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return errors.Wrap(err, "progress file")
+	}
+	return errors.Wrap(os.Rename(file.Name(), pathName), "progress file")
+}
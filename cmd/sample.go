@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"math/rand"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/xeals/signal-back/types/message"
+)
+
+// sampleIndices picks up to n items for a small export that still covers each
+// kind of message. kinds holds the kind of every item; items are taken from
+// each kind in turn, earliest first, and returned in their original order.
+func sampleIndices(kinds []int, n int) []int {
+	byKind := map[int][]int{}
+	var order []int
+	for i, k := range kinds {
+		if _, ok := byKind[k]; !ok {
+			order = append(order, k)
+		}
+		byKind[k] = append(byKind[k], i)
+	}
+
+	picked := make([]bool, len(kinds))
+	for count := 0; count < n && count < len(kinds); {
+		for _, k := range order {
+			if count == n || len(byKind[k]) == 0 {
+				continue
+			}
+			picked[byKind[k][0]] = true
+			byKind[k] = byKind[k][1:]
+			count++
+		}
+	}
+
+	var result []int
+	for i, p := range picked {
+		if p {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// Kinds of message that a sample should include.
+const (
+	sampleIncoming = iota
+	sampleOutgoing
+	sampleGroup
+	sampleAttachment
+	sampleControl
+	sampleSMS
+	sampleMMSText
+)
+
+// sampleMessages cuts m down to n representative messages.
+func sampleMessages(m []message.Message, n int) []message.Message {
+	kinds := make([]int, len(m))
+	for i, msg := range m {
+		switch {
+		case isEmptyMessage(msg):
+			kinds[i] = sampleControl
+		case len(msg.AttachmentList.Attachments) > 0:
+			kinds[i] = sampleAttachment
+		case msg.GroupName != nil:
+			kinds[i] = sampleGroup
+		case msg.Type == message.SMSSent:
+			kinds[i] = sampleOutgoing
+		default:
+			kinds[i] = sampleIncoming
+		}
+	}
+
+	sample := []message.Message{}
+	for _, i := range sampleIndices(kinds, n) {
+		sample = append(sample, m[i])
+	}
+	return sample
+}
+
+// sampleSynctech cuts the SMS and MMS lists down to n representative messages in total.
+func sampleSynctech(smses *message.SMSes, n int) {
+	kinds := make([]int, 0, len(smses.SMS)+len(smses.MMS))
+	for _, sms := range smses.SMS {
+		if sms.Body == "" {
+			kinds = append(kinds, sampleControl)
+		} else {
+			kinds = append(kinds, sampleSMS)
+		}
+	}
+	for _, mms := range smses.MMS {
+		if mms.TextOnly != 0 {
+			kinds = append(kinds, sampleMMSText)
+		} else {
+			kinds = append(kinds, sampleAttachment)
+		}
+	}
+
+	sms, mms := []message.SMS{}, []message.MMS{}
+	for _, i := range sampleIndices(kinds, n) {
+		if i < len(smses.SMS) {
+			sms = append(sms, smses.SMS[i])
+		} else {
+			mms = append(mms, smses.MMS[i-len(smses.SMS)])
+		}
+	}
+	smses.SMS, smses.MMS = sms, mms
+}
+
+// redactText replaces letters with 'x' and digits with '0', keeping the
+// length, spacing and punctuation that formatting bugs tend to depend on.
+func redactText(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r):
+			return 'x'
+		case unicode.IsDigit(r):
+			return '0'
+		}
+		return r
+	}, s)
+}
+
+// mapMessageText replaces the text of message bodies, including edits, with f(text).
+func mapMessageText(m []message.Message, f func(string) string) {
+	for i := range m {
+		m[i].Body = mapPtr(m[i].Body, f)
+		for j := range m[i].Edits {
+			m[i].Edits[j].Body = mapPtr(m[i].Edits[j].Body, f)
+		}
+	}
+}
+
+// mapSynctechText replaces the text of SMS bodies, MMS text parts and subjects with f(text).
+func mapSynctechText(smses *message.SMSes, f func(string) string) {
+	for i := range smses.SMS {
+		smses.SMS[i].Body = f(smses.SMS[i].Body)
+		smses.SMS[i].Subject = mapPtr(smses.SMS[i].Subject, f)
+	}
+	for i := range smses.MMS {
+		mms := &smses.MMS[i]
+		if mms.Sub != "null" {
+			mms.Sub = f(mms.Sub)
+		}
+		for j := range mms.PartList.Parts {
+			if part := &mms.PartList.Parts[j]; part.Ct == "text/plain" {
+				part.Text = f(part.Text)
+			}
+		}
+	}
+}
+
+func mapPtr(s *string, f func(string) string) *string {
+	if s == nil {
+		return nil
+	}
+	r := f(*s)
+	return &r
+}
+
+// attachmentSample chooses which attachments to write for --sample-attachments.
+// Without a random source it keeps the first n. With one it keeps a uniform
+// random n by reservoir sampling: the number of attachments is unknown until
+// the stream ends, so a file already written may be removed to make room.
+type attachmentSample struct {
+	n       int
+	rng     *rand.Rand
+	seen    int
+	kept    []string
+	dropped map[string]bool
+}
+
+func newAttachmentSample(n int, rng *rand.Rand) *attachmentSample {
+	return &attachmentSample{n: n, rng: rng, dropped: make(map[string]bool)}
+}
+
+// pick reports whether the next attachment should be written, and the slot
+// to pass to keep once it has been.
+func (s *attachmentSample) pick() (int, bool) {
+	s.seen++
+	if s.seen <= s.n {
+		return s.seen - 1, true
+	}
+	if s.rng == nil {
+		return 0, false
+	}
+	if j := s.rng.Intn(s.seen); j < s.n {
+		return j, true
+	}
+	return 0, false
+}
+
+// unpick undoes the last pick, for an attachment that was filtered out after
+// all, so that it does not count towards the sample.
+func (s *attachmentSample) unpick() {
+	if s != nil {
+		s.seen--
+	}
+}
+
+// keep records the file written for slot, removing the one it replaces.
+func (s *attachmentSample) keep(slot int, pathName string) error {
+	if slot < len(s.kept) {
+		old := s.kept[slot]
+		if err := os.Remove(old); err != nil {
+			return err
+		}
+		s.dropped[old] = true
+		s.kept[slot] = pathName
+		return nil
+	}
+	s.kept = append(s.kept, pathName)
+	return nil
+}
+
+// isDropped reports whether pathName was written and then removed again.
+func (s *attachmentSample) isDropped(pathName string) bool {
+	return s != nil && s.dropped[pathName]
+}
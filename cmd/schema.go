@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"database/sql"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/types"
+)
+
+type schemaEntry struct {
+	kind, name, table, sql string
+}
+
+// Schema writes the CREATE statement of every table, ordered so that each
+// table comes after the tables its foreign keys reference. With all set, the
+// indexes, triggers and views follow, each after the table it belongs to.
+func Schema(db *sql.DB, out io.Writer, all bool) error {
+	q := "SELECT type, name, tbl_name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid"
+	rows, err := db.Query(q)
+	if err != nil {
+		return errors.Wrap(err, q)
+	}
+	defer rows.Close()
+
+	var tables, others []schemaEntry
+	for rows.Next() {
+		var e schemaEntry
+		if err := rows.Scan(&e.kind, &e.name, &e.table, &e.sql); err != nil {
+			return errors.Wrap(err, "scan")
+		}
+		if e.kind == "table" {
+			tables = append(tables, e)
+		} else if all {
+			others = append(others, e)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, q)
+	}
+	rows.Close()
+
+	tables, err = dependencyOrder(db, tables)
+	if err != nil {
+		return err
+	}
+
+	w := types.NewMultiWriter(out)
+	for _, t := range tables {
+		w.W([]byte(t.sql + ";\n"))
+		for _, o := range others {
+			if o.table == t.name && o.kind != "view" {
+				w.W([]byte(o.sql + ";\n"))
+			}
+		}
+	}
+	// Views may read from any table, so they come once all tables exist
+	for _, o := range others {
+		if o.kind == "view" {
+			w.W([]byte(o.sql + ";\n"))
+		}
+	}
+	return errors.WithMessage(w.Error(), "failed to write out schema")
+}
+
+// dependencyOrder sorts tables so that each follows the tables it references,
+// otherwise keeping their order. Tables in a reference cycle keep their order.
+func dependencyOrder(db *sql.DB, tables []schemaEntry) ([]schemaEntry, error) {
+	known := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		known[t.name] = true
+	}
+	refs := make(map[string][]string)
+	for _, t := range tables {
+		q := "SELECT DISTINCT \"table\" FROM pragma_foreign_key_list(?)"
+		rows, err := db.Query(q, t.name)
+		if err != nil {
+			return nil, errors.Wrap(err, q)
+		}
+		for rows.Next() {
+			var ref string
+			if err := rows.Scan(&ref); err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "scan")
+			}
+			if known[ref] && ref != t.name {
+				refs[t.name] = append(refs[t.name], ref)
+			}
+		}
+		rows.Close()
+	}
+
+	sorted := make([]schemaEntry, 0, len(tables))
+	done := make(map[string]bool, len(tables))
+	visiting := make(map[string]bool)
+	byName := make(map[string]schemaEntry, len(tables))
+	for _, t := range tables {
+		byName[t.name] = t
+	}
+	var visit func(t schemaEntry)
+	visit = func(t schemaEntry) {
+		if done[t.name] || visiting[t.name] {
+			return
+		}
+		visiting[t.name] = true
+		for _, ref := range refs[t.name] {
+			visit(byName[ref])
+		}
+		visiting[t.name] = false
+		done[t.name] = true
+		sorted = append(sorted, t)
+	}
+	for _, t := range tables {
+		visit(t)
+	}
+	return sorted, nil
+}
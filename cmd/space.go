@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// checkOutputDir fails early if dir cannot be written to, or if its file
+// system has less than need bytes free, rather than after decrypting part of
+// the backup. Free space is not checked where it cannot be measured.
+func checkOutputDir(dir string, need int64) error {
+	if dir == "" {
+		dir = "."
+	}
+	probe, err := createTemp(filepath.Join(dir, "signal-back-probe"))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("output directory %s is not writable", dir))
+	}
+	_, err = probe.Write([]byte{0})
+	if cerr := probe.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(probe.Name())
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("output directory %s is not writable", dir))
+	}
+
+	have, ok, err := freeSpace(dir)
+	if err != nil {
+		return errors.Wrap(err, "unable to measure free space")
+	}
+	if ok && have < need {
+		return errors.Errorf("insufficient space in %s: need ~%s, have %s (use --no-space-check if fewer files will be written)",
+			dir, byteCount(need), byteCount(have))
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package cmd
+
+// freeSpace cannot measure free space on this platform.
+func freeSpace(dir string) (int64, bool, error) {
+	return 0, false, nil
+}
@@ -1,14 +1,18 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/logging"
 	"github.com/xeals/signal-back/types"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -46,19 +50,38 @@ var coreFlags = []cli.Flag{
 		Name:  "pwdfile, P",
 		Usage: "read password from `FILE`",
 	},
+	&cli.BoolFlag{
+		Name:  "no-password",
+		Usage: "the backup file has no password; do not prompt for one\n\t\t" +
+		       "(same as --password \"\")",
+	},
 	&cli.BoolFlag{
 		Name:  "verbose, v",
 		Usage: "enable verbose logging output",
 	},
+	&cli.BoolFlag{
+		Name:  "quiet, q",
+		Usage: "suppress all output except errors",
+	},
+	&cli.StringFlag{
+		Name:  "log-level",
+		Usage: "write log lines of `LEVEL` and above: debug, info, warn or error\n\t\t" +
+		       "(default error; --verbose is the same as debug)",
+	},
+	&cli.BoolFlag{
+		Name:  "log-json",
+		Usage: "write each log line as a JSON object",
+	},
+	&cli.IntFlag{
+		Name:  "kdf-rounds",
+		Usage: "derive the key with `N` rounds, for backups made by Signal forks",
+		Value: types.DefaultKDFRounds,
+	},
 }
 
 func setup(c *cli.Context) (*types.BackupFile, error) {
-	// -- Enable logging
-
-	if c.Bool("verbose") {
-		log.SetOutput(os.Stderr)
-	} else {
-		log.SetOutput(ioutil.Discard)
+	if err := setupLogging(c); err != nil {
+		return nil, err
 	}
 
 	// -- Verify
@@ -74,18 +97,71 @@ func setup(c *cli.Context) (*types.BackupFile, error) {
 		return nil, errors.Wrap(err, "unable to read password")
 	}
 
-	bf, err := types.NewBackupFile(c.Args().Get(0), pass)
+	return openBackup(c, c.Args().Get(0), pass)
+}
+
+func setupLogging(c *cli.Context) error {
+	if c.Bool("verbose") && c.Bool("quiet") {
+		return errors.New("--verbose and --quiet cannot be used together")
+	}
+	level := logging.Error
+	if c.Bool("verbose") {
+		level = logging.Debug
+	}
+	if s := c.String("log-level"); s != "" {
+		if c.Bool("verbose") {
+			return errors.New("--verbose and --log-level cannot be used together")
+		}
+		var err error
+		if level, err = logging.ParseLevel(s); err != nil {
+			return err
+		}
+	}
+	logging.Configure(os.Stderr, level, c.Bool("log-json"))
+	return nil
+}
+
+// interruptContext returns a context that is cancelled on Ctrl-C (SIGINT),
+// instead of the program being killed, until stop is called.
+func interruptContext() (ctx context.Context, stop context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// status prints a progress line to stdout unless --quiet was given.
+func status(c *cli.Context, a ...interface{}) {
+	if !c.Bool("quiet") {
+		fmt.Println(a...)
+	}
+}
+
+// stdinPath names the backup read from stdin, as in `... | signal-back extract -`.
+const stdinPath = "-"
+
+// openBackup opens the backup at path, or reads it from stdin if path is "-".
+// A backup from stdin cannot be a gzip or zip file, and its size is unknown.
+func openBackup(c *cli.Context, path, pass string) (*types.BackupFile, error) {
+	var (
+		bf  *types.BackupFile
+		err error
+	)
+	if path == stdinPath {
+		bf, err = types.NewBackupFileFromReader(os.Stdin, 0, pass, types.WithKDFRounds(c.Int("kdf-rounds")))
+	} else {
+		bf, err = types.NewBackupFile(path, pass, types.WithKDFRounds(c.Int("kdf-rounds")))
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open backup file")
 	}
-
 	return bf, nil
 }
 
 func readPassword(c *cli.Context) (string, error) {
 	var pass string
 
-	if c.String("password") != "" {
+	if c.Bool("no-password") {
+		pass = ""
+	} else if c.IsSet("password") {
+		// may be empty, for backups made without a passphrase
 		pass = c.String("password")
 	} else if c.String("pwdfile") != "" {
 		bs, err := ioutil.ReadFile(c.String("pwdfile"))
@@ -93,6 +169,8 @@ func readPassword(c *cli.Context) (string, error) {
 			return "", errors.Wrap(err, "unable to read file")
 		}
 		pass = string(bs)
+	} else if slices.Contains(c.Args(), stdinPath) {
+		return "", errors.New("the backup is read from stdin, so give the password with --password, --pwdfile or --no-password")
 	} else {
 		// Read from stdin
 		fmt.Fprint(os.Stderr, "Password: ")
@@ -105,3 +183,18 @@ func readPassword(c *cli.Context) (string, error) {
 	}
 	return pass, nil
 }
+
+// createTemp opens a new temporary file in the same directory as pathName,
+// so that it can later be renamed over pathName in a single step.
+func createTemp(pathName string) (*os.File, error) {
+	file, err := os.CreateTemp(filepath.Dir(pathName), "."+filepath.Base(pathName)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/types/message"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// ValidateXML fulfils the `validate-xml` subcommand.
+var ValidateXML = cli.Command{
+	Name:               "validate-xml",
+	Usage:              "Check an exported XML file against the SMS Backup & Restore format",
+	Description:        "Report every problem that could stop SMS Backup & Restore from importing\n"+
+	                    "the file: missing required attributes, numbers out of range, unknown\n"+
+	                    "message types and boxes, and dates that are not epoch milliseconds.\n"+
+	                    "Output of format --numeric-dates does not pass, as its MMS date_sent\n"+
+	                    "is in milliseconds where SMS Backup & Restore expects seconds.",
+	CustomHelpTemplate: SubcommandHelp,
+	ArgsUsage:          "FILE",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "suppress all output except errors",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return errors.New("must specify an XML file")
+		}
+		file, err := os.Open(c.Args().Get(0))
+		if err != nil {
+			return errors.Wrap(err, "unable to open XML file")
+		}
+		defer file.Close()
+
+		problems := 0
+		messages, err := validateSynctech(file, func(line int, msg string) {
+			problems++
+			if !c.Bool("quiet") {
+				fmt.Printf("line %d: %s\n", line, msg)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if problems > 0 {
+			return errors.Errorf("%d problems in %d messages", problems, messages)
+		}
+		status(c, fmt.Sprintf("%d messages, no problems found", messages))
+		return nil
+	},
+}
+
+// attrRule checks one attribute of an element. check, if set, returns a
+// description of what is wrong with the value, or "" if it is acceptable.
+type attrRule struct {
+	name     string
+	required bool
+	check    func(string) string
+}
+
+// Attribute rules for each element, from the SMS Backup & Restore schema (see
+// xsl/sms.xsd_.txt) and the values its documentation gives for each field.
+var synctechRules = map[string][]attrRule{
+	"smses": {
+		{"count", true, isUnsigned},
+	},
+	"sms": {
+		{"protocol", false, isUnsigned},
+		{"address", true, nil},
+		{"date", true, isMilliseconds},
+		{"type", true, inRange(int64(message.SMSReceived), int64(message.SMSQueued))},
+		{"body", true, nil},
+		{"read", true, inRange(0, 1)},
+		{"status", true, inRange(-128, 127)},
+		{"locked", false, inRange(0, 1)},
+		{"date_sent", false, isMillisecondsOrZero},
+	},
+	"mms": {
+		{"text_only", false, inRange(0, 1)},
+		{"retr_st", true, nil},
+		{"date", true, isMilliseconds},
+		{"ct_cls", true, nil},
+		{"sub_cs", true, nil},
+		{"read", true, inRange(0, 1)},
+		{"ct_l", true, nil},
+		{"tr_id", true, nil},
+		{"st", true, nil},
+		{"msg_box", true, inRange(1, 5)},
+		{"address", true, nil},
+		{"m_cls", true, nil},
+		{"d_tm", true, nil},
+		{"read_status", true, nil},
+		{"ct_t", true, nil},
+		{"retr_txt_cs", true, nil},
+		{"d_rpt", true, isUnsigned},
+		{"m_id", true, nil},
+		{"date_sent", true, isSecondsOrZero},
+		{"seen", true, inRange(0, 1)},
+		{"m_type", true, inRange(int64(message.MMSSendReq), int64(message.MMSMBoxDescr))},
+		{"v", true, isUnsigned},
+		{"exp", true, nil},
+		{"pri", true, isUnsigned},
+		{"rr", true, isUnsigned},
+		{"resp_txt", true, nil},
+		{"rpt_a", true, nil},
+		{"locked", true, inRange(0, 1)},
+		{"retr_txt", true, nil},
+		{"resp_st", true, nil},
+		{"m_size", true, nil},
+	},
+	"part": {
+		{"seq", true, isSigned},
+		{"ct", true, nil},
+		{"name", true, nil},
+		{"chset", true, nil},
+		{"cd", true, nil},
+		{"fn", true, nil},
+		{"cid", true, nil},
+		{"cl", true, nil},
+		{"ctt_s", true, nil},
+		{"ctt_t", true, nil},
+		{"text", true, nil},
+	},
+}
+
+// Elements allowed inside each element.
+var synctechChildren = map[string][]string{
+	"smses": {"sms", "mms"},
+	"mms":   {"parts", "addrs"},
+	"parts": {"part"},
+	"addrs": {"addr"},
+}
+
+// validateSynctech checks an SMS Backup & Restore XML file, passing each problem
+// found to report with its line number. It returns the number of messages read.
+// A file with a byte order mark may be in UTF-16, as format --xml-encoding writes.
+func validateSynctech(r io.Reader, report func(line int, msg string)) (int, error) {
+	dec := xml.NewDecoder(transform.NewReader(r, unicode.BOMOverride(transform.Nop)))
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		// Already decoded from UTF-16 by BOMOverride
+		if strings.EqualFold(label, "utf-16") {
+			return input, nil
+		}
+		return nil, errors.Errorf("unsupported encoding %s", label)
+	}
+	var (
+		stack    []string
+		messages int
+		count    = -1 // from the smses count attribute
+		rootLine int
+		parts    int // in the current mms
+		mmsLine  int
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return messages, errors.Wrap(err, "malformed XML")
+		}
+		line, _ := dec.InputPos()
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if len(stack) == 0 {
+				if name != "smses" {
+					return messages, errors.Errorf("root element is <%s>, not <smses>; only the SMS Backup & Restore format, from backups made in 2022 or earlier, can be validated", name)
+				}
+				rootLine = line
+			} else if parent := stack[len(stack)-1]; !slices.Contains(synctechChildren[parent], name) {
+				report(line, fmt.Sprintf("<%s> is not allowed inside <%s>", name, parent))
+			}
+			stack = append(stack, name)
+
+			attrs := make(map[string]string, len(t.Attr))
+			for _, a := range t.Attr {
+				attrs[a.Name.Local] = a.Value
+			}
+			for _, rule := range synctechRules[name] {
+				value, ok := attrs[rule.name]
+				if !ok {
+					if rule.required {
+						report(line, fmt.Sprintf("%s: missing required attribute %s", name, rule.name))
+					}
+					continue
+				}
+				if rule.check != nil {
+					if problem := rule.check(value); problem != "" {
+						report(line, fmt.Sprintf("%s: %s=%q %s", name, rule.name, value, problem))
+					}
+				}
+			}
+
+			switch name {
+			case "smses":
+				if n, err := strconv.Atoi(attrs["count"]); err == nil {
+					count = n
+				}
+			case "sms", "mms":
+				messages++
+				parts, mmsLine = 0, line
+			case "part":
+				parts++
+			}
+
+		case xml.EndElement:
+			name := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if name == "mms" && parts == 0 {
+				report(mmsLine, "mms: has no <part>")
+			}
+		}
+	}
+
+	if count >= 0 && count != messages {
+		report(rootLine, fmt.Sprintf("smses: count=\"%d\" but there are %d messages", count, messages))
+	}
+	return messages, nil
+}
+
+func isUnsigned(s string) string {
+	if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+		return "is not a whole number"
+	}
+	return ""
+}
+
+func isSigned(s string) string {
+	if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+		return "is not a whole number"
+	}
+	return ""
+}
+
+func inRange(min, max int64) func(string) string {
+	return func(s string) string {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "is not a whole number"
+		}
+		if n < min || n > max {
+			return fmt.Sprintf("is not between %d and %d", min, max)
+		}
+		return ""
+	}
+}
+
+// Epoch times from 2001 to 2286 have 13 digits in milliseconds, and 10 in seconds.
+const (
+	minMilliseconds = 1000000000000
+	maxMilliseconds = 9999999999999
+	minSeconds      = minMilliseconds / 1000
+	maxSeconds      = maxMilliseconds / 1000
+)
+
+func isMilliseconds(s string) string {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "is not a whole number"
+	}
+	if n >= minSeconds && n <= maxSeconds {
+		return "looks like seconds, not milliseconds"
+	}
+	if n < minMilliseconds || n > maxMilliseconds {
+		return "is not a plausible date in milliseconds"
+	}
+	return ""
+}
+
+func isMillisecondsOrZero(s string) string {
+	if s == "0" {
+		return ""
+	}
+	return isMilliseconds(s)
+}
+
+// isSecondsOrZero checks an MMS date_sent, which SMS Backup & Restore keeps in seconds.
+func isSecondsOrZero(s string) string {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "is not a whole number"
+	}
+	if n >= minMilliseconds {
+		return "looks like milliseconds, not seconds"
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/internal/backuptest"
+)
+
+// validate runs validateSynctech on doc, returning each problem reported as
+// "line N: message".
+func validate(t *testing.T, doc string) []string {
+	t.Helper()
+	var problems []string
+	_, err := validateSynctech(strings.NewReader(doc), func(line int, msg string) {
+		problems = append(problems, fmt.Sprintf("line %d: %s", line, msg))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return problems
+}
+
+func TestValidateGolden(t *testing.T) {
+	doc, err := os.ReadFile(filepath.Join("..", "internal", "golden", "testdata", "legacy", "messages.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := validate(t, string(doc)); len(problems) > 0 {
+		t.Errorf("golden messages.xml has problems:\n%s", strings.Join(problems, "\n"))
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	const sms = `protocol="0" address="+15551234" type="1" body="hi" read="1" status="-1"`
+	mms := func(msgBox string) string {
+		return `text_only="1" retr_st="null" date="1600000004500" ct_cls="null" sub_cs="null" read="1" ct_l="null" tr_id="null" st="null" ` +
+			`msg_box="` + msgBox + `" address="+15559999" m_cls="personal" d_tm="null" read_status="null" ct_t="application/vnd.wap.multipart.related" ` +
+			`retr_txt_cs="null" d_rpt="0" m_id="2" date_sent="1600000004" seen="1" m_type="128" v="18" exp="null" pri="0" rr="0" resp_txt="null" ` +
+			`rpt_a="null" locked="0" retr_txt="null" resp_st="null" m_size="4"`
+	}
+	const part = `<parts><part seq="0" ct="text/plain" name="null" chset="106" cd="null" fn="null" cid="null" cl="null" ctt_s="null" ctt_t="null" text="mine"/></parts>`
+
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"valid",
+			"<smses count=\"2\">\n" +
+				"<sms " + sms + ` date="1600000001000"/>` + "\n" +
+				"<mms " + mms("2") + ">" + part + "</mms>\n" +
+				"</smses>",
+			nil},
+		{"missing attribute",
+			"<smses count=\"1\">\n" +
+				"\n" +
+				`<sms protocol="0" address="+15551234" date="1600000001000" type="1" read="1" status="-1"/>` + "\n" +
+				"</smses>",
+			[]string{"line 3: sms: missing required attribute body"}},
+		{"bad msg_box",
+			"<smses count=\"1\">\n" +
+				"<mms " + mms("7") + ">" + part + "</mms>\n" +
+				"</smses>",
+			[]string{`line 2: mms: msg_box="7" is not between 1 and 5`}},
+		{"seconds for milliseconds",
+			"<smses count=\"2\">\n" +
+				"<sms " + sms + ` date="1600000001000"/>` + "\n" +
+				"<sms " + sms + ` date="1600000001"/>` + "\n" +
+				"</smses>",
+			[]string{`line 3: sms: date="1600000001" looks like seconds, not milliseconds`}},
+		{"wrong count",
+			"\n" +
+				"<smses count=\"3\">\n" +
+				"<sms " + sms + ` date="1600000001000"/>` + "\n" +
+				"</smses>",
+			[]string{`line 2: smses: count="3" but there are 1 messages`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validate(t, tt.doc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestValidateNumericDates checks that --numeric-dates output fails, as it is
+// meant to: its MMS date_sent is in milliseconds, where SMS Backup & Restore
+// expects seconds.
+func TestValidateNumericDates(t *testing.T) {
+	out := extractBackup(t, backuptest.Legacy(backuptest.WithKDFRounds(1)))
+	app := cli.NewApp()
+	app.Commands = []cli.Command{Format}
+	for _, numeric := range []bool{false, true} {
+		xmlPath := filepath.Join(t.TempDir(), "messages.xml")
+		args := []string{"signal-back", "format", "-q", "-o", xmlPath}
+		if numeric {
+			args = append(args, "--numeric-dates")
+		}
+		if err := app.Run(append(args, filepath.Join(out, filenameDB))); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := os.ReadFile(xmlPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems := validate(t, string(doc))
+		if !numeric {
+			if len(problems) > 0 {
+				t.Errorf("without --numeric-dates: %q", problems)
+			}
+			continue
+		}
+		if len(problems) != 2 {
+			t.Errorf("with --numeric-dates: %d problems, want one for each MMS: %q", len(problems), problems)
+		}
+		for _, p := range problems {
+			if !strings.Contains(p, "mms: date_sent=") || !strings.HasSuffix(p, "looks like milliseconds, not seconds") {
+				t.Errorf("with --numeric-dates: %s", p)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/types/message"
+)
+
+// VCard writes the contacts in the recipient table as vCard 3.0 cards, one per
+// phone number, for importing into an address book. Groups are left out, as
+// are recipients with neither a name nor a number. Of the recipients sharing
+// a number, the first with a name is kept.
+func VCard(db *sql.DB, out io.Writer, opt FormatOptions) error {
+	recipients, err := vcardRecipients(db)
+	if err != nil {
+		return err
+	}
+
+	var cards []message.DbCorrespondent
+	byPhone := make(map[string]int) // index in cards
+	for _, r := range recipients {
+		if r.GroupId.Valid || (!r.E164.Valid && message.CorrespondentName(r) == nil) {
+			continue
+		}
+		if !r.E164.Valid || r.E164.String == "" {
+			cards = append(cards, r)
+			continue
+		}
+		if i, ok := byPhone[r.E164.String]; ok {
+			if vcardName(cards[i]) == "" && vcardName(r) != "" {
+				cards[i] = r
+			}
+			continue
+		}
+		byPhone[r.E164.String] = len(cards)
+		cards = append(cards, r)
+	}
+	if opt.Limit >= 0 && opt.Limit < len(cards) {
+		cards = cards[:opt.Limit]
+	}
+
+	w := bufio.NewWriter(out)
+	for _, r := range cards {
+		name := vcardName(r)
+		fn := name
+		if fn == "" {
+			fn = r.E164.String
+		}
+		writeVCardLine(w, "BEGIN:VCARD")
+		writeVCardLine(w, "VERSION:3.0")
+		writeVCardLine(w, "FN:"+vcardEscape(fn))
+		writeVCardLine(w, "N:;"+vcardEscape(name)+";;;")
+		if r.E164.Valid && r.E164.String != "" {
+			writeVCardLine(w, "TEL;TYPE=CELL:"+vcardEscape(r.E164.String))
+		}
+		writeVCardLine(w, "END:VCARD")
+	}
+	return errors.Wrap(w.Flush(), "failed to write out vCard")
+}
+
+// vcardRecipients reads the recipient table of either schema era.
+func vcardRecipients(db *sql.DB) ([]message.DbCorrespondent, error) {
+	var recipients []message.DbCorrespondent
+	current, err := HasColumn(db, "recipient", "e164")
+	if err != nil {
+		return nil, errors.Wrap(err, "vcard recipient columns")
+	}
+	if current {
+		rows, err := SelectStructFromTable(db, message.DbCorrespondent{}, "recipient")
+		if err != nil {
+			return nil, errors.Wrap(err, "vcard select recipient")
+		}
+		for _, row := range rows {
+			recipients = append(recipients, *row.(*message.DbCorrespondent))
+		}
+		return recipients, nil
+	}
+
+	rows, err := SelectStructFromTable(db, message.DbRecipient{}, "recipient")
+	if err != nil {
+		return nil, errors.Wrap(err, "vcard select recipient")
+	}
+	for _, row := range rows {
+		r := row.(*message.DbRecipient)
+		recipients = append(recipients, message.DbCorrespondent{
+			ID:                r.ID,
+			E164:              r.Phone,
+			GroupId:           r.GroupId,
+			SystemJoinedName:  r.SystemDisplayName,
+			ProfileJoinedName: r.SignalProfileName,
+		})
+	}
+	return recipients, nil
+}
+
+// vcardName is the contact's name from the address book, or else from their
+// Signal profile, or "" if they have neither.
+func vcardName(r message.DbCorrespondent) string {
+	for _, ns := range []sql.NullString{r.SystemJoinedName, r.ProfileJoinedName} {
+		if name := strings.TrimSpace(stringPtr(message.NamePtr(ns))); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// vcardEscape escapes a text value as RFC 2426 requires.
+func vcardEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// writeVCardLine writes a content line, folded into lines of at most 75
+// bytes without splitting a character.
+func writeVCardLine(w *bufio.Writer, line string) {
+	const limit = 75
+	for first := true; ; first = false {
+		max := limit
+		if !first {
+			max-- // the leading space
+			w.WriteByte(' ')
+		}
+		if len(line) <= max {
+			break
+		}
+		cut := max
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n")
+		line = line[cut:]
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// threadName resolves the thread aliased `t` to a display name, preferring
+// the group title, then the names of the single recipient.
+const threadName = `COALESCE(g.title, r.system_joined_name, r.profile_joined_name, r.e164)`
+
+const threadJoins = `
+	LEFT JOIN thread t ON t._id = x.thread_id
+	LEFT JOIN recipient r ON r._id = t.recipient_id
+	LEFT JOIN groups g ON g.recipient_id = t.recipient_id`
+
+// Views are extra --table names that are assembled from other tables.
+// Drafts have no timestamps of their own, so those columns are null.
+var views = map[string]struct {
+	requires [][2]string // table and column that must exist
+	query    string
+}{
+	"draft": {
+		requires: [][2]string{{"drafts", "thread_id"}, {"drafts", "value"}},
+		query: `SELECT x._id, x.thread_id, ` + threadName + ` AS name, x.type, x.value AS body,
+	NULL AS created, NULL AS scheduled_for
+	FROM drafts x` + threadJoins,
+	},
+	"scheduled": {
+		requires: [][2]string{{"message", "scheduled_date"}},
+		query: `SELECT x._id, x.thread_id, ` + threadName + ` AS name, x.body,
+	x.date_received AS created, x.scheduled_date AS scheduled_for
+	FROM message x` + threadJoins + `
+	WHERE x.scheduled_date > 0`,
+	},
+}
+
+// tableSource returns what to select from for the named table: either the
+// table itself or, for a view, a subquery. A view whose source tables are
+// missing from this Signal version is reported as an error.
+func tableSource(db *sql.DB, table string) (string, error) {
+	view, ok := views[table]
+	if !ok {
+		return table, nil
+	}
+	for _, req := range append(view.requires, [][2]string{{"thread", "recipient_id"}, {"recipient", "e164"}, {"groups", "title"}}...) {
+		has, err := HasColumn(db, req[0], req[1])
+		if err != nil {
+			return "", errors.Wrap(err, table)
+		}
+		if !has {
+			missing := req[0] + "." + req[1] + " column"
+			if has, _ := HasTable(db, req[0]); !has {
+				missing = req[0] + " table"
+			}
+			return "", errors.Errorf("'%s' is not available: this database has no %s", table, missing)
+		}
+	}
+	return "(" + view.query + ")", nil
+}
+
+// projectColumns narrows source, as returned by tableSource, to the given
+// columns in the given order. Each column is first checked to exist in table.
+func projectColumns(db *sql.DB, table string, source string, columns []string) (string, error) {
+	var viewColumns []string
+	if _, ok := views[table]; ok {
+		var err error
+		if viewColumns, err = TableColumns(db, source); err != nil {
+			return "", errors.Wrap(err, table)
+		}
+	}
+
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		var has bool
+		if viewColumns != nil {
+			has = slices.Contains(viewColumns, column)
+		} else {
+			var err error
+			if has, err = HasColumn(db, table, column); err != nil {
+				return "", errors.Wrap(err, table)
+			}
+		}
+		if !has {
+			return "", errors.Errorf("table '%s' has no column '%s'", table, column)
+		}
+		quoted = append(quoted, `"`+strings.ReplaceAll(column, `"`, `""`)+`"`)
+	}
+	return "(SELECT " + strings.Join(quoted, ", ") + " FROM " + source + ")", nil
+}
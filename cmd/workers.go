@@ -0,0 +1,120 @@
+package cmd
+
+import "sync"
+
+// workerPool runs the file work of extraction, such as detecting file types
+// and setting timestamps, on up to n goroutines while the backup is still
+// being read. Each job may have a follow-up, which runs on the reading
+// goroutine in the order the jobs were submitted, so that names, indexes and
+// the resume state come out the same whatever the number of workers.
+type workerPool struct {
+	n     int
+	jobs  chan *poolJob
+	queue []*poolJob // submitted, follow-up not yet run
+	wg    sync.WaitGroup
+}
+
+type poolJob struct {
+	work func() error
+	then func() error
+	done chan struct{}
+	err  error
+}
+
+// newWorkerPool starts n workers. With n of 1 or less there are none, and
+// each job runs as soon as it is submitted.
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{n: n}
+	if n <= 1 {
+		return p
+	}
+	// The workers keep their own copy, since close clears p.jobs
+	jobs := make(chan *poolJob)
+	p.jobs = jobs
+	for i := 0; i < n; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range jobs {
+				j.err = j.work()
+				close(j.done)
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues work, either of which may be nil, and runs the follow-ups of
+// any jobs that have finished. It returns the first error of those.
+func (p *workerPool) submit(work, then func() error) error {
+	if p.jobs == nil {
+		if work != nil {
+			if err := work(); err != nil {
+				return err
+			}
+		}
+		if then != nil {
+			return then()
+		}
+		return nil
+	}
+
+	j := &poolJob{work: work, then: then, done: make(chan struct{})}
+	if work == nil {
+		close(j.done)
+	} else {
+		p.jobs <- j
+	}
+	p.queue = append(p.queue, j)
+
+	// Keep the follow-ups from falling far behind a slow job
+	for len(p.queue) > 2*p.n {
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+	return p.drain(false)
+}
+
+// drain runs the follow-ups of the jobs that have finished, in order, stopping
+// at the first that has not. With wait set, it waits for every job.
+func (p *workerPool) drain(wait bool) error {
+	for len(p.queue) > 0 {
+		if !wait {
+			select {
+			case <-p.queue[0].done:
+			default:
+				return nil
+			}
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next waits for the oldest job and runs its follow-up.
+func (p *workerPool) next() error {
+	j := p.queue[0]
+	p.queue = p.queue[1:]
+	<-j.done
+	if j.err != nil {
+		return j.err
+	}
+	if j.then != nil {
+		return j.then()
+	}
+	return nil
+}
+
+// close stops the workers once they finish the jobs they hold. Follow-ups not
+// yet run are dropped.
+func (p *workerPool) close() {
+	if p.jobs != nil {
+		close(p.jobs)
+		p.jobs = nil
+		p.wg.Wait()
+	}
+	p.queue = nil
+}
@@ -0,0 +1,314 @@
+// Package backuptest builds small, valid Signal backup files in memory, so that
+// tests can exercise the decryption and extraction code without real (and
+// private) backups.
+package backuptest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xeals/signal-back/signal"
+	"github.com/xeals/signal-back/types"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Password is a valid 30-digit passphrase used by Minimal.
+const Password = "000000000000000000000000000000"
+
+// Builder writes an encrypted backup frame by frame.
+// The key derivation here is written out independently of package types, so
+// that a mistake there is not silently repeated when building test files.
+type Builder struct {
+	buf     bytes.Buffer
+	key     []byte
+	macKey  []byte
+	iv      []byte
+	counter uint32
+	version uint32
+}
+
+// Option configures a Builder.
+type Option func(*options)
+
+type options struct {
+	version   uint32
+	kdfRounds int
+	salt      []byte
+	iv        []byte
+}
+
+// WithVersion sets the backup file format version in the header.
+func WithVersion(v uint32) Option {
+	return func(o *options) { o.version = v }
+}
+
+// WithKDFRounds sets the number of key derivation rounds. Fewer rounds keep
+// tests fast; the reader must then be opened with types.WithKDFRounds(n).
+func WithKDFRounds(n int) Option {
+	return func(o *options) { o.kdfRounds = n }
+}
+
+// New starts a backup encrypted with password and writes its header frame.
+// The salt and IV are fixed, so the output is the same on every run.
+func New(password string, opts ...Option) *Builder {
+	o := options{
+		kdfRounds: types.DefaultKDFRounds,
+		salt:      make([]byte, 32),
+		iv:        make([]byte, 16),
+	}
+	for i := range o.salt {
+		o.salt[i] = byte(i)
+	}
+	for i := range o.iv {
+		o.iv[i] = byte(100 + i)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	b := &Builder{
+		iv:      append([]byte{}, o.iv...),
+		counter: binary.BigEndian.Uint32(o.iv),
+		version: o.version,
+	}
+
+	header := &signal.BackupFrame{Header: &signal.Header{Iv: o.iv, Salt: o.salt}}
+	if o.version > 0 {
+		header.Header.Version = &o.version
+	}
+	data, err := proto.Marshal(header)
+	if err != nil {
+		panic(err)
+	}
+	b.writeLength(uint32(len(data)))
+	b.buf.Write(data)
+
+	secrets := make([]byte, 64)
+	kdf := hkdf.New(crypto.SHA256.New, deriveKey(password, o.salt, o.kdfRounds), make([]byte, 32), []byte("Backup Export"))
+	if _, err := io.ReadFull(kdf, secrets); err != nil {
+		panic(err)
+	}
+	b.key, b.macKey = secrets[:32], secrets[32:]
+
+	return b
+}
+
+func deriveKey(password string, salt []byte, rounds int) []byte {
+	input := []byte(strings.ReplaceAll(strings.TrimSpace(password), " ", ""))
+	hash := input
+	digest := crypto.SHA512.New()
+	digest.Write(salt)
+	for i := 0; i < rounds; i++ {
+		digest.Write(hash)
+		digest.Write(input)
+		hash = digest.Sum(nil)
+		digest.Reset()
+	}
+	return hash[:32]
+}
+
+func (b *Builder) writeLength(n uint32) {
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, n)
+	b.buf.Write(l)
+}
+
+// stream returns the cipher for the next frame or attachment.
+func (b *Builder) stream() cipher.Stream {
+	binary.BigEndian.PutUint32(b.iv, b.counter)
+	b.counter++
+	block, err := aes.NewCipher(b.key)
+	if err != nil {
+		panic(err)
+	}
+	return cipher.NewCTR(block, b.iv)
+}
+
+// Frame encrypts and appends a frame.
+func (b *Builder) Frame(f *signal.BackupFrame) {
+	data, err := proto.Marshal(f)
+	if err != nil {
+		panic(err)
+	}
+	s := b.stream()
+	mac := hmac.New(crypto.SHA256.New, b.macKey)
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)+10))
+	if b.version >= 1 {
+		// the length is encrypted and authenticated from version 1 on
+		s.XORKeyStream(length, length)
+		mac.Write(length)
+	}
+	s.XORKeyStream(data, data)
+	mac.Write(data)
+
+	b.buf.Write(length)
+	b.buf.Write(data)
+	b.buf.Write(mac.Sum(nil)[:10])
+}
+
+// Statement appends an SQL statement frame.
+func (b *Builder) Statement(stmt string, params ...*signal.SqlStatement_SqlParameter) {
+	b.Frame(&signal.BackupFrame{Statement: &signal.SqlStatement{Statement: &stmt, Parameters: params}})
+}
+
+// Attachment appends an attachment frame followed by its encrypted data.
+func (b *Builder) Attachment(rowID, attachmentID uint64, data []byte) {
+	length := uint32(len(data))
+	b.Frame(&signal.BackupFrame{Attachment: &signal.Attachment{RowId: &rowID, AttachmentId: &attachmentID, Length: &length}})
+	b.blob(data)
+}
+
+// Avatar appends an avatar frame for a recipient followed by its encrypted data.
+func (b *Builder) Avatar(recipientID string, data []byte) {
+	length := uint32(len(data))
+	b.Frame(&signal.BackupFrame{Avatar: &signal.Avatar{RecipientId: &recipientID, Length: &length}})
+	b.blob(data)
+}
+
+// Sticker appends a sticker frame followed by its encrypted data.
+func (b *Builder) Sticker(rowID uint64, data []byte) {
+	length := uint32(len(data))
+	b.Frame(&signal.BackupFrame{Sticker: &signal.Sticker{RowId: &rowID, Length: &length}})
+	b.blob(data)
+}
+
+func (b *Builder) blob(data []byte) {
+	s := b.stream()
+	mac := hmac.New(crypto.SHA256.New, b.macKey)
+	mac.Write(b.iv)
+
+	enc := make([]byte, len(data))
+	s.XORKeyStream(enc, data)
+	mac.Write(enc)
+
+	b.buf.Write(enc)
+	b.buf.Write(mac.Sum(nil)[:10])
+}
+
+// End appends the end frame.
+func (b *Builder) End() {
+	end := true
+	b.Frame(&signal.BackupFrame{End: &end})
+}
+
+// Bytes returns the backup written so far.
+func (b *Builder) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// WriteFile saves the backup written so far to pathName.
+func (b *Builder) WriteFile(pathName string) error {
+	return os.WriteFile(pathName, b.buf.Bytes(), 0644)
+}
+
+// String, Integer and Null build statement parameters.
+func String(s string) *signal.SqlStatement_SqlParameter {
+	return &signal.SqlStatement_SqlParameter{StringParameter: &s}
+}
+
+func Integer(n int64) *signal.SqlStatement_SqlParameter {
+	u := uint64(n)
+	return &signal.SqlStatement_SqlParameter{IntegerParameter: &u}
+}
+
+func Null() *signal.SqlStatement_SqlParameter {
+	null := true
+	return &signal.SqlStatement_SqlParameter{NullParameter: &null}
+}
+
+// AttachmentData is the content of the attachment in Minimal: a 1x1 PNG header.
+var AttachmentData = []byte{
+	0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a,
+	0, 0, 0, 0x0d, 'I', 'H', 'D', 'R', 0, 0, 0, 1, 0, 0, 0, 1, 8, 6, 0, 0, 0, 0x1f, 0x15, 0xc4, 0x89,
+}
+
+// Minimal returns a complete backup encrypted with Password: a database
+// version, one message with one attachment, and the end frame.
+func Minimal(opts ...Option) *Builder {
+	b := New(Password, opts...)
+
+	version := uint32(120)
+	b.Frame(&signal.BackupFrame{Version: &signal.DatabaseVersion{Version: &version}})
+
+	b.Statement("CREATE TABLE message (_id INTEGER PRIMARY KEY, thread_id INTEGER, date_sent INTEGER, date_received INTEGER, body TEXT)")
+	b.Statement("INSERT INTO message VALUES (?,?,?,?,?)", Integer(1), Integer(1), Integer(1600000000000), Integer(1600000001000), String("hello"))
+	b.Statement("CREATE TABLE attachment (_id INTEGER PRIMARY KEY, message_id INTEGER, content_type TEXT, data_size INTEGER, file_name TEXT, upload_timestamp INTEGER)")
+	b.Statement("INSERT INTO attachment VALUES (?,?,?,?,?,?)", Integer(1), Integer(1), String("image/png"), Integer(int64(len(AttachmentData))), Null(), Integer(0))
+	b.Attachment(1, 1, AttachmentData)
+
+	b.End()
+	return b
+}
+
+// Legacy returns a complete backup in the schema used until 2023, with separate
+// sms, mms and part tables: an incoming and a sent SMS, an incoming MMS with
+// one image part and a sent MMS, across two threads, one of them archived.
+func Legacy(opts ...Option) *Builder {
+	b := New(Password, opts...)
+
+	version := uint32(120)
+	b.Frame(&signal.BackupFrame{Version: &signal.DatabaseVersion{Version: &version}})
+
+	b.Statement("CREATE TABLE recipient (_id INTEGER PRIMARY KEY, phone TEXT, group_id TEXT, system_display_name TEXT, signal_profile_name TEXT, last_profile_fetch INTEGER)")
+	b.Statement("INSERT INTO recipient VALUES (?,?,?,?,?,?)", Integer(1), String("+15551234"), Null(), String("Alice <A&B>"), Null(), Integer(1600000000000))
+	b.Statement("INSERT INTO recipient VALUES (?,?,?,?,?,?)", Integer(2), String("+15559999"), Null(), Null(), String("Bob"), Integer(1600000000000))
+	b.Statement("CREATE TABLE thread (_id INTEGER PRIMARY KEY, recipient_id INTEGER, archived INTEGER DEFAULT 0, pinned INTEGER DEFAULT 0)")
+	b.Statement("INSERT INTO thread VALUES (?,?,?,?)", Integer(1), Integer(1), Integer(0), Integer(0))
+	b.Statement("INSERT INTO thread VALUES (?,?,?,?)", Integer(2), Integer(2), Integer(1), Integer(0))
+	b.Statement("CREATE TABLE sms (_id INTEGER PRIMARY KEY, thread_id INTEGER, address INTEGER, date INTEGER, date_sent INTEGER, protocol INTEGER, read INTEGER, status INTEGER, type INTEGER, subject TEXT, body TEXT, service_center TEXT, subscription_id INTEGER)")
+	b.Statement("INSERT INTO sms VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)", Integer(1), Integer(1), Integer(1), Integer(1600000001000), Integer(1600000000500), Integer(0), Integer(1), Integer(-1), Integer(20), Null(), String("hello <script>\"&\" \r\nline"), Null(), Integer(-1))
+	b.Statement("INSERT INTO sms VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)", Integer(2), Integer(2), Integer(2), Integer(1600000002000), Integer(1600000001500), Integer(0), Integer(1), Integer(-1), Integer(23), Null(), String("sent"), Null(), Integer(-1))
+	b.Statement("CREATE TABLE mms (_id INTEGER PRIMARY KEY, thread_id INTEGER, address INTEGER, read INTEGER, m_type INTEGER, m_size INTEGER, ct_l TEXT, date INTEGER, date_received INTEGER, body TEXT, tr_id TEXT, msg_box INTEGER)")
+	b.Statement("INSERT INTO mms VALUES (?,?,?,?,?,?,?,?,?,?,?,?)", Integer(1), Integer(1), Integer(1), Integer(1), Integer(132), Null(), Null(), Integer(1600000003000), Integer(1600000003500), String("pic"), Null(), Integer(20))
+	b.Statement("INSERT INTO mms VALUES (?,?,?,?,?,?,?,?,?,?,?,?)", Integer(2), Integer(2), Integer(2), Integer(1), Integer(128), Null(), Null(), Integer(1600000004000), Integer(1600000004500), String("mine"), Null(), Integer(23))
+	b.Statement("CREATE TABLE part (_id INTEGER PRIMARY KEY, mid INTEGER, seq INTEGER, ct TEXT, name TEXT, chset INTEGER, cd TEXT, fn TEXT, cid TEXT, cl TEXT, ctt_s INTEGER, ctt_t TEXT, pending_push INTEGER, data_size INTEGER, file_name TEXT, unique_id INTEGER, upload_timestamp INTEGER)")
+	b.Statement("INSERT INTO part VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", Integer(1), Integer(1), Integer(0), String("image/png"), Null(), Null(), Null(), Null(), Null(), Null(), Null(), Null(), Integer(0), Integer(int64(len(AttachmentData))), String("photo.png"), Integer(1600000003001), Integer(0))
+	b.Attachment(1, 1600000003001, AttachmentData)
+
+	b.End()
+	return b
+}
+
+// Unified returns a complete backup in the schema used since 2023, with one
+// message table: a direct conversation with an attachment and a reaction, and
+// an archived group conversation.
+func Unified(opts ...Option) *Builder {
+	b := New(Password, opts...)
+
+	version := uint32(200)
+	b.Frame(&signal.BackupFrame{Version: &signal.DatabaseVersion{Version: &version}})
+
+	b.Statement("CREATE TABLE recipient (_id INTEGER PRIMARY KEY, e164 TEXT, group_id TEXT, system_joined_name TEXT, profile_joined_name TEXT, last_profile_fetch INTEGER)")
+	b.Statement("INSERT INTO recipient VALUES (?,?,?,?,?,?)", Integer(1), String("+15551234"), Null(), String("Alice <A&B>"), Null(), Integer(1600000000000))
+	b.Statement("INSERT INTO recipient VALUES (?,?,?,?,?,?)", Integer(2), String("+15559999"), Null(), Null(), String("Bob"), Integer(1600000000000))
+	b.Statement("INSERT INTO recipient VALUES (?,?,?,?,?,?)", Integer(3), Null(), String("__signal_group__v2__!0123abcd"), Null(), Null(), Integer(0))
+	b.Statement("CREATE TABLE thread (_id INTEGER PRIMARY KEY, recipient_id INTEGER, archived INTEGER DEFAULT 0, pinned INTEGER DEFAULT 0)")
+	b.Statement("INSERT INTO thread VALUES (?,?,?,?)", Integer(1), Integer(1), Integer(0), Integer(1))
+	b.Statement("INSERT INTO thread VALUES (?,?,?,?)", Integer(2), Integer(3), Integer(1), Integer(0))
+	b.Statement("CREATE TABLE groups (_id INTEGER PRIMARY KEY, group_id TEXT, recipient_id INTEGER, title TEXT, timestamp INTEGER)")
+	b.Statement("INSERT INTO groups VALUES (?,?,?,?,?)", Integer(1), String("__signal_group__v2__!0123abcd"), Integer(3), String("Work Group"), Integer(1500000000000))
+	b.Statement("CREATE TABLE message (_id INTEGER PRIMARY KEY, thread_id INTEGER, from_recipient_id INTEGER, to_recipient_id INTEGER, date_received INTEGER, date_sent INTEGER, read INTEGER, st INTEGER, type INTEGER, body TEXT, subscription_id INTEGER, m_type INTEGER, m_size INTEGER, ct_l TEXT, tr_id TEXT, original_message_id INTEGER, revision_number INTEGER, latest_revision_id INTEGER)")
+	b.Statement("INSERT INTO message VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", Integer(1), Integer(1), Integer(1), Integer(2), Integer(1600000001000), Integer(1600000000500), Integer(1), Null(), Integer(20), String("hello <script>\"&\" \r\nline"), Integer(-1), Null(), Null(), Null(), Null(), Null(), Integer(0), Null())
+	b.Statement("INSERT INTO message VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", Integer(2), Integer(1), Integer(2), Integer(1), Integer(1600000002000), Integer(1600000001500), Integer(1), Null(), Integer(23), String("a photo"), Integer(-1), Null(), Null(), Null(), Null(), Null(), Integer(0), Null())
+	b.Statement("INSERT INTO message VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", Integer(3), Integer(2), Integer(1), Integer(3), Integer(1600000003000), Integer(1600000002500), Integer(1), Null(), Integer(20), Null(), Integer(-1), Null(), Null(), Null(), Null(), Null(), Integer(0), Null())
+	b.Statement("CREATE TABLE attachment (_id INTEGER PRIMARY KEY, message_id INTEGER, data_size INTEGER, content_type TEXT, remote_key TEXT, remote_location TEXT, transfer_state INTEGER, file_name TEXT, upload_timestamp INTEGER)")
+	b.Statement("INSERT INTO attachment VALUES (?,?,?,?,?,?,?,?,?)", Integer(7), Integer(2), Integer(int64(len(AttachmentData))), String("image/png"), Null(), Null(), Integer(0), String("photo.png"), Integer(1600000001400))
+	b.Statement("CREATE TABLE reaction (_id INTEGER PRIMARY KEY, message_id INTEGER, author_id INTEGER, emoji TEXT, date_sent INTEGER)")
+	b.Statement("INSERT INTO reaction VALUES (?,?,?,?,?)", Integer(1), Integer(1), Integer(2), String("👍"), Integer(1600000001800))
+	b.Attachment(7, 7, AttachmentData)
+
+	b.End()
+	return b
+}
@@ -0,0 +1,87 @@
+package backuptest
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xeals/signal-back/signal"
+	"github.com/xeals/signal-back/types"
+)
+
+func TestMinimalRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		rounds int
+	}{
+		{"default", nil, types.DefaultKDFRounds},
+		{"version 1", []Option{WithVersion(1), WithKDFRounds(1)}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pathName := filepath.Join(t.TempDir(), "minimal.backup")
+			if err := Minimal(tt.opts...).WriteFile(pathName); err != nil {
+				t.Fatal(err)
+			}
+			bf, err := types.NewBackupFile(pathName, Password, types.WithKDFRounds(tt.rounds))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var version uint32
+			var statements []string
+			var attachments [][]byte
+			ended := false
+			err = bf.Consume(types.ConsumeFuncs{
+				FrameFunc: func(f *signal.BackupFrame, _ int64, _ uint32) error {
+					if v := f.GetVersion(); v != nil {
+						version = v.GetVersion()
+					}
+					ended = ended || f.GetEnd()
+					return nil
+				},
+				StatementFunc: func(s *signal.SqlStatement) error {
+					statements = append(statements, s.GetStatement())
+					return nil
+				},
+				AttachmentFunc: func(a *signal.Attachment) error {
+					var buf bytes.Buffer
+					if err := bf.DecryptAttachment(a.GetLength(), &buf); err != nil {
+						return err
+					}
+					attachments = append(attachments, buf.Bytes())
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version != 120 {
+				t.Errorf("database version = %d, want 120", version)
+			}
+			if len(statements) != 4 || statements[1] != "INSERT INTO message VALUES (?,?,?,?,?)" {
+				t.Errorf("statements = %q", statements)
+			}
+			if !reflect.DeepEqual(attachments, [][]byte{AttachmentData}) {
+				t.Errorf("attachments = %x, want %x", attachments, AttachmentData)
+			}
+			if !ended {
+				t.Error("no end frame")
+			}
+		})
+	}
+}
+
+func TestMinimalWrongPassword(t *testing.T) {
+	b := Minimal(WithVersion(1), WithKDFRounds(1))
+	bf, err := types.NewBackupFileFromReader(bytes.NewReader(b.Bytes()), int64(len(b.Bytes())), "111111111111111111111111111111", types.WithKDFRounds(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bf.ValidatePassword(); err != types.ErrWrongPassword {
+		t.Errorf("ValidatePassword() = %v, want %v", err, types.ErrWrongPassword)
+	}
+}
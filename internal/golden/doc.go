@@ -0,0 +1,11 @@
+// Package golden checks the output of the format command against committed
+// golden files, for a synthetic backup in each schema era: the legacy one with
+// sms, mms and part tables, and the unified one with a single message table.
+// The message models of the two eras are separate code, so a change to one
+// can silently break the other; this catches it.
+//
+// The check is TestGolden:
+//
+//	go test ./internal/golden          # compare
+//	go test ./internal/golden -update  # rewrite the golden files
+package golden
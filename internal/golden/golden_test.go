@@ -0,0 +1,146 @@
+package golden
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+	"github.com/xeals/signal-back/cmd"
+	"github.com/xeals/signal-back/internal/backuptest"
+	_ "modernc.org/sqlite"
+)
+
+// kdfRounds keeps key derivation quick; the backups are built to match.
+const kdfRounds = 1
+
+// era is one schema era, and the files that format writes from its database,
+// named so that format picks the output format and table from the name.
+type era struct {
+	name   string
+	backup func(opts ...backuptest.Option) *backuptest.Builder
+	files  []string
+}
+
+var eras = []era{
+	{"legacy", backuptest.Legacy, []string{"messages.xml", "messages.html", "sms.json", "sms.csv", "mms.json", "mms.csv", "part.csv", "contacts.vcf"}},
+	{"unified", backuptest.Unified, []string{"messages.xml", "messages.html", "message.json", "message.ndjson", "message.csv", "attachment.csv", "reaction.json", "contacts.vcf"}},
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+func TestGolden(t *testing.T) {
+	differ, err := check(t, "testdata", *update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		t.Log("golden files updated in testdata")
+	} else if differ > 0 {
+		t.Errorf("%d files differ from their golden copies", differ)
+	}
+}
+
+// check formats each era's files in a temporary folder and compares them with
+// the golden files in dir, or writes them there if update is set. It returns
+// the number of files that differ, each of which is reported to t.
+func check(t *testing.T, dir string, update bool) (int, error) {
+	golden, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	work, err := os.MkdirTemp("", "signal-back-golden")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(work)
+	// Attachment paths in the XML are relative to the working folder
+	start, err := os.Getwd()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Chdir(work); err != nil {
+		return 0, err
+	}
+	defer os.Chdir(start)
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{cmd.Extract, cmd.Format}
+	run := func(args ...string) error {
+		return app.Run(append([]string{"signal-back"}, args...))
+	}
+
+	differ := 0
+	for _, e := range eras {
+		if err := e.backup(backuptest.WithKDFRounds(kdfRounds)).WriteFile(e.name + ".backup"); err != nil {
+			return differ, err
+		}
+		err := run("extract", "-q", "-p", backuptest.Password, "--kdf-rounds", fmt.Sprint(kdfRounds),
+			"-o", e.name, e.name+".backup")
+		if err != nil {
+			return differ, fmt.Errorf("%s: extract: %v", e.name, err)
+		}
+
+		for _, f := range e.files {
+			name := filepath.Join(e.name, f)
+			out := filepath.Join(e.name, "out", f)
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return differ, err
+			}
+			if err := run("format", "-q", "--timezone", "UTC", "-o", out, filepath.Join(e.name, "signal.db")); err != nil {
+				return differ, fmt.Errorf("%s: format: %v", name, err)
+			}
+			got, err := os.ReadFile(out)
+			if err != nil {
+				return differ, err
+			}
+
+			want := filepath.Join(golden, name)
+			if update {
+				if err := os.MkdirAll(filepath.Dir(want), 0755); err != nil {
+					return differ, err
+				}
+				if err := os.WriteFile(want, got, 0644); err != nil {
+					return differ, err
+				}
+				continue
+			}
+			expected, err := os.ReadFile(want)
+			if err != nil {
+				return differ, fmt.Errorf("%v (run with -update to create it)", err)
+			}
+			if diff := firstDifference(expected, got); diff != "" {
+				t.Errorf("%s: %s", name, diff)
+				differ++
+			}
+		}
+	}
+	return differ, nil
+}
+
+// firstDifference describes the first line where got differs from want, or
+// returns "" if they are the same.
+func firstDifference(want, got []byte) string {
+	if bytes.Equal(want, got) {
+		return ""
+	}
+	w := strings.Split(string(want), "\n")
+	g := strings.Split(string(got), "\n")
+	for i := 0; i < len(w) || i < len(g); i++ {
+		var wl, gl string
+		if i < len(w) {
+			wl = w[i]
+		}
+		if i < len(g) {
+			gl = g[i]
+		}
+		if wl != gl || i >= len(w) || i >= len(g) {
+			return fmt.Sprintf("line %d differs\n\twant: %q\n\tgot:  %q", i+1, wl, gl)
+		}
+	}
+	return "files differ"
+}
@@ -0,0 +1,140 @@
+// Package logging is a small leveled logger shared by the commands and the
+// backup types. Lines go to stderr as plain text, or as one JSON object each
+// for tools that filter them by level.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel reads a level given by name, as debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) || (name == "warn" && strings.EqualFold(s, "warning")) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.Errorf("log level '%s' not recognised; use debug, info, warn or error", s)
+}
+
+// Fields are the key-value pairs attached to a line by WithFields.
+type Fields map[string]interface{}
+
+var (
+	mu       sync.Mutex
+	out      io.Writer = os.Stderr
+	minLevel           = Warn
+	asJSON   bool
+)
+
+// Configure sets where lines are written, the least severe level written, and
+// whether each line is a JSON object rather than plain text.
+func Configure(w io.Writer, level Level, jsonLines bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	out, minLevel, asJSON = w, level, jsonLines
+}
+
+// Enabled reports whether lines at level are written.
+func Enabled(level Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return level >= minLevel
+}
+
+// Entry is a logger that adds the same fields to every line.
+type Entry struct {
+	fields Fields
+}
+
+// WithFields returns a logger that adds fields to every line it writes.
+func WithFields(fields Fields) Entry {
+	return Entry{fields}
+}
+
+func (e Entry) Debugf(format string, a ...interface{}) { e.logf(Debug, format, a...) }
+func (e Entry) Infof(format string, a ...interface{})  { e.logf(Info, format, a...) }
+func (e Entry) Warnf(format string, a ...interface{})  { e.logf(Warn, format, a...) }
+func (e Entry) Errorf(format string, a ...interface{}) { e.logf(Error, format, a...) }
+
+func Debugf(format string, a ...interface{}) { Entry{}.logf(Debug, format, a...) }
+func Infof(format string, a ...interface{})  { Entry{}.logf(Info, format, a...) }
+func Warnf(format string, a ...interface{})  { Entry{}.logf(Warn, format, a...) }
+func Errorf(format string, a ...interface{}) { Entry{}.logf(Error, format, a...) }
+
+func (e Entry) logf(level Level, format string, a ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if level < minLevel {
+		return
+	}
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	if asJSON {
+		// Written by hand, so that time, level and msg always come first
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for _, k := range keys {
+			b.WriteByte(',')
+			writeJSON(&b, k)
+			b.WriteByte(':')
+			writeJSON(&b, e.fields[k])
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "%s %-5s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%v", k, e.fields[k])
+		}
+		b.WriteByte('\n')
+	}
+	io.WriteString(out, b.String())
+}
+
+func writeJSON(b *strings.Builder, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		bs, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(bs)
+}
@@ -25,8 +25,12 @@ func main() {
 	app.Version = version
 	app.Commands = []cli.Command{
 		cmd.Analyse,
+		cmd.Diff,
 		cmd.Extract,
 		cmd.Format,
+		cmd.Keys,
+		cmd.Prune,
+		cmd.ValidateXML,
 	}
 	app.ArgsUsage = "BACKUPFILE"
 	app.Flags = []cli.Flag{
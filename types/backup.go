@@ -1,6 +1,7 @@
 package types
 
 import (
+	"context"
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
@@ -10,22 +11,38 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"os"
 	"strings"
-	// "log"
 	// "encoding/hex"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/internal/logging"
 	"github.com/xeals/signal-back/signal"
 	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
-// ATTACHMENT_BUFFER_SIZE is the size of the buffer in bytes used for decrypting attachments.
-// Larger values of this consume more memory, but have been measured to not actually decrease
-// the overall time taken.
+// ATTACHMENT_BUFFER_SIZE is the default size of the buffer in bytes used for decrypting
+// attachments, BackupFile.BufferSize. Larger values consume more memory, and on most machines
+// have been measured to not actually decrease the overall time taken.
 const ATTACHMENT_BUFFER_SIZE = 8192
 
+// DefaultKDFRounds is the number of SHA-512 rounds Signal uses to derive the backup key
+// from the password. Some forks and very old versions used other values.
+const DefaultKDFRounds = 250000
+
+// ErrWrongPassword is returned by Frame, and ValidatePassword, when a frame does not match its
+// MAC, which almost always means the password is wrong.
+var ErrWrongPassword = errors.New("Decryption error, wrong password")
+
+// ErrAttachmentMAC is returned by DecryptAttachment when the attachment data does not match
+// its MAC. The attachment bytes have been fully consumed, so reading can continue with the
+// next frame.
+var ErrAttachmentMAC = errors.New("attachment data does not match its MAC")
+
+// ErrStopConsume may be returned by a ConsumeFuncs callback to end Consume early without error.
+var ErrStopConsume = errors.New("stop consume")
+
 // ProtoCommitHash is the commit hash of the Signal Protobuf spec.
 var ProtoCommitHash = "c6473ca"
 
@@ -39,33 +56,69 @@ var ProtoCommitURL = fmt.Sprintf("https://github.com/signalapp/Signal-Android/bl
 // Closing the underlying file handle is the responsibilty of the programmer if implementing the
 // iteration manually, or is done as part of the Consume method.
 type BackupFile struct {
-	file      *os.File
-	Version   uint32
-	FileSize  int64
-	CipherKey []byte
-	MacKey    []byte
-	Mac       hash.Hash
-	IV        []byte
-	Salt      []byte
-	Counter   uint32
+	file       *positionReader
+	Version    uint32
+	KDFRounds  int // SHA-512 rounds the key was derived with
+	BufferSize int // bytes of attachment data decrypted at a time
+	FileSize   int64
+	CipherKey  []byte
+	MacKey     []byte
+	Mac        hash.Hash
+	IV         []byte
+	Salt       []byte
+	Counter    uint32
+
+	verified bool // a frame has passed its MAC check, so the password is right
+}
+
+// Option configures how NewBackupFile opens a backup.
+type Option func(*backupOptions)
+
+type backupOptions struct {
+	kdfRounds int
+}
+
+// WithKDFRounds overrides the number of key-derivation rounds (DefaultKDFRounds).
+func WithKDFRounds(rounds int) Option {
+	return func(o *backupOptions) {
+		o.kdfRounds = rounds
+	}
 }
 
 // NewBackupFile initialises a backup file for reading using the provided path
-// and password.
-func NewBackupFile(path, password string) (*BackupFile, error) {
-	info, err := os.Stat(path)
+// and password. A backup compressed with gzip, or stored alone in a zip archive,
+// is decompressed as it is read.
+func NewBackupFile(path, password string, opts ...Option) (*BackupFile, error) {
+	source, size, err := openSource(path)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to get size of backup file")
+		return nil, err
 	}
-	size := info.Size()
-
-	file, err := os.Open(path)
+	bf, err := NewBackupFileFromReader(source, size, password, opts...)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to open backup file")
+		source.Close()
+		return nil, err
 	}
+	return bf, nil
+}
+
+// NewBackupFileFromReader initialises a backup file for reading from r, whose
+// length is size bytes, or 0 if unknown. If r is an io.Closer, closing the
+// BackupFile closes it.
+func NewBackupFileFromReader(r io.Reader, size int64, password string, opts ...Option) (*BackupFile, error) {
+	o := backupOptions{
+		kdfRounds: DefaultKDFRounds,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.kdfRounds <= 0 {
+		return nil, errors.New("key derivation rounds must be positive")
+	}
+
+	file := &positionReader{r: r}
 
 	headerLengthBytes := make([]byte, 4)
-	_, err = io.ReadFull(file, headerLengthBytes)
+	_, err := io.ReadFull(file, headerLengthBytes)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read headerLengthBytes")
 	}
@@ -91,29 +144,46 @@ func NewBackupFile(path, password string) (*BackupFile, error) {
 		return nil, errors.New("No IV in header")
 	}
 
-	key := backupKey(password, frame.Header.Salt)
+	key := backupKey(password, frame.Header.Salt, o.kdfRounds)
 	derived := deriveSecrets(key, []byte("Backup Export"))
 	cipherKey := derived[:32]
 	macKey := derived[32:]
 
 	return &BackupFile{
-		file:      file,
-		Version:   version,
-		FileSize:  size,
-		CipherKey: cipherKey,
-		MacKey:    macKey,
-		Mac:       hmac.New(crypto.SHA256.New, macKey),
-		IV:        iv,
-		Salt:      frame.Header.Salt,
-		Counter:   bytesToUint32(iv),
+		file:       file,
+		Version:    version,
+		KDFRounds:  o.kdfRounds,
+		BufferSize: ATTACHMENT_BUFFER_SIZE,
+		FileSize:   size,
+		CipherKey:  cipherKey,
+		MacKey:     macKey,
+		Mac:        hmac.New(crypto.SHA256.New, macKey),
+		IV:         iv,
+		Salt:       frame.Header.Salt,
+		Counter:    bytesToUint32(iv),
 	}, nil
 }
 
-// Frame returns the next frame in the file.
+// truncatedError reports a backup that ends partway through the frame or attachment
+// starting at start, which needed need more bytes than were left.
+func (bf *BackupFile) truncatedError(start, need int64) error {
+	end := bf.FileSize
+	if end == 0 || end < start {
+		end = bf.file.pos
+	}
+	return errors.Errorf("backup file is truncated at offset %d: %d bytes were needed from %#x, but only %d remain",
+		end, need, start, end-start)
+}
+
+// Frame returns the next frame in the file. It returns io.EOF at the end of the file, and an
+// error naming the offset if the file ends partway through a frame.
 func (bf *BackupFile) Frame() (uint32, *signal.BackupFrame, error) {
+	start := bf.file.pos
 	length := make([]byte, 4)
 	_, err := io.ReadFull(bf.file, length)
-	if err != nil {
+	if err == io.ErrUnexpectedEOF {
+		return 0, nil, bf.truncatedError(start, 4)
+	} else if err != nil {
 		return 0, nil, err
 	}
 
@@ -137,9 +207,25 @@ func (bf *BackupFile) Frame() (uint32, *signal.BackupFrame, error) {
 	}
 
 	frameLength := bytesToUint32(length)
+	if bf.FileSize > 0 && int64(frameLength) > bf.FileSize-bf.file.pos {
+		// Before any frame has been verified, a length that runs off the end is
+		// almost always one decrypted with the wrong key; reading it could mean
+		// allocating gigabytes only to fail the MAC check
+		if bf.Version >= 1 && !bf.verified {
+			return 0, nil, ErrWrongPassword
+		}
+		return 0, nil, bf.truncatedError(start, 4+int64(frameLength))
+	}
 	frame := make([]byte, frameLength)
 
-	io.ReadFull(bf.file, frame)
+	if _, err := io.ReadFull(bf.file, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil, bf.truncatedError(start, 4+int64(frameLength))
+	} else if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to read frame")
+	}
+	if frameLength < 10 {
+		return 0, nil, errors.Errorf("frame at %#x is too short to hold its MAC", start)
+	}
 
 	messageLength := len(frame) - 10
 	theirMac := frame[messageLength:]
@@ -149,8 +235,9 @@ func (bf *BackupFile) Frame() (uint32, *signal.BackupFrame, error) {
 
 	if !hmac.Equal(theirMac, ourMac) {
 		// log.Printf("MAC expect %s found %s", hex.EncodeToString(ourMac), hex.EncodeToString(theirMac))
-		return 0, nil, errors.New("Decryption error, wrong password")
+		return 0, nil, ErrWrongPassword
 	}
+	bf.verified = true
 
 	output := make([]byte, messageLength)
 	stream.XORKeyStream(output, frame[:messageLength])
@@ -161,19 +248,37 @@ func (bf *BackupFile) Frame() (uint32, *signal.BackupFrame, error) {
 	return frameLength, decoded, nil
 }
 
+// ValidatePassword checks the password by reading the first frame and verifying its MAC,
+// without reading the rest of the file. It returns ErrWrongPassword if the password is
+// wrong. The frame is consumed, so the backup must be opened again to read it.
+func (bf *BackupFile) ValidatePassword() error {
+	_, _, err := bf.Frame()
+	if err == io.EOF {
+		return errors.New("backup has no frames to check the password against")
+	}
+	return err
+}
+
 // DecryptAttachment reads the attachment immediately next in the file's bytes, using a streaming
-// intermediate buffer of size ATTACHMENT_BUFFER_SIZE.
+// intermediate buffer of size BufferSize, or ATTACHMENT_BUFFER_SIZE if that is not set.
 func (bf *BackupFile) DecryptAttachment(length uint32, out io.Writer) error {
 	// if length == 0 {
 	// 	return errors.New("can't read attachment of length 0")
 	// }
 
+	start, need := bf.file.pos, int64(length)+10
+	if bf.FileSize > 0 && need > bf.FileSize-start {
+		return bf.truncatedError(start, need)
+	}
+
 	uint32ToBytes(bf.IV, bf.Counter)
 	bf.Counter++
 
 	if out == nil {
-		_, err := bf.file.Seek(int64(length + 10), io.SeekCurrent)
-		if err != nil {
+		err := bf.file.skip(int64(length) + 10)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return bf.truncatedError(start, need)
+		} else if err != nil {
 			return errors.Wrap(err, "failed to seek over attachment data")
 		}
 		return nil
@@ -187,18 +292,24 @@ func (bf *BackupFile) DecryptAttachment(length uint32, out io.Writer) error {
 	bf.Mac.Reset()
 	bf.Mac.Write(bf.IV)
 
-	buf := make([]byte, ATTACHMENT_BUFFER_SIZE)
+	size := bf.BufferSize
+	if size <= 0 {
+		size = ATTACHMENT_BUFFER_SIZE
+	}
+	buf := make([]byte, size)
 	output := make([]byte, len(buf))
 
 	for length > 0 {
 		// Go can't read an arbitrary number of bytes,
 		// so we have to downsize the buffers instead.
-		if length < ATTACHMENT_BUFFER_SIZE {
-			buf = make([]byte, length)
-			output = make([]byte, length)
+		if length < uint32(len(buf)) {
+			buf = buf[:length]
+			output = output[:length]
 		}
-		n, err := bf.file.Read(buf)
-		if err != nil {
+		n, err := io.ReadFull(bf.file, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return bf.truncatedError(start, need)
+		} else if err != nil {
 			return errors.Wrap(err, "failed to read attachment data")
 		}
 		bf.Mac.Write(buf)
@@ -212,12 +323,16 @@ func (bf *BackupFile) DecryptAttachment(length uint32, out io.Writer) error {
 	}
 
 	theirMac := make([]byte, 10)
-	io.ReadFull(bf.file, theirMac)
+	if _, err := io.ReadFull(bf.file, theirMac); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return bf.truncatedError(start, need)
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read attachment MAC")
+	}
 	ourMac := bf.Mac.Sum(nil)[:10]
 
 	if !hmac.Equal(theirMac, ourMac) {
 		// log.Printf("MAC expect %s found %s", hex.EncodeToString(ourMac), hex.EncodeToString(theirMac))
-		return errors.New("Decryption error, wrong password")
+		return ErrAttachmentMAC
 	}
 
 	return nil
@@ -232,6 +347,7 @@ type ConsumeFuncs struct {
 	PreferenceFunc func(*signal.SharedPreference) error
 	KeyValueFunc   func(*signal.KeyValue) error
 	StatementFunc  func(*signal.SqlStatement) error
+	ProgressFunc   func(bytesRead, totalBytes int64)
 }
 
 // Consume iterates over the backup file using the fields in the provided ConsumeFuncs. When a
@@ -240,9 +356,20 @@ type ConsumeFuncs struct {
 // If any image-related functions are nil (e.g., AttachmentFunc) the default will be to discard the
 // next *n* bytes, where n is the Attachment.Length.
 //
+// Any function may return ErrStopConsume to stop reading once it has what it needs.
+//
+// ProgressFunc, if set, is called after each frame, attachment data included, with the number of
+// bytes read so far and FileSize, which is 0 if the size is not known.
+//
 // The underlying file is closed at the end of the method, and the backup file should be considered
 // spent.
 func (bf *BackupFile) Consume(fns ConsumeFuncs) error {
+	return bf.ConsumeContext(context.Background(), fns)
+}
+
+// ConsumeContext is Consume, stopping before the next frame once ctx is done and returning
+// ctx.Err(). A frame that has been started, with its attachment data, is always finished first.
+func (bf *BackupFile) ConsumeContext(ctx context.Context, fns ConsumeFuncs) error {
 	var (
 		pos     int64
 		length  uint32
@@ -270,11 +397,11 @@ func (bf *BackupFile) Consume(fns ConsumeFuncs) error {
 	}
 
 	for {
-		pos, err = bf.file.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return errors.Wrap(err, "consume [seek]")
+		if err = ctx.Err(); err != nil {
+			return err
 		}
 
+		pos = bf.file.pos
 		length, f, err = bf.Frame()
 		if err == io.EOF {
 			break
@@ -282,64 +409,107 @@ func (bf *BackupFile) Consume(fns ConsumeFuncs) error {
 			return err
 		}
 
+		if fields := UnknownFields(f); len(fields) > 0 {
+			logging.Warnf("frame at %#x has unhandled field(s) %v, it may be from a newer version of Signal", pos, fields)
+		}
+
 		if fn := fns.FrameFunc; fn != nil {
-			if err = fn(f, pos, length); err != nil {
+			if err = fn(f, pos, length); err == ErrStopConsume {
+				return nil
+			} else if err != nil {
 				return errors.Wrap(err, "consume [frame]")
 			}
 		}
 
 		if fn := fns.AttachmentFunc; fn != nil {
 			if data := f.GetAttachment(); data != nil {
-				if err = fn(data); err != nil {
+				if err = fn(data); err == ErrStopConsume {
+					return nil
+				} else if err != nil {
 					return errors.Wrap(err, "consume [attachment]")
 				}
 			}
 		}
 		if fn := fns.AvatarFunc; fn != nil {
 			if data := f.GetAvatar(); data != nil {
-				if err = fn(data); err != nil {
+				if err = fn(data); err == ErrStopConsume {
+					return nil
+				} else if err != nil {
 					return errors.Wrap(err, "consume [avatar]")
 				}
 			}
 		}
 		if fn := fns.StickerFunc; fn != nil {
 			if data := f.GetSticker(); data != nil {
-				if err = fn(data); err != nil {
+				if err = fn(data); err == ErrStopConsume {
+					return nil
+				} else if err != nil {
 					return errors.Wrap(err, "consume [sticker]")
 				}
 			}
 		}
 		if fn := fns.PreferenceFunc; fn != nil {
 			if data := f.GetPreference(); data != nil {
-				if err = fn(data); err != nil {
+				if err = fn(data); err == ErrStopConsume {
+					return nil
+				} else if err != nil {
 					return errors.Wrap(err, "consume [preference]")
 				}
 			}
 		}
 		if fn := fns.KeyValueFunc; fn != nil {
 			if data := f.GetKeyValue(); data != nil {
-				if err = fn(data); err != nil {
+				if err = fn(data); err == ErrStopConsume {
+					return nil
+				} else if err != nil {
 					return errors.Wrap(err, "consume [keyvalue]")
 				}
 			}
 		}
 		if fn := fns.StatementFunc; fn != nil {
 			if data := f.GetStatement(); data != nil {
-				if err = fn(data); err != nil {
+				if err = fn(data); err == ErrStopConsume {
+					return nil
+				} else if err != nil {
 					return errors.Wrap(err, "consume [statement]")
 				}
 			}
 		}
+
+		if fns.ProgressFunc != nil {
+			fns.ProgressFunc(bf.file.pos, bf.FileSize)
+		}
 	}
 
 	return nil
 }
 
+// UnknownFields lists the field numbers in a frame that are not part of the protobuf
+// spec this was built with, such as frame types added to Signal since then. Their
+// contents are not extracted.
+func UnknownFields(f *signal.BackupFrame) []int32 {
+	var fields []int32
+	b := f.XXX_unrecognized
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			break
+		}
+		b = b[n:]
+		fields = append(fields, int32(num))
+	}
+	return fields
+}
+
 func (bf *BackupFile) Close() error {
 	return bf.file.Close()
 }
 
-func backupKey(password string, salt []byte) []byte {
+func backupKey(password string, salt []byte, rounds int) []byte {
 	digest := crypto.SHA512.New()
 	input := []byte(strings.Replace(strings.TrimSpace(password), " ", "", -1))
 	hash := input
@@ -348,7 +518,7 @@ func backupKey(password string, salt []byte) []byte {
 		digest.Write(salt)
 	}
 
-	for i := 0; i < 250000; i++ {
+	for i := 0; i < rounds; i++ {
 		digest.Write(hash)
 		digest.Write(input)
 		hash = digest.Sum(nil)
@@ -366,7 +536,7 @@ func deriveSecrets(input, info []byte) []byte {
 	hkdf := hkdf.New(sha, input, salt, info)
 	_, err := io.ReadFull(hkdf, okm)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to generate hashes:", err.Error())
+		logging.Errorf("failed to generate hashes: %v", err)
 	}
 
 	return okm
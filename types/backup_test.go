@@ -0,0 +1,134 @@
+package types_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/xeals/signal-back/internal/backuptest"
+	"github.com/xeals/signal-back/signal"
+	"github.com/xeals/signal-back/types"
+)
+
+// frameRead is what readBackup saw of a frame.
+type frameRead struct {
+	pos, length int64
+	attachment  []byte // decrypted, for an attachment frame
+}
+
+// readBackup reads every frame of the backup in r, as readFrames.
+func readBackup(r io.Reader, size int64, decrypt bool) ([]frameRead, error) {
+	bf, err := types.NewBackupFileFromReader(r, size, backuptest.Password, types.WithKDFRounds(1))
+	if err != nil {
+		return nil, err
+	}
+	return readFrames(bf, decrypt)
+}
+
+// readFrames reads every frame of bf, decrypting attachments if decrypt is set
+// and skipping them otherwise.
+func readFrames(bf *types.BackupFile, decrypt bool) ([]frameRead, error) {
+	var frames []frameRead
+	err := bf.Consume(types.ConsumeFuncs{
+		FrameFunc: func(_ *signal.BackupFrame, pos int64, length uint32) error {
+			frames = append(frames, frameRead{pos: pos, length: int64(length)})
+			return nil
+		},
+		AttachmentFunc: func(a *signal.Attachment) error {
+			if !decrypt {
+				return bf.DecryptAttachment(a.GetLength(), nil)
+			}
+			var buf bytes.Buffer
+			err := bf.DecryptAttachment(a.GetLength(), &buf)
+			frames[len(frames)-1].attachment = buf.Bytes()
+			return err
+		},
+	})
+	return frames, err
+}
+
+func TestTruncated(t *testing.T) {
+	for _, version := range []uint32{0, 1} {
+		backup := backuptest.Minimal(backuptest.WithVersion(version), backuptest.WithKDFRounds(1)).Bytes()
+		frames, err := readBackup(bytes.NewReader(backup), int64(len(backup)), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Minimal is version, four statements, attachment, end
+		statement, attachment := frames[3], frames[5]
+		data := attachment.pos + 4 + attachment.length
+
+		cuts := []struct {
+			name string
+			at   int64
+		}{
+			{"in a frame length", statement.pos + 2},
+			{"in a frame", statement.pos + 4 + statement.length/2},
+			{"in a frame MAC", statement.pos + 4 + statement.length - 3},
+			{"in attachment data", data + int64(len(backuptest.AttachmentData))/2},
+			{"in an attachment MAC", data + int64(len(backuptest.AttachmentData)) + 5},
+		}
+		for _, cut := range cuts {
+			for _, size := range []int64{cut.at, 0} {
+				for _, decrypt := range []bool{true, false} {
+					// Skipped data is sought over unless the source hides Seek,
+					// and a seek past the end only shows at the next frame
+					var r io.Reader = bytes.NewReader(backup[:cut.at])
+					if !decrypt {
+						r = struct{ io.Reader }{r}
+					}
+					name := fmt.Sprintf("version %d, %s, size %d, decrypt %t", version, cut.name, size, decrypt)
+					_, err := readBackup(r, size, decrypt)
+					if err == nil {
+						t.Errorf("%s: no error", name)
+						continue
+					}
+					if want := fmt.Sprintf("truncated at offset %d:", cut.at); !strings.Contains(err.Error(), want) {
+						t.Errorf("%s: %v, want %q", name, err, want)
+					}
+					if errors.Cause(err) == types.ErrWrongPassword {
+						t.Errorf("%s: reported as a wrong password", name)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestSkipUnseekable reads a backup from a source that cannot seek, so that
+// skipped attachments are read through instead, and checks that every frame
+// after them is read as from a source that can.
+func TestSkipUnseekable(t *testing.T) {
+	large := bytes.Repeat([]byte("skipped"), 6000) // more than io.CopyN reads at once
+	b := backuptest.New(backuptest.Password, backuptest.WithVersion(1), backuptest.WithKDFRounds(1))
+	b.Statement("CREATE TABLE attachment (_id INTEGER PRIMARY KEY)")
+	b.Attachment(1, 1, backuptest.AttachmentData)
+	b.Attachment(2, 2, large)
+	b.Statement("INSERT INTO attachment VALUES (1), (2)")
+	b.End()
+	backup := b.Bytes()
+
+	want, err := readBackup(bytes.NewReader(backup), int64(len(backup)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 5 || !bytes.Equal(want[1].attachment, backuptest.AttachmentData) || !bytes.Equal(want[2].attachment, large) {
+		t.Fatalf("frames = %v", want)
+	}
+	for i := range want {
+		want[i].attachment = nil
+	}
+	for _, size := range []int64{int64(len(backup)), 0} {
+		got, err := readBackup(struct{ io.Reader }{bytes.NewReader(backup)}, size, false)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("size %d: frames = %v, want %v", size, got, want)
+		}
+	}
+}
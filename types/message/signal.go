@@ -2,9 +2,15 @@ package message
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
 )
 
 // Correspondent represents a 'recipient' DB record.
@@ -38,6 +44,52 @@ func NewCorrespondent(correspondent DbCorrespondent) (int64, Correspondent) {
 	return correspondent.ID, xml
 }
 
+// Group id prefixes, from GroupId in Signal-Android. The id bytes follow in hex.
+const (
+	GroupIdPrefixV1  = "__textsecure_group__!"
+	GroupIdPrefixV2  = "__signal_group__v2__!"
+	GroupIdPrefixMMS = "__signal_mms_group__!"
+)
+
+// CanonicalGroupId returns a group id in the text form Signal itself uses,
+// a prefix and the id in hex. Ids stored as raw bytes, which otherwise show
+// as garbage, are converted: 16 bytes for a v1 group, 32 for a v2 group, and
+// plain hex for any other length. Ids already in text form are unchanged.
+func CanonicalGroupId(raw []byte) string {
+	s := string(raw)
+	for _, prefix := range []string{GroupIdPrefixV1, GroupIdPrefixV2, GroupIdPrefixMMS} {
+		if strings.HasPrefix(s, prefix) {
+			id := s[len(prefix):]
+			if _, err := hex.DecodeString(id); err == nil {
+				return s
+			}
+			return prefix + hex.EncodeToString([]byte(id))
+		}
+	}
+	if isPrintable(s) {
+		return s
+	}
+	switch len(raw) {
+	case 16:
+		return GroupIdPrefixV1 + hex.EncodeToString(raw)
+	case 32:
+		return GroupIdPrefixV2 + hex.EncodeToString(raw)
+	}
+	return hex.EncodeToString(raw)
+}
+
+func isPrintable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
 type DbGroup struct {
 	GroupId     string
 	RecipientId int64
@@ -48,15 +100,26 @@ type DbGroup struct {
 type DbThread struct {
 	ID          int64
 	RecipientId int64
+	Archived    int64
 }
 
 // Messages holds a set of Message records.
 type Messages struct {
 	XMLName  xml.Name  `xml:"messages"`
 	Count    int       `xml:"count,attr"`
+	Avatars  []Avatar  `xml:"avatar"`
 	Messages []Message `xml:"message"`
 }
 
+// Avatar holds the picture shown beside the messages of one recipient, as
+// base64 data.
+type Avatar struct {
+	XMLName     xml.Name `xml:"avatar"`
+	RecipientId int64    `xml:"recipient_id,attr"`
+	ContentType string   `xml:"content_type,attr"`
+	Data        string   `xml:"data,attr"`
+}
+
 type AttachmentList struct {
 	XMLName xml.Name `xml:"attachments"`
 	Attachments   []Attachment
@@ -81,6 +144,14 @@ type Message struct {
 	ContactName           *string   `xml:"contact_name,attr"`           // required
 	GroupName           *string   `xml:"group_name,attr"`           // required
 	GroupDate       uint64  `xml:"-"`      // optional
+	SenderId        int64   `xml:"-"`
+	ThreadId        int64   `xml:"-"`
+	AvatarId        *int64  `xml:"avatar_id,attr"` // optional, recipient_id of an Avatar
+	Forwarded      bool     `xml:"forwarded,attr,omitempty"` // optional
+	Special        string   `xml:"special,attr,omitempty"`   // optional, SpecialKind or story, story_reply
+	Edits          []Edit   `xml:"edit"`                // optional
+	Reactions      []Reaction `xml:"reaction"`          // optional
+	Receipts       []Receipt  `xml:"receipt"`           // optional
 }
 
 // https://github.com/signalapp/Signal-Android/blob/main/app/src/main/java/org/thoughtcrime/securesms/database/MessageTable.kt
@@ -105,11 +176,17 @@ type DbMessage struct {
 	TrId            sql.NullString //TransactionID
 }
 
-// NewMessage constructs an XML Message struct from a SQL record.
-func NewMessage(msg DbMessage) Message {
+// NewMessage constructs an XML Message struct from a SQL record. A message of
+// unrecognised type is still constructed, as SMSInvalid, along with the error,
+// so that callers can report it and carry on.
+func NewMessage(msg DbMessage, dates Dates) (Message, error) {
+	smsType, err := TranslateSMSType(msg.Type)
+	if err != nil {
+		err = errors.WithMessage(err, fmt.Sprintf("message ID = %d", msg.ID))
+	}
 	xml := Message{
 		MessageId:          msg.ID,
-		Type:           TranslateSMSType(msg.Type),
+		Type:           smsType,
 		Body:           StringPtr(msg.Body),
 		SubscriptionId: msg.SubscriptionId,
 		DateSent:     msg.DateSent,
@@ -120,12 +197,14 @@ func NewMessage(msg DbMessage) Message {
 		TrId:         StringRef(msg.TrId),
 		MType:         IntPtr(msg.MType),
 		MSize:        "null",
-		ReadableDate: IntToTime(&msg.DateSent),
+		ReadableDate: dates.Readable(&msg.DateSent),
+		SenderId:     msg.FromRecipientId,
+		Special:      SpecialKind(msg.Type),
 	}
 	if v := IntPtr(msg.MSize); v != nil {
 		xml.MSize = strconv.FormatUint(*v, 10)
 	}
-	return xml
+	return xml, err
 }
 
 func SetMessageContact(msg *DbMessage, xml *Message, correspondents map[int64]DbCorrespondent, threads map[int64]DbThread, groups map[int64]DbGroup) {
@@ -133,7 +212,7 @@ func SetMessageContact(msg *DbMessage, xml *Message, correspondents map[int64]Db
 		tid := thread.RecipientId
 		
 		if group, ok := groups[tid]; ok {
-			name := StringPtr(group.Title)
+			name := NamePtr(group.Title)
 			if name == nil || *name == "" {
 				generic := fmt.Sprintf("Group%d", tid)
 				name = &generic
@@ -150,15 +229,135 @@ func SetMessageContact(msg *DbMessage, xml *Message, correspondents map[int64]Db
 	}
 
 	if correspondent, ok := correspondents[id]; ok {
-		name := StringPtr(correspondent.SystemJoinedName)
-		if name == nil {
-			name = StringPtr(correspondent.ProfileJoinedName)
-		}
-		if name == nil {
-			name = StringPtr(correspondent.E164)
-		}
-		xml.ContactName = name
+		xml.ContactName = CorrespondentName(correspondent)
+	}
+}
+
+// CorrespondentName picks the best available display name for a recipient.
+func CorrespondentName(correspondent DbCorrespondent) *string {
+	name := NamePtr(correspondent.SystemJoinedName)
+	if name == nil {
+		name = NamePtr(correspondent.ProfileJoinedName)
+	}
+	if name == nil {
+		name = StringPtr(correspondent.E164)
+	}
+	return name
+}
+
+// Edit holds a prior revision of an edited Message.
+type Edit struct {
+	XMLName      xml.Name `xml:"edit"`
+	Revision     int64    `xml:"revision,attr"`
+	DateSent     uint64   `xml:"date_sent,attr"`
+	ReadableDate *string  `xml:"readable_date,attr"`
+	Body         *string  `xml:"body,attr"`
+}
+
+// Message revision fields as stored in signal database (relevant subset)
+// Superseded revisions point at the newest one through LatestRevisionId.
+type DbRevision struct {
+	ID               int64
+	LatestRevisionId sql.NullInt64
+	RevisionNumber   int64
+	DateSent         uint64
+	Body             sql.NullString
+}
+
+// NewEdit constructs an XML Edit struct from a SQL record.
+func NewEdit(rev DbRevision, dates Dates) Edit {
+	return Edit{
+		Revision:     rev.RevisionNumber,
+		DateSent:     rev.DateSent,
+		ReadableDate: dates.Readable(&rev.DateSent),
+		Body:         StringPtr(rev.Body),
+	}
+}
+
+// Reaction holds an emoji reaction to a Message.
+type Reaction struct {
+	XMLName      xml.Name `xml:"reaction"`
+	Emoji        string   `xml:"emoji,attr"`
+	Author       *string  `xml:"author,attr"`
+	DateSent     uint64   `xml:"date_sent,attr"`
+	ReadableDate *string  `xml:"readable_date,attr"`
+}
+
+// Reaction fields as stored in signal database (relevant subset)
+type DbReaction struct {
+	ID        int64
+	MessageId int64
+	AuthorId  int64
+	Emoji     string
+	DateSent  uint64
+}
+
+// NewReaction constructs an XML Reaction struct from a SQL record.
+func NewReaction(reaction DbReaction, correspondents map[int64]DbCorrespondent, dates Dates) Reaction {
+	xml := Reaction{
+		Emoji:        reaction.Emoji,
+		DateSent:     reaction.DateSent,
+		ReadableDate: dates.Readable(&reaction.DateSent),
+	}
+	if correspondent, ok := correspondents[reaction.AuthorId]; ok {
+		xml.Author = CorrespondentName(correspondent)
 	}
+	return xml
+}
+
+// Receipt holds the delivery state of a sent Message for one recipient.
+// Signal keeps only the latest receipt, so a message that has been read
+// has a read time but no delivery time.
+type Receipt struct {
+	XMLName      xml.Name `xml:"receipt"`
+	ContactName  *string  `xml:"contact_name,attr"`
+	Status       string   `xml:"status,attr"`
+	DeliveredAt  uint64   `xml:"delivered_at,attr,omitempty"`
+	ReadAt       uint64   `xml:"read_at,attr,omitempty"`
+	ReadableDate *string  `xml:"readable_date,attr"`
+}
+
+// Group receipt fields as stored in signal database (relevant subset)
+type DbGroupReceipt struct {
+	ID        int64
+	MmsId     int64
+	Address   int64
+	Status    int64
+	Timestamp uint64
+}
+
+// Receipt status values, from GroupReceiptTable
+const (
+	ReceiptUndelivered = 0
+	ReceiptDelivered   = 1
+	ReceiptRead        = 2
+	ReceiptViewed      = 3
+)
+
+// NewReceipt constructs an XML Receipt struct for a recipient in the given
+// status since timestamp (0 if unknown).
+func NewReceipt(recipientId int64, status int64, timestamp uint64, correspondents map[int64]DbCorrespondent, dates Dates) Receipt {
+	xml := Receipt{}
+	switch status {
+	case ReceiptViewed:
+		xml.Status = "viewed"
+		xml.ReadAt = timestamp
+	case ReceiptRead:
+		xml.Status = "read"
+		xml.ReadAt = timestamp
+	case ReceiptDelivered:
+		xml.Status = "delivered"
+		xml.DeliveredAt = timestamp
+	default:
+		xml.Status = "sent"
+	}
+	if timestamp > 0 && xml.Status != "sent" {
+		xml.ReadableDate = dates.Readable(&timestamp)
+	}
+	if correspondent, ok := correspondents[recipientId]; ok {
+		xml.ContactName = CorrespondentName(correspondent)
+	}
+	return xml
 }
 
 // Attachment holds a single attachment for a Message.
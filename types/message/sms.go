@@ -2,10 +2,10 @@ package message
 
 import (
 	"database/sql"
-	"log"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Character sets as specified by IANA.
@@ -53,19 +53,21 @@ const (
 	MMSMBoxDescr                             // 147
 )
 
+// SetMMSMessageType sets the message type of mms, and the box and version
+// that go with it. Notifications and reports about another message, such as
+// delivery and read reports, have no box of their own, which is left as it is.
+// The message store types from 139 up are an error.
 func SetMMSMessageType(messageType uint64, mms *MMS) error {
 	switch messageType {
-	case MMSSendReq:
+	case MMSSendReq, MMSForwardReq:
 		mms.MsgBox = 2
 		mms.V = 18
-		break
-	case MMSNotificationInd:
-		// We can safely ignore this case.
-		break
 	case MMSRetrieveConf:
 		mms.MsgBox = 1
 		mms.V = 16
-		break
+	case MMSSendConf, MMSNotificationInd, MMSNotifyResponseInd, MMSAckknowledgeInd,
+		MMSDeliveryInd, MMSReadRecInd, MMSReadOrigInd, MMSForwardConf:
+		// No box of their own
 	default:
 		return errors.Errorf("unsupported message type %v encountered", messageType)
 	}
@@ -74,45 +76,115 @@ func SetMMSMessageType(messageType uint64, mms *MMS) error {
 	return nil
 }
 
-func TranslateSMSType(t int64) SMSType {
+// MMSTypeForBox picks the MMS message type matching the direction of a
+// Signal message type: MMSRetrieveConf for incoming messages and MMSSendReq
+// for outgoing ones. It reports false if the direction is not known.
+func MMSTypeForBox(t int64) (uint64, bool) {
+	switch v := uint8(t) & 0x1F; {
+	case v == 20: // signal inbox
+		return MMSRetrieveConf, true
+	case 21 <= v && v <= 26: // outbox, sending, sent, failed, pending fallbacks
+		return MMSSendReq, true
+	}
+	return 0, false
+}
+
+// TranslateSMSType maps a Signal message type to the SMS type it is exported as.
+// A base type that Signal does not define is an error, with SMSInvalid.
+// Special kinds of message, such as gift badges, keep the SMS type of their
+// direction; see SpecialKind.
+func TranslateSMSType(t int64) (SMSType, error) {
 	// Just get the lowest 5 bits, because everything else is masking.
 	// https://github.com/signalapp/Signal-Android/blob/main/app/src/main/java/org/thoughtcrime/securesms/database/MessageTypes.java
 	v := uint8(t) & 0x1F
 
 	if 1 <= v && v <= 18 {
-		return SMSInvalid
+		return SMSInvalid, nil
 	}
 
 	switch v {
 	case 20: // signal inbox
-		return SMSReceived
+		return SMSReceived, nil
 	case 21: // signal outbox
-		return SMSOutbox
+		return SMSOutbox, nil
 	case 22: // signal sending
-		return SMSQueued
+		return SMSQueued, nil
 	case 23: // signal sent
-		return SMSSent
+		return SMSSent, nil
 	case 24: // signal failed
-		return SMSFailed
+		return SMSFailed, nil
 	case 25: // pending secure SMS fallback
-		return SMSQueued
+		return SMSQueued, nil
 	case 26: // pending insecure SMS fallback
-		return SMSQueued
+		return SMSQueued, nil
 	case 27: // signal draft
-		return SMSDraft
+		return SMSDraft, nil
 
 	default:
-		log.Fatalf("undefined SMS type: %#v\nplease report this issue, as well as (if possible) details about the SMS,\nsuch as whether it was sent, received, drafted, etc.\n", t)
-		log.Fatalf("note that the output XML may not properly import to Signal\n")
-		return SMSInvalid
+		return SMSInvalid, errors.Errorf("undefined SMS type: %#v\nplease report this issue, as well as (if possible) details about the SMS,\nsuch as whether it was sent, received, drafted, etc.", t)
+	}
+}
+
+// Special kinds of message, in the bits above the base type and its flags.
+// See SPECIAL_TYPES_MASK in MessageTypes.java.
+const (
+	specialTypesMask            = 0xF00000000
+	specialStoryReaction        = 0x100000000
+	specialGiftBadge            = 0x200000000
+	specialPaymentsNotification = 0x300000000
+	specialPaymentsActivateReq  = 0x400000000
+	specialPaymentsActivated    = 0x800000000
+)
+
+// SpecialKind names the special kind of a Signal message type, or returns ""
+// for an ordinary message. The kinds are:
+//
+//	story_reaction    a reaction to a story, shown in the chat
+//	gift_badge        a badge given as a gift
+//	payment           a payment notification
+//	payment_request   a request to activate payments
+//	payment_activated a notice that payments were activated
+//
+// Kinds added to Signal since are all "special", so they are still marked.
+func SpecialKind(t int64) string {
+	switch t & specialTypesMask {
+	case 0:
+		return ""
+	case specialStoryReaction:
+		return "story_reaction"
+	case specialGiftBadge:
+		return "gift_badge"
+	case specialPaymentsNotification:
+		return "payment"
+	case specialPaymentsActivateReq:
+		return "payment_request"
+	case specialPaymentsActivated:
+		return "payment_activated"
 	}
+	return "special"
 }
 
-func IntToTime(n *uint64) *string {
-	if n == nil {
+// Dates controls how the constructors give dates.
+type Dates struct {
+	// Location is the time zone that readable dates are shown in; nil is
+	// time.Local.
+	Location *time.Location
+	// Numeric, if set, gives every date as epoch milliseconds only: there are
+	// no readable_date attributes, and MMS date_sent is not converted to seconds.
+	Numeric bool
+}
+
+// Readable gives the date n, in epoch milliseconds, in readable form, or nil
+// if n is nil or d.Numeric is set.
+func (d Dates) Readable(n *uint64) *string {
+	if n == nil || d.Numeric {
 		return nil
 	}
-	unix := time.Unix(int64(*n)/1000, 0)
+	loc := d.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	unix := time.Unix(int64(*n)/1000, 0).In(loc)
 	t := unix.Format("Jan 02, 2006 3:04:05 PM")
 	return &t
 }
@@ -124,6 +196,17 @@ func StringPtr(ns sql.NullString) *string {
 	return nil
 }
 
+// NamePtr is StringPtr for names of people and groups. Phones store names in
+// either Unicode normalization form; they are converted to NFC so the same
+// name always sorts and compares the same way.
+func NamePtr(ns sql.NullString) *string {
+	if ns.Valid {
+		name := norm.NFC.String(ns.String)
+		return &name
+	}
+	return nil
+}
+
 func StringRef(ns sql.NullString) string {
 	if ns.Valid {
 		return ns.String
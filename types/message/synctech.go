@@ -4,8 +4,9 @@ import (
 	"database/sql"
 	"encoding/xml"
 	"fmt"
-	"log"
 	"strconv"
+
+	"github.com/pkg/errors"
 )
 
 // XML fields are as specified by the page content and .xsd file at:
@@ -67,11 +68,13 @@ type SMS struct {
 	DateSent       *uint64  `xml:"date_sent,attr"`      // optional
 	ReadableDate   *string  `xml:"readable_date,attr"`  // optional
 	ContactName    *string  `xml:"contact_name,attr"`   // optional
+	ThreadId       int64    `xml:"-"`
 }
 
 // SMS fields as stored in signal database (relevant subset)
 type DbSMS struct {
 	ID             int64
+	ThreadId       int64
 	Address        int64
 	Date           uint64
 	DateSent       uint64
@@ -85,12 +88,17 @@ type DbSMS struct {
 	SubscriptionId int64
 }
 
-// NewSMS constructs an XML SMS struct from a SQL record.
-func NewSMS(sms DbSMS, recipient DbRecipient) SMS {
+// NewSMS constructs an XML SMS struct from a SQL record. As with NewMessage,
+// an SMS of unrecognised type is constructed along with the error.
+func NewSMS(sms DbSMS, recipient DbRecipient, dates Dates) (SMS, error) {
+	smsType, err := TranslateSMSType(sms.Type)
+	if err != nil {
+		err = errors.WithMessage(err, fmt.Sprintf("SMS ID = %d", sms.ID))
+	}
 	xml := SMS{
 		Address:        StringRef(recipient.Phone),
 		Date:           sms.Date,
-		Type:           TranslateSMSType(sms.Type),
+		Type:           smsType,
 		Subject:        StringPtr(sms.Subject),
 		Body:           StringRef(sms.Body),
 		ServiceCenter:  StringPtr(sms.ServiceCenter),
@@ -98,16 +106,17 @@ func NewSMS(sms DbSMS, recipient DbRecipient) SMS {
 		Read:           sms.Read,
 		Status:         sms.Status,
 		DateSent:       &sms.DateSent,
-		ReadableDate:   IntToTime(&sms.Date),
-		ContactName:    StringPtr(recipient.SystemDisplayName),
+		ReadableDate:   dates.Readable(&sms.Date),
+		ContactName:    NamePtr(recipient.SystemDisplayName),
+		ThreadId:       sms.ThreadId,
 	}
 	if v := IntPtr(sms.Protocol); v != nil {
 		xml.Protocol = v
 	}
 	if xml.ContactName == nil {
-		xml.ContactName = StringPtr(recipient.SignalProfileName)
+		xml.ContactName = NamePtr(recipient.SignalProfileName)
 	}
-	return xml
+	return xml, err
 }
 
 type MMSPartList struct {
@@ -155,11 +164,13 @@ type MMS struct {
 	SimSlot      *string `xml:"sim_slot,attr"`      // optional
 	ReadableDate *string `xml:"readable_date,attr"` // optional
 	ContactName  *string `xml:"contact_name,attr"`  // optional
+	ThreadId     int64   `xml:"-"`
 }
 
 // MMS fields as stored in signal database (relevant subset)
 type DbMMS struct {
 	ID           int64
+	ThreadId     int64
 	Address      int64
 	Read         uint64
 	MType        uint64         //MessageType
@@ -169,10 +180,14 @@ type DbMMS struct {
 	DateReceived uint64
 	Body         sql.NullString
 	TrId         sql.NullString //TransactionID
+	MsgBox       int64          //Signal message type, as for SMS
 }
 
-// NewMMS constructs an XML MMS struct from a SQL record.
-func NewMMS(mms DbMMS, recipient DbRecipient) MMS {
+// NewMMS constructs an XML MMS struct from a SQL record. As with NewSMS, an
+// MMS of a message type that SetMMSMessageType does not support is constructed
+// along with the error: the type is left unset, and the box is taken from the
+// Signal message type.
+func NewMMS(mms DbMMS, recipient DbRecipient, dates Dates) (MMS, error) {
 	xml := MMS{
 		TextOnly:     0,
 		Sub:          "null",
@@ -199,27 +214,37 @@ func NewMMS(mms DbMMS, recipient DbRecipient) MMS {
 		RetrTxt:      "null",
 		RespSt:       "null",
 		MSize:        "null",
-		ReadableDate: IntToTime(&mms.DateReceived),
+		ReadableDate: dates.Readable(&mms.DateReceived),
 		Address:      StringRef(recipient.Phone),
-		ContactName:  StringPtr(recipient.SystemDisplayName),
+		ContactName:  NamePtr(recipient.SystemDisplayName),
 		MId:          mms.ID,
+		ThreadId:     mms.ThreadId,
 	}
 	if xml.ContactName == nil {
-		xml.ContactName = StringPtr(recipient.SignalProfileName)
+		xml.ContactName = NamePtr(recipient.SignalProfileName)
+	}
+	if dates.Numeric {
+		xml.DateSent = mms.Date
 	}
 	if mms.MSize.Valid {
 		xml.MSize = strconv.FormatInt(mms.MSize.Int64, 10)
 	}
-	if err := SetMMSMessageType(mms.MType, &xml); err != nil {
-		body := StringPtr(mms.Body)
-		if body == nil {
-			s := "null"
-			body = &s
+	// An unsupported type leaves MType nil and the box unset
+	err := SetMMSMessageType(mms.MType, &xml)
+	if err != nil {
+		err = errors.WithMessage(err, fmt.Sprintf("MMS ID = %d", mms.ID))
+	}
+	if xml.MsgBox == 0 {
+		// Message types such as MMSNotificationInd imply no box of their own
+		switch mtype, _ := MMSTypeForBox(mms.MsgBox); mtype {
+		case MMSRetrieveConf:
+			xml.MsgBox = 1
+		case MMSSendReq:
+			xml.MsgBox = 2
 		}
-		log.Fatalf("%v\nplease report this issue, as well as (if possible) details about the MMS\nID = %d, body = %s\n\n%v", err, mms.ID, *body, mms)
 	}
 
-	return xml
+	return xml, err
 }
 
 // MMSPart holds a data blob for an MMS.
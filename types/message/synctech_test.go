@@ -0,0 +1,53 @@
+package message
+
+import "testing"
+
+func TestNewMMSMessageType(t *testing.T) {
+	tests := []struct {
+		name   string
+		mtype  uint64
+		box    int64 // Signal message type
+		msgBox uint64
+		v      uint64
+	}{
+		{"notification incoming", MMSNotificationInd, 20, 1, 0},
+		{"notification sent", MMSNotificationInd, 23, 2, 0},
+		{"delivery report", MMSDeliveryInd, 20, 1, 0},
+		{"delivery report unknown box", MMSDeliveryInd, 1, 0, 0},
+		{"forward", MMSForwardReq, 20, 2, 18},
+		{"retrieve", MMSRetrieveConf, 23, 1, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml, err := NewMMS(DbMMS{MType: tt.mtype, MsgBox: tt.box}, DbRecipient{}, Dates{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if xml.MType == nil || *xml.MType != tt.mtype {
+				t.Errorf("MType = %v, want %d", xml.MType, tt.mtype)
+			}
+			if xml.MsgBox != tt.msgBox || xml.V != tt.v {
+				t.Errorf("MsgBox, V = %d, %d, want %d, %d", xml.MsgBox, xml.V, tt.msgBox, tt.v)
+			}
+		})
+	}
+}
+
+func TestSetMMSMessageTypeUnsupported(t *testing.T) {
+	var xml MMS
+	if err := SetMMSMessageType(MMSMBoxStoreReq, &xml); err == nil {
+		t.Error("no error for an unsupported message type")
+	}
+	if xml.MType != nil || xml.MsgBox != 0 {
+		t.Errorf("MType, MsgBox = %v, %d, want unset", xml.MType, xml.MsgBox)
+	}
+
+	// NewMMS reports the type, and falls back to the Signal message box
+	xml, err := NewMMS(DbMMS{MType: MMSMBoxStoreReq, MsgBox: 20}, DbRecipient{}, Dates{})
+	if err == nil {
+		t.Error("NewMMS gave no error for an unsupported message type")
+	}
+	if xml.MType != nil || xml.MsgBox != 1 {
+		t.Errorf("MType, MsgBox = %v, %d, want nil, 1", xml.MType, xml.MsgBox)
+	}
+}
@@ -79,13 +79,14 @@ func (s *Schema) HasField(name string) bool {
 	return ok
 }
 
-func (s *Schema) Field(row []*signal.SqlStatement_SqlParameter, column string) interface{} {
+// Field returns the value of the named column in row. It reports false if the
+// column is not in the schema or the row is too short to contain it.
+func (s *Schema) Field(row []*signal.SqlStatement_SqlParameter, column string) (interface{}, bool) {
 	i, ok := s.Index[column]
-	t     := s.Type[i]
-	if !ok {
-		panic("Field not found: " + column)
+	if !ok || i >= len(row) || i >= len(s.Type) {
+		return nil, false
 	}
-	return ParameterValue(row[i], t)
+	return ParameterValue(row[i], s.Type[i]), true
 }
 
 func (s *Schema) RowValues(row []*signal.SqlStatement_SqlParameter) []interface{} {
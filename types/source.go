@@ -0,0 +1,129 @@
+package types
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// openSource opens the backup at path, decompressing it if it is wrapped in gzip or
+// in a zip archive holding a single .backup file. The size returned is that of the
+// backup itself, or 0 when the wrapper does not record it.
+func openSource(path string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "unable to open backup file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, errors.Wrap(err, "unable to get size of backup file")
+	}
+	size := info.Size()
+
+	magic := make([]byte, len(zipMagic))
+	n, _ := file.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, 0, errors.Wrap(err, "unable to read gzip backup file")
+		}
+		return &wrappedSource{gz, []io.Closer{gz, file}}, 0, nil
+
+	case bytes.HasPrefix(magic, zipMagic):
+		zr, err := zip.NewReader(file, size)
+		if err != nil {
+			file.Close()
+			return nil, 0, errors.Wrap(err, "unable to read zip backup file")
+		}
+		var backups []*zip.File
+		for _, f := range zr.File {
+			if !f.FileInfo().IsDir() && strings.HasSuffix(strings.ToLower(f.Name), ".backup") {
+				backups = append(backups, f)
+			}
+		}
+		if len(backups) != 1 {
+			file.Close()
+			return nil, 0, errors.Errorf("zip archive must contain exactly one .backup file, found %d", len(backups))
+		}
+		rc, err := backups[0].Open()
+		if err != nil {
+			file.Close()
+			return nil, 0, errors.Wrapf(err, "unable to open %s in zip archive", backups[0].Name)
+		}
+		return &wrappedSource{rc, []io.Closer{rc, file}}, int64(backups[0].UncompressedSize64), nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, errors.Wrap(err, "unable to open backup file")
+	}
+	return file, size, nil
+}
+
+// wrappedSource reads a decompressed backup, closing the decompressor and the file
+// beneath it together.
+type wrappedSource struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *wrappedSource) Close() error {
+	var first error
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// positionReader counts the bytes read from a backup, so that frame positions can be
+// reported for sources that cannot seek.
+type positionReader struct {
+	r      io.Reader
+	pos    int64
+	noSeek bool // a seek failed, as it does for a pipe even though it is an *os.File
+}
+
+func (p *positionReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.pos += int64(n)
+	return n, err
+}
+
+// skip discards the next n bytes, seeking over them when the source allows and
+// reading through them otherwise.
+func (p *positionReader) skip(n int64) error {
+	if s, ok := p.r.(io.Seeker); ok && !p.noSeek {
+		if _, err := s.Seek(n, io.SeekCurrent); err == nil {
+			p.pos += n
+			return nil
+		}
+		// A seek that fails, such as on a pipe (ESPIPE), leaves the offset as it was
+		p.noSeek = true
+	}
+	_, err := io.CopyN(io.Discard, p, n)
+	return err
+}
+
+func (p *positionReader) Close() error {
+	if c, ok := p.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
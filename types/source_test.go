@@ -0,0 +1,91 @@
+package types_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xeals/signal-back/internal/backuptest"
+	"github.com/xeals/signal-back/types"
+)
+
+// zipped returns a zip archive of the named files.
+func zipped(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenSource(t *testing.T) {
+	backup := backuptest.Minimal(backuptest.WithKDFRounds(1)).Bytes()
+	other := backuptest.Legacy(backuptest.WithKDFRounds(1)).Bytes()
+	want, err := readBackup(bytes.NewReader(backup), int64(len(backup)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(backup)
+	w.Close()
+
+	tests := []struct {
+		name string
+		file []byte
+		size int64  // FileSize
+		err  string // or "" to read the Minimal backup
+	}{
+		{"plain", backup, int64(len(backup)), ""},
+		{"gzip", gz.Bytes(), 0, ""},
+		{"zip", zipped(t, map[string][]byte{"signal.backup": backup}), int64(len(backup)), ""},
+		{"zip with other files", zipped(t, map[string][]byte{"notes.txt": []byte("hi"), "old/": nil, "Signal.BACKUP": backup}), int64(len(backup)), ""},
+		{"zip with no backup", zipped(t, map[string][]byte{"signal.txt": backup}), 0, "exactly one .backup file, found 0"},
+		{"zip with two backups", zipped(t, map[string][]byte{"signal.backup": backup, "old/signal.backup": other}), 0, "exactly one .backup file, found 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pathName := filepath.Join(t.TempDir(), "test.backup")
+			if err := os.WriteFile(pathName, tt.file, 0644); err != nil {
+				t.Fatal(err)
+			}
+			bf, err := types.NewBackupFile(pathName, backuptest.Password, types.WithKDFRounds(1))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bf.FileSize != tt.size {
+				t.Errorf("FileSize = %d, want %d", bf.FileSize, tt.size)
+			}
+			got, err := readFrames(bf, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("frames = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package types
 
 import (
+	"fmt"
 	"io"
-	"log"
 	"os"
+
+	"github.com/xeals/signal-back/internal/logging"
 )
 
 // MultiWriter is a convenience wrapper around an io.Writer to allow multiple
@@ -34,9 +36,9 @@ func (w *MultiWriter) Error() error {
 
 func rescue(v ...interface{}) {
 	if r := recover(); r != nil {
-		log.Println("Panicked:", r)
+		logging.Errorf("panicked: %v", r)
 		if v != nil {
-			log.Println(v)
+			logging.Errorf("%s", fmt.Sprint(v...))
 			os.Exit(2)
 		}
 	}
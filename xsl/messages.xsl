@@ -2,6 +2,7 @@
 <xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform"  
                 xmlns:msxsl="urn:schemas-microsoft-com:xslt"
                 xmlns:user="http://android.riteshsahu.com">
+<xsl:key name="avatar" match="avatar" use="@recipient_id"/>
 <xsl:template match="/">
 
 <html>
@@ -43,6 +44,19 @@
 			white-space: pre-wrap;
 			max-width: 680px;
 		}
+		.edit
+		{
+			color:#888;
+			font-size:0.9em;
+		}
+		.avatar
+		{
+			width:40px;
+			height:40px;
+			border-radius:50%;
+			float:left;
+			margin-right:8px;
+		}
 		</style>
 	</head>
 	<body>
@@ -55,10 +69,15 @@
 			<th>Contact</th>
 			<th>Message</th>
 		</tr>
-		<xsl:for-each select="messages/*">
+		<xsl:for-each select="messages/message">
 		<tr>
 			<td><xsl:value-of select="@group_name"/></td>
-			<td class="date"><xsl:value-of select="@readable_date"/></td>
+			<td class="date">
+				<xsl:choose>
+					<xsl:when test="@readable_date"><xsl:value-of select="@readable_date"/></xsl:when>
+					<xsl:otherwise><xsl:value-of select="@date"/></xsl:otherwise>
+				</xsl:choose>
+			</td>
 			<td>
 				<xsl:if test="@type = 1">
 				From
@@ -72,6 +91,30 @@
 			</td>
 			<td><xsl:value-of select="@contact_name"/></td>
 			<td>
+				<xsl:for-each select="key('avatar', @avatar_id)">
+					<img class="avatar">
+						<xsl:attribute name="src">
+							<xsl:value-of select="concat(concat('data:',@content_type), concat(';base64,',@data))"/>
+						</xsl:attribute>
+					</img>
+				</xsl:for-each>
+				<xsl:if test="@forwarded = 'true'">
+					<div class="edit"><i>Forwarded</i></div>
+				</xsl:if>
+				<xsl:if test="@special">
+					<div class="edit"><i>
+						<xsl:choose>
+							<xsl:when test="@special = 'story'">Story</xsl:when>
+							<xsl:when test="@special = 'story_reply'">Reply to a story</xsl:when>
+							<xsl:when test="@special = 'story_reaction'">Reaction to a story</xsl:when>
+							<xsl:when test="@special = 'gift_badge'">Gift badge</xsl:when>
+							<xsl:when test="@special = 'payment'">Payment</xsl:when>
+							<xsl:when test="@special = 'payment_request'">Request to activate payments</xsl:when>
+							<xsl:when test="@special = 'payment_activated'">Payments activated</xsl:when>
+							<xsl:otherwise>Special message</xsl:otherwise>
+						</xsl:choose>
+					</i></div>
+				</xsl:if>
 				<xsl:for-each select="attachments/attachment">
 					<xsl:choose>
 						<xsl:when test="@src">
@@ -89,6 +132,20 @@
 							  </xsl:attribute>
 							</img><br/>
 						</xsl:when>
+						<xsl:when test="starts-with(@content_type,'audio/')" >
+							<audio controls="controls">
+							  <xsl:attribute name="src">
+								<xsl:value-of select="concat(concat('data:',@content_type), concat(';base64,',@data))"/>
+							  </xsl:attribute>
+							</audio><br/>
+						</xsl:when>
+						<xsl:when test="starts-with(@content_type,'video/')" >
+							<video controls="controls">
+							  <xsl:attribute name="src">
+								<xsl:value-of select="concat(concat('data:',@content_type), concat(';base64,',@data))"/>
+							  </xsl:attribute>
+							</video><br/>
+						</xsl:when>
 						<xsl:otherwise>
 							<i>Preview of <xsl:value-of select="@content_type"/> not supported.</i><br/>
 						</xsl:otherwise>
@@ -97,6 +154,34 @@
 				<div class="body">
 					<xsl:value-of select="@body"/>
 				</div>
+				<xsl:for-each select="edit">
+					<div class="edit">
+						Edited from (<xsl:choose><xsl:when test="@readable_date"><xsl:value-of select="@readable_date"/></xsl:when><xsl:otherwise><xsl:value-of select="@date_sent"/></xsl:otherwise></xsl:choose>):
+						<div class="body"><xsl:value-of select="@body"/></div>
+					</div>
+				</xsl:for-each>
+				<xsl:if test="reaction">
+					<div class="edit">
+						<xsl:for-each select="reaction">
+							<span>
+								<xsl:attribute name="title"><xsl:value-of select="@author"/></xsl:attribute>
+								<xsl:value-of select="@emoji"/>
+							</span>
+						</xsl:for-each>
+					</div>
+				</xsl:if>
+				<xsl:for-each select="receipt">
+					<div class="edit">
+						<xsl:choose>
+							<xsl:when test="@status = 'read'">Read</xsl:when>
+							<xsl:when test="@status = 'viewed'">Viewed</xsl:when>
+							<xsl:when test="@status = 'delivered'">Delivered</xsl:when>
+							<xsl:otherwise>Sent</xsl:otherwise>
+						</xsl:choose>
+						<xsl:if test="../@group_name"> by <xsl:value-of select="@contact_name"/></xsl:if>
+						<xsl:if test="@readable_date"> at <xsl:value-of select="@readable_date"/></xsl:if>
+					</div>
+				</xsl:for-each>
 			</td>
 		</tr>
 		</xsl:for-each>
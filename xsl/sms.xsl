@@ -89,7 +89,12 @@
 		  </xsl:choose>
 		  <td><xsl:value-of select="@address"/></td>
 		  <td><xsl:value-of select="@contact_name"/></td>
-		  <td><xsl:value-of select="@readable_date"/></td>
+		  <td>
+			<xsl:choose>
+			<xsl:when test="@readable_date"><xsl:value-of select="@readable_date"/></xsl:when>
+			<xsl:otherwise><xsl:value-of select="@date"/></xsl:otherwise>
+			</xsl:choose>
+		  </td>
 		  <td>
 			<xsl:choose>
 			<xsl:when test="name() = 'sms'">
@@ -122,6 +127,20 @@
 						  </xsl:attribute>
 						</img><br/>
 					</xsl:when>
+					<xsl:when test="starts-with(@ct,'audio/')" >
+						<audio controls="controls">
+						  <xsl:attribute name="src">
+							<xsl:value-of select="concat(concat('data:',@ct), concat(';base64,',@data))"/>
+						  </xsl:attribute>
+						</audio><br/>
+					</xsl:when>
+					<xsl:when test="starts-with(@ct,'video/')" >
+						<video controls="controls">
+						  <xsl:attribute name="src">
+							<xsl:value-of select="concat(concat('data:',@ct), concat(';base64,',@data))"/>
+						  </xsl:attribute>
+						</video><br/>
+					</xsl:when>
 					<xsl:otherwise>
 						<i>Preview of <xsl:value-of select="@ct"/> not supported.</i><br/>
 					</xsl:otherwise>